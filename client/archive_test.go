@@ -0,0 +1,54 @@
+package main
+
+import (
+    "crypto/rand"
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// TestCompressDirectoryMaxSize checks that a directory whose archive would
+// outgrow -max-archive-size fails with errArchiveTooLarge and leaves no
+// partial archive behind, in both formats.
+func TestCompressDirectoryMaxSize(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "data")
+    if err := os.Mkdir(src, 0755); err != nil {
+        t.Fatal(err)
+    }
+    // Random bytes do not compress, so the archive is at least this large.
+    data := make([]byte, 256<<10)
+    rand.Read(data)
+    if err := os.WriteFile(filepath.Join(src, "big.bin"), data, 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    for format, compress := range map[string]func(string, string, int64) (string, error){
+        "zip":   compressDirectory,
+        "targz": compressDirectoryTarGz,
+    } {
+        t.Run(format, func(t *testing.T) {
+            out := filepath.Join(t.TempDir(), "data"+archiveExtensions[format])
+            _, err := compress(src, out, 64<<10)
+            if !errors.Is(err, errArchiveTooLarge) {
+                t.Fatalf("err = %v, want errArchiveTooLarge", err)
+            }
+            if _, err := os.Stat(out); !os.IsNotExist(err) {
+                t.Errorf("partial archive left behind: %v", err)
+            }
+
+            // The same directory fits under a limit above its size.
+            name, err := compress(src, out, 1<<20)
+            if err != nil {
+                t.Fatal(err)
+            }
+            info, err := os.Stat(name)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if info.Size() > 1<<20 {
+                t.Errorf("archive is %d bytes, over the limit", info.Size())
+            }
+        })
+    }
+}
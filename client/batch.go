@@ -0,0 +1,141 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "strings"
+    "time"
+)
+
+// fileList collects repeated -file flags, each of which may also hold a
+// comma-separated list.
+type fileList []string
+
+func (f *fileList) String() string {
+    return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(value string) error {
+    for _, path := range strings.Split(value, ",") {
+        if path = strings.TrimSpace(path); path != "" {
+            *f = append(*f, path)
+        }
+    }
+    return nil
+}
+
+// defaultReportPath is used for batches when -report is not given.
+const defaultReportPath = "transfer-failures.jsonl"
+
+// failureRecord is one line of the failure report written by runBatch and
+// read back by -retry-failed.
+type failureRecord struct {
+    Path  string    `json:"path"`
+    Error string    `json:"error"`
+    Time  time.Time `json:"time"`
+}
+
+// runBatch transfers files one after another with send and returns how many
+// failed and how many were not sent. A failure is recorded in reportPath and
+// the batch moves on with continueOnError; otherwise it stops there. A
+// pending interrupt is honoured between files. The files a stop leaves
+// unsent are recorded too, so -retry-failed picks them up.
+func runBatch(send func(path string) error, files []string, continueOnError bool, reportPath string) (failed, unsent int) {
+    for i, path := range files {
+        if stopAfterCurrent() {
+            fmt.Printf("Interrupted, %d file(s) not sent.\n", len(files)-i)
+            recordUnsent(reportPath, files[i:], "interrupted")
+            return failed, len(files) - i
+        }
+
+        if len(files) > 1 {
+            infof("[%d/%d] %s\n", i+1, len(files), path)
+        }
+        err := send(path)
+        if err == nil {
+            continue
+        }
+
+        failed++
+        fmt.Printf("Failed to transfer %s: %v\n", path, err)
+        if reportPath != "" {
+            if repErr := appendFailure(reportPath, failureRecord{Path: path, Error: err.Error(), Time: time.Now()}); repErr != nil {
+                fmt.Printf("Failed to write failure report: %v\n", repErr)
+            }
+        }
+        if !continueOnError && i < len(files)-1 {
+            fmt.Printf("Stopping, %d file(s) not sent.\n", len(files)-i-1)
+            recordUnsent(reportPath, files[i+1:], "an earlier file failed")
+            return failed, len(files) - i - 1
+        }
+    }
+    return failed, 0
+}
+
+// recordUnsent lists the files a batch stopped before in reportPath, with
+// the reason it stopped.
+func recordUnsent(reportPath string, files []string, reason string) {
+    if reportPath == "" {
+        return
+    }
+    now := time.Now()
+    for _, path := range files {
+        if err := appendFailure(reportPath, failureRecord{Path: path, Error: "not sent: " + reason, Time: now}); err != nil {
+            fmt.Printf("Failed to write failure report: %v\n", err)
+            return
+        }
+    }
+}
+
+// replaceReport moves the report a -retry-failed run wrote to newPath over
+// oldPath, the report it retried. Until then oldPath keeps every file it
+// listed, so a retry that is aborted loses none of them. If the run wrote
+// no report, nothing failed and oldPath is removed.
+func replaceReport(newPath, oldPath string) error {
+    err := os.Rename(newPath, oldPath)
+    if errors.Is(err, fs.ErrNotExist) {
+        err = os.Remove(oldPath)
+    }
+    return err
+}
+
+func appendFailure(reportPath string, record failureRecord) error {
+    file, err := os.OpenFile(reportPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    return json.NewEncoder(file).Encode(record)
+}
+
+// loadFailureReport returns the paths listed in a failure report, in order
+// and without duplicates.
+func loadFailureReport(reportPath string) ([]string, error) {
+    file, err := os.Open(reportPath)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var paths []string
+    seen := make(map[string]bool)
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        if len(scanner.Bytes()) == 0 {
+            continue
+        }
+        var record failureRecord
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+            return nil, fmt.Errorf("invalid report line %q: %w", scanner.Text(), err)
+        }
+        if !seen[record.Path] {
+            seen[record.Path] = true
+            paths = append(paths, record.Path)
+        }
+    }
+    return paths, scanner.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func TestRunBatchRecordsFailures(t *testing.T) {
+    files := []string{"ok1", "bad1", "ok2", "bad2", "ok3"}
+    tests := []struct {
+        name            string
+        continueOnError bool
+        wantSent        []string
+        wantFailed      int
+        wantReport      []string // failed files, then unsent ones
+    }{
+        {"continues past failures", true, files, 2, []string{"bad1", "bad2"}},
+        {"stops on the first failure", false, []string{"ok1", "bad1"}, 1, []string{"bad1", "ok2", "bad2", "ok3"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var sent []string
+            send := func(path string) error {
+                sent = append(sent, path)
+                if path[:3] == "bad" {
+                    return errors.New("connection reset")
+                }
+                return nil
+            }
+            report := filepath.Join(t.TempDir(), "failures.jsonl")
+            failed, unsent := runBatch(send, files, tt.continueOnError, report)
+            if failed != tt.wantFailed || unsent != len(files)-len(tt.wantSent) {
+                t.Errorf("runBatch = %d failed, %d unsent; want %d, %d", failed, unsent, tt.wantFailed, len(files)-len(tt.wantSent))
+            }
+            if !reflect.DeepEqual(sent, tt.wantSent) {
+                t.Errorf("sent %v, want %v", sent, tt.wantSent)
+            }
+            got, err := loadFailureReport(report)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !reflect.DeepEqual(got, tt.wantReport) {
+                t.Errorf("report lists %v, want %v", got, tt.wantReport)
+            }
+        })
+    }
+}
+
+func TestRetryFailedReport(t *testing.T) {
+    report := filepath.Join(t.TempDir(), "failures.jsonl")
+    fail := func(path string) error {
+        if path == "flaky" || path == "broken" {
+            return errors.New("timeout")
+        }
+        return nil
+    }
+    runBatch(fail, []string{"fine", "flaky", "broken"}, true, report)
+    // The same file failing again is listed once.
+    runBatch(fail, []string{"broken"}, true, report)
+
+    paths, err := loadFailureReport(report)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"flaky", "broken"}; !reflect.DeepEqual(paths, want) {
+        t.Fatalf("loadFailureReport = %v, want %v", paths, want)
+    }
+    var retried []string
+    if failed, _ := runBatch(func(path string) error { retried = append(retried, path); return nil }, paths, true, ""); failed != 0 {
+        t.Errorf("retry reported %d failures, want 0", failed)
+    }
+    if !reflect.DeepEqual(retried, paths) {
+        t.Errorf("retried %v, want %v", retried, paths)
+    }
+}
+
+func TestRetryKeepsUnsentFiles(t *testing.T) {
+    report := filepath.Join(t.TempDir(), "failures.jsonl")
+    fail := func(path string) error { return errors.New("timeout") }
+    runBatch(fail, []string{"a", "b", "c"}, true, report)
+
+    // A retry that stops at a leaves b and c unsent; they stay in the
+    // report alongside a.
+    runBatch(fail, []string{"a", "b", "c"}, false, report+".new")
+    if err := replaceReport(report+".new", report); err != nil {
+        t.Fatal(err)
+    }
+    paths, err := loadFailureReport(report)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"a", "b", "c"}; !reflect.DeepEqual(paths, want) {
+        t.Fatalf("report lists %v after the retry, want %v", paths, want)
+    }
+
+    // A retry in which everything succeeds removes the report.
+    runBatch(func(string) error { return nil }, paths, true, report+".new")
+    if err := replaceReport(report+".new", report); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(report); !os.IsNotExist(err) {
+        t.Errorf("report left after a successful retry: %v", err)
+    }
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+
+    "wenPlus/transfer"
+)
+
+// Capabilities describes what this binary supports so users can check
+// client/server compatibility before starting a transfer. The field names and
+// the text layout are consumed by tooling, so only ever append to them.
+// Compression lists the codecs of data on the wire, which the server
+// reports the same way, and ArchiveFormats the -format values a directory
+// can be packed in.
+type Capabilities struct {
+    Binary           string   `json:"binary"`
+    HashAlgorithms   []string `json:"hash_algorithms"`
+    Compression      []string `json:"compression"`
+    ProtocolVersions []int    `json:"protocol_versions"`
+    Features         []string `json:"features"`
+    ArchiveFormats   []string `json:"archive_formats,omitempty"`
+}
+
+func clientCapabilities() Capabilities {
+    formats := make([]string, 0, len(archiveWriters))
+    for format := range archiveWriters {
+        formats = append(formats, format)
+    }
+    sort.Strings(formats)
+    return Capabilities{
+        Binary:           "client",
+        HashAlgorithms:   transfer.HashAlgorithms(),
+        Compression:      []string{"deflate"},
+        ProtocolVersions: []int{transfer.ProtocolVersion},
+        Features:         []string{"compress", "dest", "download", "hardlinks", "list", "proxy", "reliable", "resume", "retry", "signature", "smart-resume", "sparse", "stream", "tls", "verify-only"},
+        ArchiveFormats:   formats,
+    }
+}
+
+// printCapabilities writes caps to w, either as a single JSON object or as
+// one "key: v1,v2" line per field.
+func printCapabilities(w io.Writer, caps Capabilities, asJSON bool) error {
+    if asJSON {
+        enc := json.NewEncoder(w)
+        return enc.Encode(caps)
+    }
+
+    versions := make([]string, len(caps.ProtocolVersions))
+    for i, v := range caps.ProtocolVersions {
+        versions[i] = strconv.Itoa(v)
+    }
+    _, err := fmt.Fprintf(w, "binary: %s\nhash_algorithms: %s\ncompression: %s\nprotocol_versions: %s\nfeatures: %s\n",
+        caps.Binary,
+        strings.Join(caps.HashAlgorithms, ","),
+        strings.Join(caps.Compression, ","),
+        strings.Join(versions, ","),
+        strings.Join(caps.Features, ","))
+    if err == nil && len(caps.ArchiveFormats) > 0 {
+        _, err = fmt.Fprintf(w, "archive_formats: %s\n", strings.Join(caps.ArchiveFormats, ","))
+    }
+    return err
+}
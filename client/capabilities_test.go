@@ -0,0 +1,29 @@
+package main
+
+import (
+    "bytes"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// TestCapabilitiesSplitCodecsFromArchives checks that Compression names the
+// wire codec the server also reports, and that archive formats are listed
+// apart from it.
+func TestCapabilitiesSplitCodecsFromArchives(t *testing.T) {
+    caps := clientCapabilities()
+    if want := []string{"deflate"}; !reflect.DeepEqual(caps.Compression, want) {
+        t.Errorf("Compression = %v, want %v", caps.Compression, want)
+    }
+    if want := []string{"targz", "zip"}; !reflect.DeepEqual(caps.ArchiveFormats, want) {
+        t.Errorf("ArchiveFormats = %v, want %v", caps.ArchiveFormats, want)
+    }
+
+    var out bytes.Buffer
+    if err := printCapabilities(&out, caps, false); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(out.String(), "\narchive_formats: targz,zip\n") {
+        t.Errorf("text output lacks archive formats:\n%s", out.String())
+    }
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+    "fmt"
+    "path/filepath"
+
+    "wenPlus/transfer"
+)
+
+// printDryRun shows what a real run would send to serverAddr: the name each
+// file is sent under, its size and hash. It does not connect.
+func printDryRun(client *transfer.Client, serverAddr string, files []string) error {
+    fmt.Printf("Dry run: would send %d file(s) to %s (%s)\n", len(files), serverAddr, client.Scheme())
+    for _, path := range files {
+        size, err := getFileSize(path)
+        if err != nil {
+            return fmt.Errorf("%s: failed to get file size: %w", path, err)
+        }
+        hash, err := client.Hash(path)
+        if err != nil {
+            return fmt.Errorf("%s: failed to calculate file hash: %w", path, err)
+        }
+        fmt.Printf("%s\n    name: %s\n", path, filepath.Base(path))
+        if dest := fileDest(path); dest != "" {
+            fmt.Printf("    destination: %s\n", dest)
+        }
+        fmt.Printf("    size: %d bytes\n    %s: %s\n", size, opts.HashAlgorithm, hash)
+    }
+    return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// envPrefix starts the environment variables the client takes its defaults
+// from: EILECORES_TOKEN for -token, EILECORES_MAX_ARCHIVE_SIZE for
+// -max-archive-size, and so on.
+const envPrefix = "EILECORES_"
+
+// envAliases name the variables whose flag name would read badly.
+var envAliases = map[string]string{
+    "ip": "EILECORES_SERVER",
+}
+
+// envName is the environment variable for a flag.
+func envName(flagName string) string {
+    if name, ok := envAliases[flagName]; ok {
+        return name
+    }
+    return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvDefaults sets every flag that was not given on the command line
+// from its environment variable, if that is set and not empty. Flags
+// therefore override the environment, which overrides the built-in
+// defaults.
+func applyEnvDefaults() error {
+    given := map[string]bool{}
+    flag.Visit(func(f *flag.Flag) {
+        given[f.Name] = true
+    })
+    var err error
+    flag.VisitAll(func(f *flag.Flag) {
+        if err != nil || given[f.Name] {
+            return
+        }
+        name := envName(f.Name)
+        value := os.Getenv(name)
+        if value == "" {
+            return
+        }
+        if setErr := flag.Set(f.Name, value); setErr != nil {
+            err = fmt.Errorf("invalid %s=%q: %v", name, value, setErr)
+        }
+    })
+    return err
+}
+
+// printUsage is the default usage message plus a note on the environment
+// variables.
+func printUsage() {
+    out := flag.CommandLine.Output()
+    fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+    flag.PrintDefaults()
+    fmt.Fprintf(out, "\n命令行未指定的参数从环境变量 %s<参数名> 读取 (大写, - 换成 _), 如 EILECORES_TOKEN, EILECORES_TLS=true; -ip 对应 EILECORES_SERVER\n", envPrefix)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// excludeList collects repeated -exclude glob patterns. A pattern without a
+// "/" matches a file or directory name at any depth (node_modules, *.log);
+// one with a "/" matches the path from the top of the compressed directory
+// (build/*.o).
+type excludeList []string
+
+var excludePatterns excludeList
+
+func (e *excludeList) String() string {
+    return strings.Join(*e, ",")
+}
+
+func (e *excludeList) Set(value string) error {
+    if _, err := path.Match(value, ""); err != nil {
+        return fmt.Errorf("bad pattern %q: %w", value, err)
+    }
+    *e = append(*e, value)
+    return nil
+}
+
+// skipExcluded is called by the compressors' Walk callbacks for each entry
+// of dirPath. It returns filepath.SkipDir for an excluded directory, and
+// skip is true for any excluded entry.
+func skipExcluded(dirPath, entryPath string, isDir bool) (skip bool, err error) {
+    rel, err := filepath.Rel(dirPath, entryPath)
+    if err != nil || rel == "." || !excludePatterns.matches(filepath.ToSlash(rel)) {
+        return false, err
+    }
+    if isDir {
+        return true, filepath.SkipDir
+    }
+    return true, nil
+}
+
+func (e excludeList) matches(rel string) bool {
+    for _, pattern := range e {
+        name := path.Base(rel)
+        if strings.Contains(pattern, "/") {
+            pattern, name = strings.Trim(pattern, "/"), rel
+        }
+        if ok, _ := path.Match(pattern, name); ok {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "os"
+
+// hardLinkID never finds hard links where the file system's inode numbers
+// are not available; such files are sent as copies.
+func hardLinkID(info os.FileInfo) (id fileID, ok bool) {
+    return fileID{}, false
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+    "os"
+    "syscall"
+)
+
+// hardLinkID identifies the file behind info when other names link to it
+// too. ok is false for a file with a single name.
+func hardLinkID(info os.FileInfo) (id fileID, ok bool) {
+    st, isStat := info.Sys().(*syscall.Stat_t)
+    if !isStat || st.Nlink < 2 {
+        return fileID{}, false
+    }
+    return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+)
+
+// stopRequested is set by the first interrupt. Callers check it between
+// files (and between retry attempts) so the in-flight file is finished
+// instead of being abandoned half-sent.
+var stopRequested atomic.Bool
+
+// installInterruptHandler makes the first Ctrl-C request a stop after the
+// current file and the second one abort the process immediately. stop
+// removes the handler again.
+func installInterruptHandler() (stop func()) {
+    sigCh := make(chan os.Signal, 2)
+    signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+    go func() {
+        <-sigCh
+        stopRequested.Store(true)
+        fmt.Println("\nInterrupt received, finishing current file. Press Ctrl-C again to abort.")
+
+        <-sigCh
+        fmt.Println("\nAborted.")
+        os.Exit(130)
+    }()
+    return func() { signal.Stop(sigCh) }
+}
+
+// stopAfterCurrent reports whether the user asked to stop once the current
+// file is done.
+func stopAfterCurrent() bool {
+    return stopRequested.Load()
+}
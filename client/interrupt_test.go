@@ -0,0 +1,48 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestInterruptBetweenFilesStopsBatch(t *testing.T) {
+    t.Cleanup(installInterruptHandler())
+    t.Cleanup(func() { stopRequested.Store(false) })
+
+    var sent []string
+    send := func(path string) error {
+        if path == "b" {
+            // Ctrl-C while b is in flight; b itself still completes.
+            syscall.Kill(os.Getpid(), syscall.SIGINT)
+            for deadline := time.Now().Add(5 * time.Second); !stopAfterCurrent(); {
+                if time.Now().After(deadline) {
+                    t.Fatal("interrupt was not noticed")
+                }
+                time.Sleep(time.Millisecond)
+            }
+        }
+        sent = append(sent, path)
+        return nil
+    }
+    report := filepath.Join(t.TempDir(), "failures.jsonl")
+    if failed, unsent := runBatch(send, []string{"a", "b", "c", "d"}, true, report); failed != 0 || unsent != 2 {
+        t.Errorf("runBatch = %d failed, %d unsent; want 0, 2", failed, unsent)
+    }
+    if want := []string{"a", "b"}; !reflect.DeepEqual(sent, want) {
+        t.Errorf("sent %v, want %v", sent, want)
+    }
+    // The files the interrupt skipped are listed for -retry-failed.
+    unsent, err := loadFailureReport(report)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"c", "d"}; !reflect.DeepEqual(unsent, want) {
+        t.Errorf("report lists %v, want %v", unsent, want)
+    }
+}
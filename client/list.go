@@ -0,0 +1,28 @@
+package main
+
+import (
+    "context"
+    "fmt"
+
+    "wenPlus/transfer"
+)
+
+// listStoredFiles prints the files the server stores with their size and,
+// where the server recorded one, their hash (-list).
+func listStoredFiles(ctx context.Context, client *transfer.Client) error {
+    files, err := client.List(ctx)
+    if err != nil {
+        return err
+    }
+    var total int64
+    for _, f := range files {
+        hash := "-"
+        if f.Hash != "" {
+            hash = f.HashAlgorithm + ":" + f.Hash
+        }
+        fmt.Printf("%12d  %s  %s\n", f.Size, hash, f.Name)
+        total += f.Size
+    }
+    fmt.Printf("%d file(s), %d bytes.\n", len(files), total)
+    return nil
+}
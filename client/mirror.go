@@ -0,0 +1,92 @@
+package main
+
+import (
+    "context"
+    "os"
+    "path"
+    "path/filepath"
+    "time"
+
+    "wenPlus/transfer"
+)
+
+// mirrorTree (-mirror) sends the files of the -path directory one by one
+// instead of archiving them, each into the subdirectory of -dest matching
+// its place in the tree, so the server ends up with a browsable copy.
+var mirrorTree bool
+
+// fileDests holds the server directory of each file queued by -mirror.
+// It is filled before any transfer starts and only read afterwards.
+var fileDests = make(map[string]string)
+
+// linkSources maps a file queued by -mirror that is a hard link to an
+// earlier queued file to that file. Filled and read like fileDests.
+var linkSources = make(map[string]string)
+
+// fileID is a file's device and inode number.
+type fileID struct {
+    dev, ino uint64
+}
+
+// fileDest returns the directory filePath is stored in on the server.
+func fileDest(filePath string) string {
+    if dest, ok := fileDests[filePath]; ok {
+        return dest
+    }
+    return opts.Dest
+}
+
+// sendQueued sends filePath into its fileDest. A hard link to a file sent
+// before it is sent as a link to that file's place on the server, which
+// recreates the link, or copies the file if it cannot, without the data
+// crossing the network again.
+func sendQueued(ctx context.Context, client *transfer.Client, filePath string) error {
+    if source, ok := linkSources[filePath]; ok {
+        linkTo := path.Join(fileDest(source), filepath.Base(source))
+        return client.SendLink(ctx, filePath, fileDest(filePath), linkTo)
+    }
+    return client.SendTo(ctx, filePath, fileDest(filePath))
+}
+
+// mirrorFiles lists the files under dirPath that -exclude does not skip and
+// records each one's destination: -dest joined with its directory, named
+// from dirPath's parent as in an archive. Symlinks are followed to files;
+// anything else that is not a regular file is skipped, as are files last
+// modified before -since. A file hard-linked to one listed before it is
+// recorded in linkSources.
+func mirrorFiles(dirPath string) ([]string, error) {
+    var files []string
+    unchanged := 0
+    linked := make(map[fileID]string)
+    err := walkFiles(dirPath, func(filePath, relPath string) error {
+        info, err := os.Stat(filePath)
+        if err != nil {
+            return err
+        }
+        if !info.Mode().IsRegular() {
+            infof("Skipping %s: not a regular file\n", filePath)
+            return nil
+        }
+        if info.ModTime().Before(sinceTime) {
+            unchanged++
+            return nil
+        }
+        files = append(files, filePath)
+        fileDests[filePath] = path.Join(opts.Dest, path.Dir(filepath.ToSlash(relPath)))
+        // A symlink is sent as the file it points to, never as a link.
+        if linfo, err := os.Lstat(filePath); err == nil && linfo.Mode().IsRegular() {
+            if id, ok := hardLinkID(linfo); ok {
+                if source, seen := linked[id]; seen {
+                    linkSources[filePath] = source
+                } else {
+                    linked[id] = filePath
+                }
+            }
+        }
+        return nil
+    })
+    if unchanged > 0 {
+        infof("Skipped %d file(s) not modified since %s.\n", unchanged, sinceTime.Format(time.RFC3339))
+    }
+    return files, err
+}
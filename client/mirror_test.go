@@ -0,0 +1,64 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestMirrorFilesFindsHardLinks(t *testing.T) {
+    dir := filepath.Join(t.TempDir(), "tree")
+    write := func(name, data string) string {
+        p := filepath.Join(dir, name)
+        if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+            t.Fatal(err)
+        }
+        return p
+    }
+    a := write("a.txt", "same")
+    c := write("c.txt", "other")
+    b := filepath.Join(dir, "sub", "b.txt")
+    os.MkdirAll(filepath.Dir(b), 0755)
+    if err := os.Link(a, b); err != nil {
+        t.Skipf("file system has no hard links: %v", err)
+    }
+    s := filepath.Join(dir, "s.txt")
+    if err := os.Symlink(a, s); err != nil {
+        t.Fatal(err)
+    }
+
+    oldDests, oldSources := fileDests, linkSources
+    fileDests, linkSources = make(map[string]string), make(map[string]string)
+    t.Cleanup(func() { fileDests, linkSources = oldDests, oldSources })
+
+    files, err := mirrorFiles(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(files) != 4 {
+        t.Fatalf("mirrorFiles returned %v, want 4 files", files)
+    }
+    tests := []struct {
+        file   string
+        source string // empty when sent as data
+        dest   string
+    }{
+        {a, "", "tree"},
+        {b, a, "tree/sub"},
+        {c, "", "tree"},
+        {s, "", "tree"}, // symlinks are sent as files, not links
+    }
+    for _, tt := range tests {
+        if got := linkSources[tt.file]; got != tt.source {
+            t.Errorf("linkSources[%s] = %q, want %q", tt.file, got, tt.source)
+        }
+        if got := fileDest(tt.file); got != tt.dest {
+            t.Errorf("fileDest(%s) = %q, want %q", tt.file, got, tt.dest)
+        }
+    }
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "strings"
+    "time"
+
+    "wenPlus/transfer"
+)
+
+// jsonProgress writes one JSON object per update to w, for -progress-json.
+func jsonProgress(w io.Writer) func(transfer.Progress) {
+    enc := json.NewEncoder(w)
+    return func(u transfer.Progress) {
+        enc.Encode(struct {
+            Bytes      int64   `json:"bytes"`
+            Total      int64   `json:"total"`
+            Speed      float64 `json:"speed"`
+            ETASeconds float64 `json:"eta_seconds"`
+            Done       bool    `json:"done"`
+        }{u.Sent, u.Total, u.Speed, u.ETA.Seconds(), u.Done})
+    }
+}
+
+// progressBarWidth is the number of cells in the bar itself.
+const progressBarWidth = 30
+
+// progressBar redraws a single status line on w for each update and ends it
+// with a summary line once the transfer is done.
+func progressBar(w io.Writer) func(transfer.Progress) {
+    return func(u transfer.Progress) {
+        if u.Total <= 0 {
+            // A stream's size is only known once it is done.
+            fmt.Fprintf(w, "\r%.1f MB  %.2f MB/s ", float64(u.Sent)/(1024*1024), u.Speed/(1024*1024))
+            if u.Done {
+                fmt.Fprintf(w, "\nSent %.1f MB in %s (%.2f MB/s)\n",
+                    float64(u.Sent)/(1024*1024), u.Elapsed.Round(time.Millisecond), u.Speed/(1024*1024))
+            }
+            return
+        }
+        percent := 100.0
+        if u.Total > 0 {
+            percent = float64(u.Sent) / float64(u.Total) * 100
+        }
+        filled := int(percent / 100 * progressBarWidth)
+        if filled > progressBarWidth {
+            filled = progressBarWidth
+        }
+        bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+        eta := "--:--"
+        if u.ETA > 0 {
+            eta = formatETA(u.ETA)
+        }
+        fmt.Fprintf(w, "\r[%s] %5.1f%%  %.1f/%.1f MB  %.2f MB/s  ETA %s ",
+            bar, percent, float64(u.Sent)/(1024*1024), float64(u.Total)/(1024*1024), u.Speed/(1024*1024), eta)
+        if u.Done {
+            fmt.Fprintf(w, "\nSent %.1f MB in %s (%.2f MB/s)\n",
+                float64(u.Sent)/(1024*1024), u.Elapsed.Round(time.Millisecond), u.Speed/(1024*1024))
+        }
+    }
+}
+
+// progressLog prints a progress line on w at most once a second, and once
+// more when the transfer is done, for -verbose where the output is likely to
+// end up in a log rather than on a terminal.
+func progressLog(w io.Writer) func(transfer.Progress) {
+    var last time.Time
+    return func(u transfer.Progress) {
+        if !u.Done && time.Since(last) < time.Second {
+            return
+        }
+        last = time.Now()
+        elapsed := u.Elapsed.Round(time.Second)
+        if u.Total <= 0 {
+            fmt.Fprintf(w, "%s  sent %.1f MB  %.2f MB/s\n", elapsed, float64(u.Sent)/(1024*1024), u.Speed/(1024*1024))
+            return
+        }
+        eta := "--:--"
+        if u.ETA > 0 {
+            eta = formatETA(u.ETA)
+        }
+        fmt.Fprintf(w, "%s  sent %.1f/%.1f MB (%.1f%%)  %.2f MB/s  ETA %s\n", elapsed,
+            float64(u.Sent)/(1024*1024), float64(u.Total)/(1024*1024),
+            float64(u.Sent)/float64(u.Total)*100, u.Speed/(1024*1024), eta)
+    }
+}
+
+// formatETA prints d as m:ss, or h:mm:ss for long transfers.
+func formatETA(d time.Duration) string {
+    s := int(d.Round(time.Second).Seconds())
+    if s >= 3600 {
+        return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+    }
+    return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
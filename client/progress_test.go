@@ -0,0 +1,45 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "reflect"
+    "testing"
+    "time"
+
+    "wenPlus/transfer"
+)
+
+// TestJSONProgress captures what -progress-json writes for a transfer and a
+// stream and parses it back, one object per line.
+func TestJSONProgress(t *testing.T) {
+    var out bytes.Buffer
+    report := jsonProgress(&out)
+    updates := []transfer.Progress{
+        {Sent: 1 << 20, Total: 4 << 20, Speed: 2 << 20, ETA: 1500 * time.Millisecond, Elapsed: time.Second},
+        {Sent: 4 << 20, Total: 4 << 20, Speed: 2 << 20, Elapsed: 2 * time.Second, Done: true},
+        {Sent: 300, Speed: 150, Elapsed: 2 * time.Second, Done: true}, // a stream
+    }
+    for _, u := range updates {
+        report(u)
+    }
+
+    want := []map[string]interface{}{
+        {"bytes": 1048576.0, "total": 4194304.0, "speed": 2097152.0, "eta_seconds": 1.5, "done": false},
+        {"bytes": 4194304.0, "total": 4194304.0, "speed": 2097152.0, "eta_seconds": 0.0, "done": true},
+        {"bytes": 300.0, "total": 0.0, "speed": 150.0, "eta_seconds": 0.0, "done": true},
+    }
+    var got []map[string]interface{}
+    scanner := bufio.NewScanner(&out)
+    for scanner.Scan() {
+        var line map[string]interface{}
+        if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+            t.Fatalf("line %q: %v", scanner.Text(), err)
+        }
+        got = append(got, line)
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v, want %v", got, want)
+    }
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// sinceTime (-since) makes -mirror skip files last modified before it.
+// The zero time sends every file.
+var sinceTime time.Time
+
+// sinceLast is the -since value that means "since the last run".
+const sinceLast = "last"
+
+// sinceLayouts are the timestamp forms -since accepts, in local time
+// unless they carry a zone.
+var sinceLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+// parseSince turns a -since value into a time: a timestamp, a duration
+// meaning that long ago (24h), or sinceLast for the start of the last
+// successful -mirror run of runKey, the zero time if there was none.
+func parseSince(value, runKey string) (time.Time, error) {
+    if value == sinceLast {
+        return lastRun(runKey), nil
+    }
+    if d, err := time.ParseDuration(value); err == nil && d > 0 {
+        return time.Now().Add(-d), nil
+    }
+    for _, layout := range sinceLayouts {
+        if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, fmt.Errorf("invalid -since %q: use a time such as 2024-05-01 or 2024-05-01T08:00:00Z, a duration such as 24h, or %q", value, sinceLast)
+}
+
+// mirrorRunKey identifies a mirror of dirPath to serverAddr, so runs to
+// other servers or destinations keep their own last run.
+func mirrorRunKey(dirPath, serverAddr string) string {
+    if abs, err := filepath.Abs(dirPath); err == nil {
+        dirPath = abs
+    }
+    return strings.Join([]string{dirPath, serverAddr, opts.Dest}, "|")
+}
+
+// lastRunsPath is where the start times of successful -mirror runs are
+// kept, or "" if there is no user cache directory.
+func lastRunsPath() string {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(dir, "eilecores", "mirror-runs.json")
+}
+
+func loadLastRuns() map[string]time.Time {
+    runs := make(map[string]time.Time)
+    path := lastRunsPath()
+    if path == "" {
+        return runs
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return runs
+    }
+    if err := json.Unmarshal(data, &runs); err != nil {
+        return make(map[string]time.Time)
+    }
+    return runs
+}
+
+// lastRun returns when the last successful run of runKey started.
+func lastRun(runKey string) time.Time {
+    return loadLastRuns()[runKey]
+}
+
+// recordRun saves start as the start of the last successful run of runKey.
+// The start rather than the end is kept, so files changed while the run
+// was going are sent next time. Failing to save only means the next
+// "-since last" sends more, so errors are ignored.
+func recordRun(runKey string, start time.Time) {
+    path := lastRunsPath()
+    if path == "" {
+        return
+    }
+    runs := loadLastRuns()
+    runs[runKey] = start
+    data, err := json.Marshal(runs)
+    if err != nil {
+        return
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return
+    }
+    os.Rename(tmp, path)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+
+    "wenPlus/transfer"
+)
+
+// freeSpaceMargin is the extra room, as a fraction of the batch size, the
+// server must have before a batch is started.
+const freeSpaceMargin = 0.05
+
+// checkFreeSpace fails if the server reports less free space than the batch
+// needs plus a margin. Servers that cannot report free space, or do not
+// know the status request at all, pass.
+func checkFreeSpace(ctx context.Context, client *transfer.Client, files []string) error {
+    var total int64
+    for _, path := range files {
+        size, err := getFileSize(path)
+        if err != nil {
+            continue // reported when the file itself is sent
+        }
+        total += size
+    }
+
+    status, err := client.Status(ctx)
+    if errors.Is(err, transfer.ErrStatusUnsupported) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to query server free space: %w", err)
+    }
+    if status.FreeBytes < 0 {
+        return nil
+    }
+
+    needed := total + int64(float64(total)*freeSpaceMargin)
+    if status.FreeBytes < needed {
+        return fmt.Errorf("server has %d bytes free but the batch needs %d (%d plus margin); use -force to send anyway",
+            status.FreeBytes, needed, total)
+    }
+    return nil
+}
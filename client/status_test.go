@@ -0,0 +1,86 @@
+package main
+
+import (
+    "context"
+    "encoding/binary"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "wenPlus/transfer"
+)
+
+// statusServer answers every status request with reply and returns its
+// address.
+func statusServer(t *testing.T, reply string) string {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            conn.SetDeadline(time.Now().Add(5 * time.Second))
+            var length uint32
+            if binary.Read(conn, binary.BigEndian, &length) == nil {
+                io.CopyN(io.Discard, conn, int64(length))
+                binary.Write(conn, binary.BigEndian, uint32(len(reply)))
+                io.WriteString(conn, reply)
+            }
+            conn.Close()
+        }
+    }()
+    return listener.Addr().String()
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+    dir := t.TempDir()
+    var files []string
+    for _, name := range []string{"a", "b"} {
+        path := filepath.Join(dir, name)
+        if err := os.WriteFile(path, make([]byte, 1000), 0644); err != nil {
+            t.Fatal(err)
+        }
+        files = append(files, path)
+    }
+
+    tests := []struct {
+        name    string
+        reply   string
+        wantErr string // empty when the batch may start
+    }{
+        {"enough room", `{"free_bytes":1000000,"active_connections":0}`, ""},
+        {"too little room", `{"free_bytes":2050,"active_connections":0}`, "server has 2050 bytes free but the batch needs 2100"},
+        {"free space unknown", `{"free_bytes":-1,"active_connections":0}`, ""},
+        {"server predates status requests", "unsupported protocol version STATUS, server speaks 19", ""},
+        {"wrong token", "authentication failed", "server rejected the token"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            client, err := transfer.NewClient(statusServer(t, tt.reply), transfer.Options{})
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer client.Close()
+            err = checkFreeSpace(context.Background(), client, files)
+            if tt.wantErr == "" {
+                if err != nil {
+                    t.Fatalf("checkFreeSpace = %v, want the batch to start", err)
+                }
+                return
+            }
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Fatalf("checkFreeSpace = %v, want an error containing %q", err, tt.wantErr)
+            }
+        })
+    }
+}
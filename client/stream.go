@@ -0,0 +1,30 @@
+package main
+
+import (
+    "context"
+    "io"
+
+    "wenPlus/transfer"
+)
+
+// streamArchives (-stream) sends a -path directory while it is being
+// archived, without writing the archive to disk first. The size is not
+// known up front, so the archive cannot be resumed; a retry archives the
+// directory again.
+var streamArchives bool
+
+// archiveWriters writes a directory in each -format.
+var archiveWriters = map[string]func(dirPath string, w io.Writer) error{
+    "zip":   writeZip,
+    "targz": writeTarGz,
+}
+
+// streamDirectory archives dirPath in format and sends the archive as name
+// as it is produced. The archive is cut off at maxSize bytes, as with
+// -max-archive-size.
+func streamDirectory(ctx context.Context, client *transfer.Client, dirPath, name, format string, maxSize int64) error {
+    write := archiveWriters[format]
+    return client.SendStream(ctx, name, func(w io.Writer) error {
+        return write(dirPath, &limitedWriter{w: w, limit: maxSize})
+    })
+}
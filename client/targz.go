@@ -0,0 +1,97 @@
+package main
+
+import (
+    "archive/tar"
+    "compress/gzip"
+    "io"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// compressDirectoryTarGz is the tar+gzip counterpart of compressDirectory.
+// It keeps file modes and stores symlinks as links to their target instead
+// of following them. maxSize limits the compressed size the same way.
+func compressDirectoryTarGz(dirPath, outputFileName string, maxSize int64) (string, error) {
+    if outputFileName == "" {
+        outputFileName = filepath.Base(dirPath) + ".tar.gz"
+    }
+    archiveFile, err := os.Create(outputFileName)
+    if err != nil {
+        return "", err
+    }
+    defer archiveFile.Close()
+
+    err = writeTarGz(dirPath, &limitedWriter{w: archiveFile, limit: maxSize})
+    if err != nil {
+        archiveFile.Close()
+        os.Remove(outputFileName)
+        return "", err
+    }
+    return outputFileName, nil
+}
+
+// writeTarGz writes dirPath as a tar+gzip archive to w, in lexical order.
+// Like writeZip it gives the same bytes for the same directory, as long as
+// the files' modes and modification times, which it keeps, are unchanged
+// too.
+func writeTarGz(dirPath string, w io.Writer) error {
+    gzipWriter := gzip.NewWriter(w)
+    defer gzipWriter.Close()
+    tarWriter := tar.NewWriter(gzipWriter)
+    defer tarWriter.Close()
+
+    // filepath.Walk reports symlinks without following them.
+    err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if skip, err := skipExcluded(dirPath, path, info.IsDir()); skip {
+            return err
+        }
+        relPath, err := filepath.Rel(filepath.Dir(dirPath), path)
+        if err != nil {
+            return err
+        }
+
+        var link string
+        if info.Mode()&os.ModeSymlink != 0 {
+            if link, err = os.Readlink(path); err != nil {
+                return err
+            }
+        }
+        header, err := tar.FileInfoHeader(info, link)
+        if err != nil {
+            return err
+        }
+        header.Name = filepath.ToSlash(relPath)
+        // Reading the files changes their access times.
+        header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+        if info.IsDir() {
+            header.Name += "/"
+        }
+        if err := tarWriter.WriteHeader(header); err != nil {
+            return err
+        }
+        if !info.Mode().IsRegular() {
+            return nil
+        }
+
+        file, err := os.Open(path)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        _, err = io.Copy(tarWriter, file)
+        return err
+    })
+
+    if err == nil {
+        err = tarWriter.Close()
+    }
+    if err == nil {
+        // The gzip trailer also counts toward the limit.
+        err = gzipWriter.Close()
+    }
+    return err
+}
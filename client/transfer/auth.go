@@ -0,0 +1,18 @@
+package transfer
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+// headerMAC returns the hex HMAC-SHA256 of payload keyed with the client's
+// Token, or "" when no token is set.
+func (c *Client) headerMAC(payload string) string {
+    if c.opts.Token == "" {
+        return ""
+    }
+    h := hmac.New(sha256.New, []byte(c.opts.Token))
+    h.Write([]byte(payload))
+    return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,59 @@
+package transfer
+
+import (
+    "bytes"
+    "compress/flate"
+    "encoding/binary"
+    "fmt"
+    "net"
+)
+
+// compressDeflate is the header's fieldCompress for compressed data.
+const compressDeflate = "deflate"
+
+// chunkDeflater compresses the data of Options.Compress with deflate, chunk
+// by chunk, each prefixed with its compressed length; see the server's
+// compress.go. The hash is still that of the file itself. It reuses its
+// buffer and compressor between chunks. Compressing waits for acquireCPU,
+// sending does not.
+type chunkDeflater struct {
+    buf        bytes.Buffer
+    w          *flate.Writer
+    acquireCPU func() (release func())
+}
+
+// send compresses data on its own and sends it as one chunk.
+func (c *chunkDeflater) send(conn net.Conn, data []byte) error {
+    if err := c.compress(data); err != nil {
+        return err
+    }
+    frame := c.buf.Bytes()
+    binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+    if err := writeFull(conn, frame); err != nil {
+        return fmt.Errorf("failed to send data: %w", err)
+    }
+    return nil
+}
+
+// compress leaves data in c.buf, compressed, after room for its length.
+func (c *chunkDeflater) compress(data []byte) error {
+    defer c.acquireCPU()()
+    c.buf.Reset()
+    c.buf.Write(make([]byte, 4))
+    if c.w == nil {
+        w, err := flate.NewWriter(&c.buf, flate.DefaultCompression)
+        if err != nil {
+            return permanent(err)
+        }
+        c.w = w
+    } else {
+        c.w.Reset(&c.buf)
+    }
+    if _, err := c.w.Write(data); err != nil {
+        return permanent(fmt.Errorf("failed to compress data: %w", err))
+    }
+    if err := c.w.Close(); err != nil {
+        return permanent(fmt.Errorf("failed to compress data: %w", err))
+    }
+    return nil
+}
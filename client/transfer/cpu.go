@@ -0,0 +1,12 @@
+package transfer
+
+// acquireCPU waits until fewer than Options.CPUs goroutines of c are
+// hashing or compressing, and returns the function that makes room for the
+// next one. Without a limit it returns at once.
+func (c *Client) acquireCPU() (release func()) {
+    if c.cpuSlots == nil {
+        return func() {}
+    }
+    c.cpuSlots <- struct{}{}
+    return func() { <-c.cpuSlots }
+}
@@ -0,0 +1,110 @@
+package transfer
+
+import (
+    "hash"
+    "hash/crc32"
+    "os"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// busyHash counts the Writes in progress across all its instances and
+// records the most seen at once.
+type busyHash struct {
+    hash.Hash
+    active, peak *atomic.Int32
+}
+
+func (h busyHash) Write(p []byte) (int, error) {
+    n := h.active.Add(1)
+    defer h.active.Add(-1)
+    for {
+        peak := h.peak.Load()
+        if n <= peak || h.peak.CompareAndSwap(peak, n) {
+            break
+        }
+    }
+    time.Sleep(20 * time.Millisecond)
+    return h.Hash.Write(p)
+}
+
+func TestCPUsBoundsConcurrentHashing(t *testing.T) {
+    var active, peak atomic.Int32
+    hashAlgorithms["busy"] = func() hash.Hash { return busyHash{crc32.NewIEEE(), &active, &peak} }
+    t.Cleanup(func() { delete(hashAlgorithms, "busy") })
+
+    path := filepath.Join(t.TempDir(), "f")
+    if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    const hashers = 8
+    tests := []struct {
+        cpus     int
+        wantPeak int32 // at most
+    }{
+        {1, 1},
+        {3, 3},
+        {0, hashers},
+    }
+    for _, tt := range tests {
+        c, err := NewClient("127.0.0.1:1", Options{HashAlgorithm: "busy", CPUs: tt.cpus})
+        if err != nil {
+            t.Fatal(err)
+        }
+        peak.Store(0)
+        var wg sync.WaitGroup
+        for i := 0; i < hashers; i++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                if _, err := c.calculateFileHash(path); err != nil {
+                    t.Error(err)
+                }
+            }()
+        }
+        wg.Wait()
+        c.Close()
+        if got := peak.Load(); got > tt.wantPeak {
+            t.Errorf("CPUs %d: %d files hashed at once, want at most %d", tt.cpus, got, tt.wantPeak)
+        }
+        // Without a limit the hashers overlap, so the check above can fail.
+        if tt.cpus == 0 && peak.Load() < 2 {
+            t.Errorf("CPUs 0: files were hashed one at a time")
+        }
+    }
+}
+
+func TestCPUsBoundsCompression(t *testing.T) {
+    c, err := NewClient("127.0.0.1:1", Options{Compress: true, CPUs: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    release := c.acquireCPU()
+    d := &chunkDeflater{acquireCPU: c.acquireCPU}
+    done := make(chan error)
+    go func() { done <- d.compress([]byte("data")) }()
+    select {
+    case <-done:
+        t.Fatal("compressed a chunk while the only CPU was taken")
+    case <-time.After(50 * time.Millisecond):
+    }
+    release()
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("compression did not go ahead once the CPU was free")
+    }
+}
+
+func TestCPUsRejectsNegative(t *testing.T) {
+    if _, err := NewClient("127.0.0.1:1", Options{CPUs: -1}); err == nil {
+        t.Error("NewClient accepted a negative CPU limit")
+    }
+}
@@ -0,0 +1,73 @@
+package transfer
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// TestDeadlineCutsOffSlowTransfer sends to a server that drains the upload
+// at about 100KB/s, and checks the context deadline (-deadline) stops the
+// transfer mid-file instead of letting it or its retries run on.
+func TestDeadlineCutsOffSlowTransfer(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                conn.SetDeadline(time.Now().Add(10 * time.Second))
+                if _, err := readFrame(conn, 1<<20); err != nil {
+                    return
+                }
+                reply := []byte("0||")
+                binary.Write(conn, binary.BigEndian, uint32(len(reply)))
+                conn.Write(reply)
+                for {
+                    if _, err := io.CopyN(io.Discard, conn, 1024); err != nil {
+                        return
+                    }
+                    time.Sleep(10 * time.Millisecond)
+                }
+            }()
+        }
+    }()
+
+    path := filepath.Join(t.TempDir(), "slow.bin")
+    if err := os.WriteFile(path, make([]byte, 16<<20), 0644); err != nil {
+        t.Fatal(err)
+    }
+    client, err := NewClient(listener.Addr().String(), Options{Retries: 3, RetryBase: 10 * time.Millisecond, RetryMax: 10 * time.Millisecond})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    const deadline = 500 * time.Millisecond
+    ctx, cancel := context.WithTimeout(context.Background(), deadline)
+    defer cancel()
+    start := time.Now()
+    err = client.Send(ctx, path)
+    elapsed := time.Since(start)
+
+    if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "deadline exceeded after attempt 1/3") {
+        t.Errorf("Send = %v, want the deadline to end the first attempt", err)
+    }
+    if elapsed < deadline || elapsed > deadline+time.Second {
+        t.Errorf("Send returned after %s, want shortly after the %s deadline", elapsed, deadline)
+    }
+}
@@ -0,0 +1,173 @@
+package transfer
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// downloadRequest starts a header asking for a stored file instead of
+// sending one.
+const downloadRequest = "DOWNLOAD"
+
+// Download header fields, in wire order.
+const (
+    dlFieldType    = iota // downloadRequest
+    dlFieldVersion        // ProtocolVersion
+    dlFieldName
+    dlFieldOffset // bytes already in the local part file
+    dlFieldAuth   // HMAC of the fields before it, see Options.Token
+    downloadFields
+)
+
+// downloadPartSuffix marks a download that has not been verified yet. A
+// later run resumes from its size.
+const downloadPartSuffix = ".part"
+
+// errDownloadPrefixMismatch means the partial download on disk is not the
+// start of the file the server stores now.
+var errDownloadPrefixMismatch = errors.New("partial download does not match the server's file")
+
+// Receive downloads the stored file name into dir, resuming a partial
+// download left by an earlier attempt or run, and renames it into place
+// once its hash matches the server's.
+func (c *Client) Receive(ctx context.Context, name, dir string) error {
+    return c.withRetry(ctx, func() error {
+        return c.receive(ctx, name, dir)
+    })
+}
+
+func (c *Client) receive(ctx context.Context, name, dir string) (err error) {
+    sess := c.sess
+    target := filepath.Join(dir, filepath.Base(name))
+    partPath := target + downloadPartSuffix
+    var have int64
+    if info, err := os.Stat(partPath); err == nil {
+        have = info.Size()
+    } else if !os.IsNotExist(err) {
+        return permanent(fmt.Errorf("failed to stat %s: %w", partPath, err))
+    }
+
+    conn, err := sess.get(ctx)
+    if err != nil {
+        return err
+    }
+    // After a failure the stream is out of step with the server.
+    defer func() {
+        if err != nil {
+            sess.drop()
+        }
+    }()
+
+    fields := make([]string, downloadFields)
+    fields[dlFieldType] = downloadRequest
+    fields[dlFieldVersion] = strconv.Itoa(ProtocolVersion)
+    fields[dlFieldName] = name
+    fields[dlFieldOffset] = strconv.FormatInt(have, 10)
+    fields[dlFieldAuth] = c.headerMAC(strings.Join(fields[:dlFieldAuth], "|"))
+    request := strings.Join(fields, "|")
+    lengthBuf := make([]byte, 4)
+    binary.BigEndian.PutUint32(lengthBuf, uint32(len(request)))
+    if err := writeFull(conn, append(lengthBuf, request...)); err != nil {
+        return fmt.Errorf("failed to send download request: %w", err)
+    }
+
+    reply, err := readFrame(conn, maxReplyLen)
+    if err != nil {
+        return fmt.Errorf("failed to read download offset: %w", err)
+    }
+    replyFields := strings.Split(string(reply), "|")
+    offset, err := strconv.ParseInt(replyFields[0], 10, 64)
+    if err != nil {
+        return rejectionError(string(reply))
+    }
+    if len(replyFields) != 4 {
+        return fmt.Errorf("malformed server reply %q", reply)
+    }
+    size, err := strconv.ParseInt(replyFields[1], 10, 64)
+    if err != nil || offset < 0 || offset > have || offset > size {
+        return fmt.Errorf("malformed server reply %q", reply)
+    }
+    fileHash, prefixHash := replyFields[2], replyFields[3]
+
+    // Only now that the server has the file is the part file worth creating.
+    file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return permanent(fmt.Errorf("failed to open %s: %w", partPath, err))
+    }
+    defer func() {
+        if file != nil {
+            file.Close()
+        }
+    }()
+
+    // The bytes kept from earlier attempts must be the start of this file.
+    hasher := sha256.New()
+    if offset > 0 {
+        if _, err := io.Copy(hasher, io.NewSectionReader(file, 0, offset)); err != nil {
+            return permanent(fmt.Errorf("failed to read from %s: %w", partPath, err))
+        }
+        if !strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), prefixHash) {
+            if err := file.Truncate(0); err != nil {
+                return permanent(fmt.Errorf("failed to truncate %s: %w", partPath, err))
+            }
+            return fmt.Errorf("%w (first %d bytes), starting over", errDownloadPrefixMismatch, offset)
+        }
+        c.log.Infof("Resuming from byte %d of %d.\n", offset, size)
+    }
+    if err := file.Truncate(offset); err != nil {
+        return permanent(fmt.Errorf("failed to truncate %s: %w", partPath, err))
+    }
+    c.log.Infof("Download started.\n")
+
+    progress := newProgressTracker(offset, size, c.opts.Progress, c.opts.ProgressInterval)
+    buf := make([]byte, c.opts.ChunkSize)
+    received := offset
+    for received < size {
+        chunk := buf
+        if remaining := size - received; remaining < int64(len(chunk)) {
+            chunk = chunk[:remaining]
+        }
+        n, err := conn.Read(chunk)
+        if n > 0 {
+            if _, werr := file.WriteAt(chunk[:n], received); werr != nil {
+                return permanent(fmt.Errorf("failed to write to %s: %w", partPath, werr))
+            }
+            hasher.Write(chunk[:n])
+            received += int64(n)
+            progress.Add(n)
+        }
+        if err != nil {
+            if err == io.EOF {
+                err = io.ErrUnexpectedEOF
+            }
+            return fmt.Errorf("failed to receive data after %d of %d bytes: %w", received, size, err)
+        }
+    }
+    progress.Finish()
+
+    calculated := hex.EncodeToString(hasher.Sum(nil))
+    err = file.Close()
+    file = nil
+    if err != nil {
+        return permanent(fmt.Errorf("failed to close %s: %w", partPath, err))
+    }
+    if !strings.EqualFold(calculated, fileHash) {
+        // Nothing of this download can be trusted; the retry starts over.
+        os.Remove(partPath)
+        return fmt.Errorf("hash mismatch: received %s, server has %s", calculated, fileHash)
+    }
+    if err := os.Rename(partPath, target); err != nil {
+        return permanent(fmt.Errorf("failed to rename %s: %w", partPath, err))
+    }
+    c.log.Infof("Downloaded %s to %s (%d bytes). Hash verified: %s\n", name, target, size, calculated)
+    return nil
+}
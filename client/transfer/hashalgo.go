@@ -0,0 +1,36 @@
+package transfer
+
+import (
+    "crypto/sha256"
+    "crypto/sha512"
+    "hash"
+    "hash/crc32"
+    "sort"
+)
+
+// hashAlgorithms mirrors the server's registry of file hashes.
+var hashAlgorithms = map[string]func() hash.Hash{
+    "crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+    "sha256": sha256.New,
+    "sha512": sha512.New,
+}
+
+// DefaultHashAlgorithm is used when Options.HashAlgorithm is empty, and by
+// hash cache entries written before the algorithm was recorded.
+const DefaultHashAlgorithm = "sha256"
+
+// newFileHash returns the hash sent in the header and used for every check
+// against the server.
+func (c *Client) newFileHash() hash.Hash {
+    return hashAlgorithms[c.opts.HashAlgorithm]()
+}
+
+// HashAlgorithms lists the names Options.HashAlgorithm accepts.
+func HashAlgorithms() []string {
+    names := make([]string, 0, len(hashAlgorithms))
+    for name := range hashAlgorithms {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
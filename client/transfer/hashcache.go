@@ -0,0 +1,118 @@
+package transfer
+
+import (
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// hashCacheEntry remembers the hash of a file as long as its size and
+// modification time are unchanged. Algorithm is empty in entries written
+// before the algorithm was recorded, which were all
+// DefaultHashAlgorithm.
+type hashCacheEntry struct {
+    Size      int64     `json:"size"`
+    ModTime   time.Time `json:"mod_time"`
+    Hash      string    `json:"hash"`
+    Algorithm string    `json:"algorithm,omitempty"`
+}
+
+func (e hashCacheEntry) algorithm() string {
+    if e.Algorithm == "" {
+        return DefaultHashAlgorithm
+    }
+    return e.Algorithm
+}
+
+var (
+    hashCache       map[string]hashCacheEntry
+    hashCacheMu     sync.Mutex
+    hashCacheLoaded bool
+)
+
+// hashCachePath is where the cache is kept between runs, or "" if there is
+// no user cache directory.
+func hashCachePath() string {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(dir, "eilecores", "hashes.json")
+}
+
+// Hash returns the hash of the file at filePath with the client's
+// algorithm, as it would be sent. The value is cached in the user cache
+// directory and reused while the file's size and mtime still match, so
+// retries and repeated runs do not re-read large files.
+func (c *Client) Hash(filePath string) (string, error) {
+    absPath, err := filepath.Abs(filePath)
+    if err != nil {
+        return "", err
+    }
+    info, err := os.Stat(absPath)
+    if err != nil {
+        return "", err
+    }
+
+    hashCacheMu.Lock()
+    if !hashCacheLoaded {
+        loadHashCache()
+    }
+    entry, ok := hashCache[absPath]
+    hashCacheMu.Unlock()
+    if ok && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) && entry.algorithm() == c.opts.HashAlgorithm {
+        return entry.Hash, nil
+    }
+
+    hash, err := c.calculateFileHash(absPath)
+    if err != nil {
+        return "", err
+    }
+
+    hashCacheMu.Lock()
+    hashCache[absPath] = hashCacheEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: hash, Algorithm: c.opts.HashAlgorithm}
+    saveHashCache()
+    hashCacheMu.Unlock()
+    return hash, nil
+}
+
+// loadHashCache must be called with hashCacheMu held. A missing or corrupt
+// cache just starts empty.
+func loadHashCache() {
+    hashCacheLoaded = true
+    hashCache = make(map[string]hashCacheEntry)
+    path := hashCachePath()
+    if path == "" {
+        return
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return
+    }
+    if err := json.Unmarshal(data, &hashCache); err != nil {
+        hashCache = make(map[string]hashCacheEntry)
+    }
+}
+
+// saveHashCache must be called with hashCacheMu held. Failing to persist the
+// cache only costs a re-hash next time, so errors are ignored.
+func saveHashCache() {
+    path := hashCachePath()
+    if path == "" {
+        return
+    }
+    data, err := json.Marshal(hashCache)
+    if err != nil {
+        return
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return
+    }
+    os.Rename(tmp, path)
+}
@@ -0,0 +1,89 @@
+package transfer
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// TestHashCacheInvalidation plants a made-up hash in the cache and checks
+// Hash returns it only while the file's size, modification time and the
+// algorithm still match the entry.
+func TestHashCacheInvalidation(t *testing.T) {
+    t.Setenv("XDG_CACHE_HOME", t.TempDir())
+    t.Cleanup(func() {
+        hashCacheMu.Lock()
+        hashCache, hashCacheLoaded = nil, false
+        hashCacheMu.Unlock()
+    })
+    hashCacheMu.Lock()
+    hashCache, hashCacheLoaded = nil, false
+    hashCacheMu.Unlock()
+
+    path := filepath.Join(t.TempDir(), "f.bin")
+    mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+    write := func(data string, mtime time.Time) string {
+        t.Helper()
+        if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.Chtimes(path, mtime, mtime); err != nil {
+            t.Fatal(err)
+        }
+        sum := sha256.Sum256([]byte(data))
+        return hex.EncodeToString(sum[:])
+    }
+    client, err := NewClient("127.0.0.1:1", Options{HashAlgorithm: "sha256"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    const planted = "cached"
+    plant := func() {
+        t.Helper()
+        if _, err := client.Hash(path); err != nil {
+            t.Fatal(err)
+        }
+        hashCacheMu.Lock()
+        for key, entry := range hashCache {
+            entry.Hash = planted
+            hashCache[key] = entry
+        }
+        hashCacheMu.Unlock()
+    }
+
+    write("first", mtime)
+    plant()
+    if got, _ := client.Hash(path); got != planted {
+        t.Errorf("unchanged file hashed again: %q", got)
+    }
+
+    want := write("first", mtime.Add(time.Second))
+    if got, _ := client.Hash(path); got != want {
+        t.Errorf("after an mtime change Hash = %q, want %q", got, want)
+    }
+
+    plant()
+    want = write("second, longer", mtime.Add(time.Second))
+    if got, _ := client.Hash(path); got != want {
+        t.Errorf("after a size change Hash = %q, want %q", got, want)
+    }
+
+    plant()
+    other, err := NewClient("127.0.0.1:1", Options{HashAlgorithm: "sha512"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer other.Close()
+    if got, _ := other.Hash(path); got == planted || len(got) != 128 {
+        t.Errorf("sha512 client got %q from a sha256 entry", got)
+    }
+
+    if _, err := os.Stat(hashCachePath()); err != nil {
+        t.Errorf("cache not saved: %v", err)
+    }
+}
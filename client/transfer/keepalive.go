@@ -0,0 +1,37 @@
+package transfer
+
+import (
+    "crypto/tls"
+    "net"
+    "time"
+)
+
+// keepAliveProbes is how many probes go unanswered before the connection is
+// given up, where the platform lets us set it (see keepalive_linux.go).
+const keepAliveProbes = 3
+
+// setKeepAlive sets up TCP keepalive on a connection to the server: after
+// period of silence, and then every period, a probe checks that the server
+// is still there. A server that vanished without closing the connection is
+// noticed after keepAliveProbes unanswered probes, so the transfer can be
+// retried. A period of 0 or less turns keepalive off. Failing to set it only
+// means a dead server is noticed later, so errors are ignored.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+    if tlsConn, ok := conn.(*tls.Conn); ok {
+        conn = tlsConn.NetConn()
+    }
+    if buffered, ok := conn.(*bufferedConn); ok {
+        conn = buffered.Conn
+    }
+    tcpConn, ok := conn.(*net.TCPConn)
+    if !ok {
+        return
+    }
+    if period <= 0 {
+        tcpConn.SetKeepAlive(false)
+        return
+    }
+    tcpConn.SetKeepAlive(true)
+    tcpConn.SetKeepAlivePeriod(period)
+    setKeepAliveProbes(tcpConn, period)
+}
@@ -0,0 +1,103 @@
+package transfer
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// listRequest starts a header asking the server for the files it stores.
+const listRequest = "LIST"
+
+// List header fields, in wire order.
+const (
+    lsFieldType    = iota // listRequest
+    lsFieldVersion        // ProtocolVersion
+    lsFieldAuth           // HMAC of the fields before it, see Options.Token
+    listFields
+)
+
+// maxListEntryLen bounds one entry of the listing; names include the
+// subdirectories files were stored in with Options.Dest.
+const maxListEntryLen = 64 * 1024
+
+// StoredFile is one entry of the server's listing.
+type StoredFile struct {
+    // Name includes the subdirectory the file is stored in.
+    Name string
+    Size int64
+    // HashAlgorithm and Hash are empty when the server has no hash on
+    // record (it runs without -manifest).
+    HashAlgorithm string
+    Hash          string
+}
+
+// List returns the files the server stores.
+func (c *Client) List(ctx context.Context) ([]StoredFile, error) {
+    var files []StoredFile
+    err := c.withRetry(ctx, func() (err error) {
+        files, err = c.list(ctx)
+        return err
+    })
+    return files, err
+}
+
+func (c *Client) list(ctx context.Context) (files []StoredFile, err error) {
+    sess := c.sess
+    conn, err := sess.get(ctx)
+    if err != nil {
+        return nil, err
+    }
+    // After a failure the stream is out of step with the server.
+    defer func() {
+        if err != nil {
+            sess.drop()
+        }
+    }()
+
+    fields := make([]string, listFields)
+    fields[lsFieldType] = listRequest
+    fields[lsFieldVersion] = strconv.Itoa(ProtocolVersion)
+    fields[lsFieldAuth] = c.headerMAC(strings.Join(fields[:lsFieldAuth], "|"))
+    request := strings.Join(fields, "|")
+    lengthBuf := make([]byte, 4)
+    binary.BigEndian.PutUint32(lengthBuf, uint32(len(request)))
+    if err := writeFull(conn, append(lengthBuf, request...)); err != nil {
+        return nil, fmt.Errorf("failed to send list request: %w", err)
+    }
+
+    for {
+        frame, err := readFrame(conn, maxListEntryLen)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read file list: %w", err)
+        }
+        if len(frame) == 0 {
+            return files, nil
+        }
+        entry, ok := parseStoredFile(string(frame))
+        if !ok {
+            if len(files) == 0 {
+                // Only the first frame can be a rejection.
+                return nil, rejectionError(string(frame))
+            }
+            return nil, errors.New("malformed file list entry")
+        }
+        files = append(files, entry)
+    }
+}
+
+// parseStoredFile parses a "size|hashAlgo|hash|name" entry.
+func parseStoredFile(entry string) (StoredFile, bool) {
+    parts := strings.SplitN(entry, "|", 4)
+    if len(parts) != 4 || parts[3] == "" {
+        return StoredFile{}, false
+    }
+    size, err := strconv.ParseInt(parts[0], 10, 64)
+    if err != nil || size < 0 {
+        return StoredFile{}, false
+    }
+    return StoredFile{Name: parts[3], Size: size, HashAlgorithm: parts[1], Hash: parts[2]}, true
+}
@@ -0,0 +1,105 @@
+package transfer
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "os"
+    "sync"
+)
+
+// transferRange is the part [Start, End) of a file sent over one connection.
+type transferRange struct {
+    Start int64
+    End   int64
+}
+
+// splitRanges cuts size bytes into at most n ranges of at least minSize
+// bytes each.
+func splitRanges(size int64, n int, minSize int64) []transferRange {
+    if minSize < 1 {
+        minSize = 1
+    }
+    if limit := (size + minSize - 1) / minSize; int64(n) > limit {
+        n = int(limit)
+    }
+    if n < 1 {
+        n = 1
+    }
+    ranges := make([]transferRange, 0, n)
+    for i := 0; i < n; i++ {
+        ranges = append(ranges, transferRange{
+            Start: size * int64(i) / int64(n),
+            End:   size * int64(i+1) / int64(n),
+        })
+    }
+    return ranges
+}
+
+// sendParallel sends filePath as up to Options.Parallel ranges over
+// connections of their own, each resumed and retried separately. The server
+// writes every range at its offset and checks the hash once the last one is
+// in.
+func (c *Client) sendParallel(ctx context.Context, filePath, dest string) error {
+    file, err := os.Open(filePath)
+    if err != nil {
+        return permanent(fmt.Errorf("failed to open file: %w", err))
+    }
+    defer file.Close()
+
+    meta, err := c.statFileMeta(filePath, dest)
+    if err != nil {
+        return err
+    }
+    if meta.transferID, err = transferIDFor(c.opts.HashAlgorithm, meta); err != nil {
+        return err
+    }
+
+    id := make([]byte, 8)
+    if _, err := rand.Read(id); err != nil {
+        return fmt.Errorf("failed to create transfer group: %w", err)
+    }
+    group := hex.EncodeToString(id)
+
+    ranges := splitRanges(meta.size, c.opts.Parallel, int64(c.opts.ChunkSize))
+    c.log.Infof("Transfer started over %d connection(s).\n", len(ranges))
+
+    progress := newProgressTracker(0, meta.size, c.opts.Progress, c.opts.ProgressInterval)
+    errs := make([]error, len(ranges))
+    var wg sync.WaitGroup
+    for i, r := range ranges {
+        wg.Add(1)
+        go func(i int, r transferRange) {
+            defer wg.Done()
+            sess := c.newSession()
+            defer sess.Close()
+            var counted int64
+            errs[i] = c.withRetry(ctx, func() (err error) {
+                conn, err := sess.get(ctx)
+                if err != nil {
+                    return err
+                }
+                defer func() {
+                    if err != nil {
+                        sess.drop()
+                    }
+                }()
+                return c.sendRange(conn, file, meta, group, r, progress, &counted)
+            })
+            if errs[i] != nil {
+                errs[i] = fmt.Errorf("range %d-%d: %w", r.Start, r.End, errs[i])
+            }
+        }(i, r)
+    }
+    wg.Wait()
+    if err := errors.Join(errs...); err != nil {
+        return err
+    }
+    forgetTransferID(c.opts.HashAlgorithm, meta)
+    progress.Finish()
+    // Windows cannot remove a file that is still open.
+    file.Close()
+    return c.removeSentFile(filePath, meta)
+}
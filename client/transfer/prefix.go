@@ -0,0 +1,49 @@
+package transfer
+
+import (
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// errPrefixMismatch means the bytes the server already holds differ from
+// the local file, so resuming would stitch two versions together.
+var errPrefixMismatch = errors.New("server's partial data does not match the local file")
+
+type prefixKey struct {
+    name  string
+    hash  string
+    start int64
+}
+
+func (c *Client) distrustsPrefix(meta fileMeta, r transferRange) bool {
+    _, ok := c.distrustedPrefixes.Load(prefixKey{meta.name, meta.hash, r.Start})
+    return ok
+}
+
+// checkPrefix compares the server's hash of the bytes it has for r, up to
+// offset, with the same bytes of file.
+func (c *Client) checkPrefix(file *os.File, meta fileMeta, r transferRange, offset int64, serverHash string) error {
+    release := c.acquireCPU()
+    hasher := c.newFileHash()
+    _, err := io.Copy(hasher, io.NewSectionReader(file, r.Start, offset-r.Start))
+    release()
+    if err != nil {
+        return permanent(fmt.Errorf("failed to read from file: %w", err))
+    }
+    if strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), serverHash) {
+        return nil
+    }
+    key := prefixKey{meta.name, meta.hash, r.Start}
+    if _, tried := c.resumeLimits.Load(key); c.opts.SmartResume && !tried {
+        c.resumeLimits.Store(key, int64(compareBlocks))
+        return fmt.Errorf("%w (first %d bytes), comparing blocks to find where it differs", errPrefixMismatch, offset-r.Start)
+    }
+    // Even the blocks that matched no longer do: start over.
+    c.resumeLimits.Delete(key)
+    c.distrustedPrefixes.Store(key, struct{}{})
+    return fmt.Errorf("%w (first %d bytes), starting over", errPrefixMismatch, offset-r.Start)
+}
@@ -0,0 +1,85 @@
+package transfer
+
+import (
+    "sync"
+    "time"
+)
+
+// DefaultProgressInterval is the least time between two Options.Progress
+// calls when Options.ProgressInterval is 0, so a fast chunk loop does not
+// flood whoever is listening.
+const DefaultProgressInterval = 200 * time.Millisecond
+
+// Progress describes how far a transfer has got, for Options.Progress.
+// Sent includes the resume offset; Speed only counts bytes sent in this
+// session. Total is 0 for a stream, whose size is only known once it is
+// done.
+type Progress struct {
+    Sent    int64
+    Total   int64
+    Speed   float64 // bytes per second
+    ETA     time.Duration
+    Elapsed time.Duration
+    Done    bool
+}
+
+// progressTracker turns byte counts from the send loop into throttled
+// Progress calls. It may be shared by the connections of a parallel
+// transfer.
+type progressTracker struct {
+    mu       sync.Mutex
+    handler  func(Progress)
+    interval time.Duration
+    offset   int64
+    sent     int64
+    total    int64
+    start    time.Time
+    last     time.Time
+}
+
+func newProgressTracker(offset, total int64, handler func(Progress), interval time.Duration) *progressTracker {
+    now := time.Now()
+    return &progressTracker{handler: handler, interval: interval, offset: offset, sent: offset, total: total, start: now, last: now}
+}
+
+// Skip records n bytes the server already had, which count toward the
+// total but not the speed. n is negative when a retry resumes earlier than
+// the previous attempt got.
+func (p *progressTracker) Skip(n int64) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.sent += n
+    p.offset += n
+}
+
+// Add records n more bytes sent.
+func (p *progressTracker) Add(n int) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.sent += int64(n)
+    if p.handler == nil || time.Since(p.last) < p.interval {
+        return
+    }
+    p.last = time.Now()
+    p.handler(p.update(false))
+}
+
+// Finish always reports the final state.
+func (p *progressTracker) Finish() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.handler != nil {
+        p.handler(p.update(true))
+    }
+}
+
+func (p *progressTracker) update(done bool) Progress {
+    u := Progress{Sent: p.sent, Total: p.total, Elapsed: time.Since(p.start), Done: done}
+    if elapsed := u.Elapsed.Seconds(); elapsed > 0 {
+        u.Speed = float64(p.sent-p.offset) / elapsed
+    }
+    if u.Speed > 0 && p.total > p.sent {
+        u.ETA = time.Duration(float64(p.total-p.sent) / u.Speed * float64(time.Second))
+    }
+    return u
+}
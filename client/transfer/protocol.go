@@ -0,0 +1,186 @@
+package transfer
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+)
+
+// Wire format of one transfer, shared with the server's protocol.go:
+//
+//	client: 4-byte big-endian length, then the info header, whose
+//	        "|"-separated fields are listed below
+//	server: a rejection reason, or "offset|prefix|storedAs" framed with
+//	        the same 4-byte length: the resume offset as decimal ASCII;
+//	        past the start of the range, the hex hash of the bytes
+//	        already received, which the client checks against its own
+//	        before resuming; and the name the file is stored under if
+//	        -overwrite rename chose a new one. Empty fields stay empty
+//	client: file data from the offset, the hex hash, and for signed
+//	        transfers a 4-byte length plus the signature. A stream, whose
+//	        size field is -1, sends its data as length-prefixed chunks
+//	        ended by an empty one, see stream.go; Compress sends
+//	        length-prefixed deflate chunks, see compress.go; Sparse
+//	        length-prefixed chunks and holes, see sparse.go
+//	server: the result, "status|hash" with the transfer's final status
+//	        and the hash the server calculated (empty if it did not get
+//	        that far), framed like the offset
+//
+// When an unsigned whole-file upload resumes at the end of the file and the
+// prefix hash equals the header's hash, the server already has the file:
+// the client sends no data, hash or signature, and the result follows the
+// offset reply directly. That is also the reply to a header naming a
+// stored file in fieldLinkTo that the server linked or copied.
+//
+// A header of statusRequest, followed by "|" and its HMAC when a token is
+// in use, asks for the server status instead.
+//
+// A download header, downloadRequest followed by the fields listed in
+// download.go, asks for a stored file instead:
+//
+//	server: a rejection reason, or "offset|size|hash|prefix" framed like
+//	        the offset above: where the data starts (the client's offset,
+//	        or 0 if the server cannot resume from it), the file's size and
+//	        hex SHA-256, and the hash of the bytes before the offset
+//	server: the file data from the offset to the end
+//
+// A list header, listRequest followed by the fields listed in list.go,
+// asks for the stored files:
+//
+//	server: a rejection reason, or one "size|hashAlgo|hash|name" frame
+//	        per file followed by an empty frame; the hash is empty when
+//	        the server has none on record
+//
+// A blocks header, blocksRequest followed by the fields listed in
+// smartresume.go, asks for the hashes of the partial data of an upload:
+//
+//	server: a rejection reason, or the offset an upload would resume
+//	        from, framed like the offset above, then one frame per block
+//	        up to it with the block's hex hash, then an empty frame
+
+// ProtocolVersion is the first field of every info header. A server only
+// accepts headers of its own version.
+const ProtocolVersion = 20
+
+// Info header fields, in wire order.
+const (
+    fieldVersion = iota
+    fieldName
+    fieldSize
+    fieldHash
+    fieldResume
+    fieldSigned
+    fieldIfMatch
+    fieldGroup      // parallel transfer group ID, empty for a whole file
+    fieldRangeStart // first byte of this connection's range
+    fieldRangeEnd   // end of the range (exclusive)
+    fieldReliable   // "true" for CRC-checked, acknowledged chunks, see reliable.go
+    fieldModTime    // source mtime in Unix nanoseconds, empty to keep the server's
+    fieldHashAlgo   // algorithm of fieldHash and the trailer, see hashalgo.go
+    fieldDest       // subdirectory of the server's storage directory, see Options.Dest
+    fieldTransferID // UUID of this upload, see transferid.go
+    fieldCompress   // compressDeflate for compressed chunks, see compress.go
+    fieldResumeLimit // highest offset to resume from, empty for any, see smartresume.go
+    fieldSparse // "true" for chunks that may skip runs of zeros, see sparse.go
+    fieldLinkTo // stored file this one is a hard link to, see Client.SendLink
+    fieldAuth // HMAC of the fields before it, see Options.Token
+    headerFields // number of fields
+)
+
+// authFailed is the server's rejection for a missing or wrong -token.
+const authFailed = "authentication failed"
+
+// ErrAuthFailed is not retried: the same token would fail again.
+var ErrAuthFailed = errors.New("server rejected the token")
+
+// protocolMismatch starts the server's rejection for an unsupported version.
+const protocolMismatch = "unsupported protocol version"
+
+// ErrProtocolMismatch is not retried: the server will never accept this
+// client's headers.
+var ErrProtocolMismatch = errors.New("server does not speak this client's protocol version")
+
+// storageFailed starts the server's rejection when it cannot create or open
+// the file on its disk; the rest names the cause.
+const storageFailed = "cannot store file"
+
+// ErrStorageFailed blames the server's storage, not the network, for a
+// failed upload.
+var ErrStorageFailed = errors.New("server cannot write the file to its storage")
+
+// versionConflict is the server's reply when IfMatch does not match the
+// file it currently stores.
+const versionConflict = "版本冲突"
+
+// ErrVersionConflict is not retried: the server's copy changed, so the file
+// has to be re-fetched before uploading again.
+var ErrVersionConflict = errors.New("version conflict: server file does not match the IfMatch hash")
+
+// maxReplyLen bounds the offset/rejection reply; anything longer means the
+// stream is out of step.
+const maxReplyLen = 1024
+
+// readFrame reads one length-prefixed payload of at most maxLen bytes.
+func readFrame(r io.Reader, maxLen uint32) ([]byte, error) {
+    lengthBuf := make([]byte, 4)
+    if _, err := io.ReadFull(r, lengthBuf); err != nil {
+        return nil, err
+    }
+    length := binary.BigEndian.Uint32(lengthBuf)
+    if length > maxLen {
+        return nil, fmt.Errorf("reply too large (%d bytes)", length)
+    }
+    payload := make([]byte, length)
+    if _, err := io.ReadFull(r, payload); err != nil {
+        return nil, err
+    }
+    return payload, nil
+}
+
+// transientRejections are server refusals that may go away on their own, so
+// the transfer is worth retrying. Any other rejection is final.
+var transientRejections = map[string]bool{
+    "too many connections": true,
+    "quota exceeded":       true,
+    "file busy":            true,
+    "server busy":          true,
+}
+
+// rejectionError turns a server reply that carries no offset into the error
+// for the rejection it names.
+func rejectionError(reply string) error {
+    switch {
+    case reply == versionConflict:
+        return ErrVersionConflict
+    case reply == authFailed:
+        return ErrAuthFailed
+    case strings.HasPrefix(reply, protocolMismatch):
+        return fmt.Errorf("%w: %s", ErrProtocolMismatch, reply)
+    case strings.HasPrefix(reply, storageFailed+": "):
+        return permanent(fmt.Errorf("%w: %s", ErrStorageFailed, strings.TrimPrefix(reply, storageFailed+": ")))
+    }
+    err := fmt.Errorf("server rejected transfer: %s", reply)
+    if !transientRejections[reply] {
+        err = permanent(err)
+    }
+    return err
+}
+
+// writeFull writes all of p to w. The io.Writer contract already requires
+// an error on a short write, but wrapped connections do not always honour
+// it, and a silently dropped byte would desync the stream.
+func writeFull(w io.Writer, p []byte) error {
+    for len(p) > 0 {
+        n, err := w.Write(p)
+        if err != nil {
+            return err
+        }
+        if n == 0 {
+            return io.ErrShortWrite
+        }
+        p = p[n:]
+    }
+    return nil
+}
@@ -0,0 +1,167 @@
+package transfer
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRejectionError(t *testing.T) {
+    tests := []struct {
+        reply     string
+        want      error // nil when no sentinel applies
+        retryable bool
+    }{
+        {versionConflict, ErrVersionConflict, false},
+        {authFailed, ErrAuthFailed, false},
+        {protocolMismatch + " 3, server speaks 20", ErrProtocolMismatch, false},
+        {storageFailed + ": disk full", ErrStorageFailed, false},
+        {"server busy", nil, true},
+        {"quota exceeded", nil, true},
+        {"invalid file name", nil, false},
+    }
+    for _, tt := range tests {
+        err := rejectionError(tt.reply)
+        if tt.want != nil && !errors.Is(err, tt.want) {
+            t.Errorf("rejectionError(%q) = %v, want %v", tt.reply, err, tt.want)
+        }
+        if got := isRetryable(err); got != tt.retryable {
+            t.Errorf("isRetryable(rejectionError(%q)) = %v, want %v", tt.reply, got, tt.retryable)
+        }
+    }
+}
+
+func TestReadFrame(t *testing.T) {
+    frame := func(payload string) *bytes.Reader {
+        var b bytes.Buffer
+        binary.Write(&b, binary.BigEndian, uint32(len(payload)))
+        b.WriteString(payload)
+        return bytes.NewReader(b.Bytes())
+    }
+    if got, err := readFrame(frame("12|ab|"), maxReplyLen); err != nil || string(got) != "12|ab|" {
+        t.Errorf("readFrame = %q, %v; want the payload", got, err)
+    }
+    if _, err := readFrame(frame(strings.Repeat("x", maxReplyLen+1)), maxReplyLen); err == nil {
+        t.Error("readFrame accepted a frame over maxLen")
+    }
+    if _, err := readFrame(bytes.NewReader([]byte{0, 0, 0, 5, 'a'}), maxReplyLen); err == nil {
+        t.Error("readFrame accepted a truncated frame")
+    }
+}
+
+// TestSendHeader checks the info header Send builds, against a server that
+// answers it with a version conflict.
+func TestSendHeader(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    headers := make(chan []string, 1)
+    go func() {
+        conn, err := listener.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        conn.SetDeadline(time.Now().Add(5 * time.Second))
+        info, err := readFrame(conn, 1<<20)
+        if err != nil {
+            return
+        }
+        headers <- strings.Split(string(info), "|")
+        payload := []byte(versionConflict)
+        binary.Write(conn, binary.BigEndian, uint32(len(payload)))
+        conn.Write(payload)
+    }()
+
+    data := []byte("header test data")
+    path := filepath.Join(t.TempDir(), "h.txt")
+    if err := os.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    client, err := NewClient(listener.Addr().String(), Options{Token: "secret", IfMatch: "abc", Dest: "sub", Retries: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+    if err := client.Send(context.Background(), path); !errors.Is(err, ErrVersionConflict) {
+        t.Fatalf("Send = %v, want ErrVersionConflict", err)
+    }
+
+    fields := <-headers
+    if len(fields) != headerFields {
+        t.Fatalf("header has %d fields, want %d: %q", len(fields), headerFields, fields)
+    }
+    sum := sha256.Sum256(data)
+    want := map[int]string{
+        fieldVersion:  strconv.Itoa(ProtocolVersion),
+        fieldName:     "h.txt",
+        fieldSize:     strconv.Itoa(len(data)),
+        fieldHash:     hex.EncodeToString(sum[:]),
+        fieldIfMatch:  "abc",
+        fieldHashAlgo: DefaultHashAlgorithm,
+        fieldDest:     "sub",
+        fieldLinkTo:   "",
+    }
+    for i, v := range want {
+        if fields[i] != v {
+            t.Errorf("field %d = %q, want %q", i, fields[i], v)
+        }
+    }
+    h := hmac.New(sha256.New, []byte("secret"))
+    h.Write([]byte(strings.Join(fields[:fieldAuth], "|")))
+    if fields[fieldAuth] != hex.EncodeToString(h.Sum(nil)) {
+        t.Errorf("header HMAC %q does not match its fields", fields[fieldAuth])
+    }
+}
+
+// partialWriter accepts at most max bytes per Write, without an error,
+// unlike the io.Writer contract but like some wrapped connections; once
+// failAfter bytes are written it fails.
+type partialWriter struct {
+    bytes.Buffer
+    max       int
+    failAfter int
+}
+
+func (w *partialWriter) Write(p []byte) (int, error) {
+    if w.failAfter > 0 && w.Len() >= w.failAfter {
+        return 0, errors.New("connection reset")
+    }
+    if len(p) > w.max {
+        p = p[:w.max]
+    }
+    return w.Buffer.Write(p)
+}
+
+func TestWriteFull(t *testing.T) {
+    data := []byte("a header that takes several partial writes")
+
+    w := &partialWriter{max: 5}
+    if err := writeFull(w, data); err != nil || w.String() != string(data) {
+        t.Errorf("writeFull = %v, wrote %q; want all of %q", err, w.String(), data)
+    }
+
+    w = &partialWriter{max: 0}
+    if err := writeFull(w, data); !errors.Is(err, io.ErrShortWrite) {
+        t.Errorf("writeFull to a writer taking nothing = %v, want io.ErrShortWrite", err)
+    }
+
+    w = &partialWriter{max: 5, failAfter: 10}
+    if err := writeFull(w, data); err == nil || w.Len() != 10 {
+        t.Errorf("writeFull = %v after %d bytes, want the writer's error after 10", err, w.Len())
+    }
+}
@@ -0,0 +1,308 @@
+package transfer
+
+import (
+    "bufio"
+    "context"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/textproto"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// proxyDirect given to ParseProxy ignores ALL_PROXY and dials the server
+// directly.
+const proxyDirect = "direct"
+
+// proxyHandshakeTimeout bounds the exchange with the proxy, so a proxy that
+// accepts the connection but never answers cannot hang the transfer.
+const proxyHandshakeTimeout = 30 * time.Second
+
+// ParseProxy reads a proxy URL for Options.Proxy, falling back to ALL_PROXY
+// (or all_proxy) when value is empty; "direct" and no proxy at all give
+// nil. It accepts socks5://, socks5h:// and
+// http:// URLs, with optional user:password for the proxy's own
+// authentication.
+func ParseProxy(value string) (*url.URL, error) {
+    if value == "" {
+        value = os.Getenv("ALL_PROXY")
+        if value == "" {
+            value = os.Getenv("all_proxy")
+        }
+    }
+    if value == "" || value == proxyDirect {
+        return nil, nil
+    }
+    u, err := url.Parse(value)
+    if err != nil {
+        return nil, err
+    }
+    var defaultPort string
+    switch u.Scheme {
+    case "socks5", "socks5h":
+        defaultPort = "1080"
+    case "http":
+        defaultPort = "80"
+    default:
+        return nil, fmt.Errorf("unsupported proxy scheme %q, use socks5://, socks5h:// or http://", u.Scheme)
+    }
+    if u.Hostname() == "" {
+        return nil, fmt.Errorf("proxy %q has no host", value)
+    }
+    if u.Port() == "" {
+        u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+    }
+    return u, nil
+}
+
+// proxyName describes proxy for messages, leaving out any password.
+func proxyName(proxy *url.URL) string {
+    return proxy.Scheme + "://" + proxy.Host
+}
+
+// dialProxy connects to serverAddr through proxy. The returned
+// connection carries the protocol (or TLS) exactly as a direct one would.
+// The server's host name is passed on unresolved, so it is looked up on the
+// proxy's side for both socks5:// and socks5h://.
+func dialProxy(ctx context.Context, dialer *net.Dialer, proxy *url.URL, serverAddr string) (net.Conn, error) {
+    conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyName(proxy), err)
+    }
+
+    deadline := time.Now().Add(proxyHandshakeTimeout)
+    if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+        deadline = d
+    }
+    conn.SetDeadline(deadline)
+    // Cancelling ctx interrupts the handshake by expiring the deadline.
+    done := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        select {
+        case <-ctx.Done():
+            conn.SetDeadline(time.Unix(1, 0))
+        case <-done:
+        }
+    }()
+
+    if proxy.Scheme == "http" {
+        conn, err = httpConnect(conn, proxy, serverAddr)
+    } else {
+        err = socks5Connect(conn, proxy, serverAddr)
+    }
+    close(done)
+    <-stopped
+    if err == nil {
+        err = ctx.Err()
+    }
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    conn.SetDeadline(time.Time{})
+    return conn, nil
+}
+
+// SOCKS5 protocol constants, from RFC 1928 and RFC 1929.
+const (
+    socksVersion     = 5
+    socksNoAuth      = 0
+    socksUserPass    = 2
+    socksNoMethods   = 0xff
+    socksConnect     = 1
+    socksAddrIPv4    = 1
+    socksAddrDomain  = 3
+    socksAddrIPv6    = 4
+    socksAuthVersion = 1
+)
+
+// socksReplies are the RFC 1928 failure codes a SOCKS5 proxy answers a
+// CONNECT with.
+var socksReplies = map[byte]string{
+    1: "general SOCKS server failure",
+    2: "connection not allowed by ruleset",
+    3: "network unreachable",
+    4: "host unreachable",
+    5: "connection refused",
+    6: "TTL expired",
+    7: "command not supported",
+    8: "address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 proxy on conn to connect to serverAddr,
+// logging in with the user name and password from proxy if it has them.
+func socks5Connect(conn net.Conn, proxy *url.URL, serverAddr string) error {
+    host, portStr, err := net.SplitHostPort(serverAddr)
+    if err != nil {
+        return permanent(err)
+    }
+    port, err := strconv.ParseUint(portStr, 10, 16)
+    if err != nil {
+        return permanent(fmt.Errorf("invalid port in %s", serverAddr))
+    }
+
+    methods := []byte{socksNoAuth}
+    if proxy.User != nil {
+        methods = append(methods, socksUserPass)
+    }
+    if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+        return fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+    reply := make([]byte, 2)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        return fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+    if reply[0] != socksVersion {
+        return permanent(fmt.Errorf("%s is not a SOCKS5 proxy", proxyName(proxy)))
+    }
+    switch {
+    case reply[1] == socksNoAuth:
+    case reply[1] == socksUserPass && proxy.User != nil:
+        if err := socks5Login(conn, proxy); err != nil {
+            return err
+        }
+    case reply[1] == socksNoMethods && proxy.User == nil:
+        return permanent(fmt.Errorf("proxy %s requires a user name and password", proxyName(proxy)))
+    default:
+        return permanent(fmt.Errorf("proxy %s offers no supported authentication method", proxyName(proxy)))
+    }
+
+    req := []byte{socksVersion, socksConnect, 0}
+    if ip := net.ParseIP(host); ip == nil {
+        if len(host) > 255 {
+            return permanent(fmt.Errorf("host name %s is too long for SOCKS5", host))
+        }
+        req = append(req, socksAddrDomain, byte(len(host)))
+        req = append(req, host...)
+    } else if ip4 := ip.To4(); ip4 != nil {
+        req = append(req, socksAddrIPv4)
+        req = append(req, ip4...)
+    } else {
+        req = append(req, socksAddrIPv6)
+        req = append(req, ip.To16()...)
+    }
+    req = append(req, byte(port>>8), byte(port))
+    if _, err := conn.Write(req); err != nil {
+        return fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+
+    // VER REP RSV ATYP, then the bound address, which we have no use for.
+    head := make([]byte, 4)
+    if _, err := io.ReadFull(conn, head); err != nil {
+        return fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+    if head[1] != 0 {
+        reason, ok := socksReplies[head[1]]
+        if !ok {
+            reason = fmt.Sprintf("error %d", head[1])
+        }
+        return fmt.Errorf("proxy %s could not connect to %s: %s", proxyName(proxy), serverAddr, reason)
+    }
+    var skip int64
+    switch head[3] {
+    case socksAddrIPv4:
+        skip = net.IPv4len
+    case socksAddrIPv6:
+        skip = net.IPv6len
+    case socksAddrDomain:
+        n := make([]byte, 1)
+        if _, err := io.ReadFull(conn, n); err != nil {
+            return fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+        }
+        skip = int64(n[0])
+    default:
+        return fmt.Errorf("proxy %s sent an unknown address type %d", proxyName(proxy), head[3])
+    }
+    if _, err := io.CopyN(io.Discard, conn, skip+2); err != nil {
+        return fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+    return nil
+}
+
+// socks5Login sends proxy's user name and password (RFC 1929).
+func socks5Login(conn net.Conn, proxy *url.URL) error {
+    user := proxy.User.Username()
+    pass, _ := proxy.User.Password()
+    if len(user) > 255 || len(pass) > 255 {
+        return permanent(errors.New("proxy user name and password must be at most 255 bytes each"))
+    }
+    req := []byte{socksAuthVersion, byte(len(user))}
+    req = append(req, user...)
+    req = append(req, byte(len(pass)))
+    req = append(req, pass...)
+    if _, err := conn.Write(req); err != nil {
+        return fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+    reply := make([]byte, 2)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        return fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+    if reply[1] != 0 {
+        return permanent(fmt.Errorf("proxy %s rejected the user name or password", proxyName(proxy)))
+    }
+    return nil
+}
+
+// httpConnect opens a tunnel to serverAddr with an HTTP CONNECT request.
+// The returned connection replays anything the proxy sent after its
+// response headers.
+func httpConnect(conn net.Conn, proxy *url.URL, serverAddr string) (net.Conn, error) {
+    var req strings.Builder
+    fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", serverAddr, serverAddr)
+    if proxy.User != nil {
+        pass, _ := proxy.User.Password()
+        creds := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+        fmt.Fprintf(&req, "Proxy-Authorization: Basic %s\r\n", creds)
+    }
+    req.WriteString("\r\n")
+    if _, err := io.WriteString(conn, req.String()); err != nil {
+        return conn, fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+
+    br := bufio.NewReader(conn)
+    tp := textproto.NewReader(br)
+    status, err := tp.ReadLine()
+    if err != nil {
+        return conn, fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+    // Drain the response headers; a CONNECT reply has no body we care about.
+    if _, err := tp.ReadMIMEHeader(); err != nil {
+        return conn, fmt.Errorf("failed to talk to proxy %s: %w", proxyName(proxy), err)
+    }
+    proto, rest, _ := strings.Cut(status, " ")
+    code, _, _ := strings.Cut(rest, " ")
+    if !strings.HasPrefix(proto, "HTTP/") {
+        return conn, permanent(fmt.Errorf("%s is not an HTTP proxy", proxyName(proxy)))
+    }
+    switch {
+    case code == "407":
+        return conn, permanent(fmt.Errorf("proxy %s requires authentication: %s", proxyName(proxy), rest))
+    case len(code) != 3 || code[0] != '2':
+        return conn, fmt.Errorf("proxy %s could not connect to %s: %s", proxyName(proxy), serverAddr, rest)
+    }
+    if br.Buffered() > 0 {
+        return &bufferedConn{Conn: conn, r: br}, nil
+    }
+    return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into r.
+type bufferedConn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+    if c.r.Buffered() > 0 {
+        return c.r.Read(p)
+    }
+    return c.Conn.Read(p)
+}
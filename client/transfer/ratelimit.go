@@ -0,0 +1,44 @@
+package transfer
+
+import (
+    "sync"
+    "time"
+)
+
+// tokenBucket limits throughput to rate bytes per second. A rate <= 0 means
+// unlimited. Wait lets the bucket go into debt for large chunks and sleeps
+// the debt off, so the average rate is respected without splitting chunks.
+type tokenBucket struct {
+    mu     sync.Mutex
+    rate   float64
+    tokens float64
+    last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+    return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Wait blocks until n more bytes may be sent.
+func (b *tokenBucket) Wait(n int) {
+    b.mu.Lock()
+    if b.rate <= 0 {
+        b.mu.Unlock()
+        return
+    }
+    now := time.Now()
+    // Burst is capped at one second worth of tokens.
+    b.tokens += now.Sub(b.last).Seconds() * b.rate
+    if b.tokens > b.rate {
+        b.tokens = b.rate
+    }
+    b.last = now
+    b.tokens -= float64(n)
+    var delay time.Duration
+    if b.tokens < 0 {
+        delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+    }
+    b.mu.Unlock()
+
+    time.Sleep(delay)
+}
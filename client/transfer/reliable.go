@@ -0,0 +1,54 @@
+package transfer
+
+import (
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "net"
+)
+
+const (
+    chunkAck  = 'A'
+    chunkNack = 'N'
+)
+
+// MaxFramedChunkSize is the largest ChunkSize Reliable, Compress, Sparse
+// and SendStream allow: the server accepts no larger chunk where chunks
+// carry their own length.
+const MaxFramedChunkSize = 64 * 1024 * 1024
+
+// maxChunkResends is how often one chunk is sent again after the server
+// reports a CRC mismatch before the attempt is given up.
+const maxChunkResends = 3
+
+// sendCheckedChunk sends data as one chunk of Options.Reliable: with its
+// length and CRC32, re-sending it while the server answers chunkNack. See
+// the server's reliable.go.
+func sendCheckedChunk(conn net.Conn, data []byte) error {
+    var header [8]byte
+    binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+    binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(data))
+    reply := make([]byte, 1)
+    for resends := 0; ; resends++ {
+        if err := writeFull(conn, header[:]); err != nil {
+            return fmt.Errorf("failed to send data: %w", err)
+        }
+        if err := writeFull(conn, data); err != nil {
+            return fmt.Errorf("failed to send data: %w", err)
+        }
+        if _, err := io.ReadFull(conn, reply); err != nil {
+            return fmt.Errorf("failed to read chunk acknowledgement: %w", err)
+        }
+        switch reply[0] {
+        case chunkAck:
+            return nil
+        case chunkNack:
+            if resends == maxChunkResends {
+                return fmt.Errorf("chunk of %d bytes still corrupted after %d resends", len(data), resends)
+            }
+        default:
+            return fmt.Errorf("unexpected chunk acknowledgement %q", reply[0])
+        }
+    }
+}
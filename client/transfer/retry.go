@@ -0,0 +1,100 @@
+package transfer
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "time"
+)
+
+// permanentError marks a failure another attempt would only repeat, such as
+// a missing local file or a server rejection that will not change.
+type permanentError struct {
+    err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+    return permanentError{err}
+}
+
+// isRetryable reports whether err looks transient, i.e. a network failure
+// or a server that is only busy for now.
+func isRetryable(err error) bool {
+    var p permanentError
+    if errors.As(err, &p) {
+        return false
+    }
+    return !errors.Is(err, ErrVersionConflict) && !errors.Is(err, ErrProtocolMismatch) && !errors.Is(err, ErrAuthFailed)
+}
+
+// withRetry runs attempt up to Options.Retries times, giving up early on
+// errors that would only repeat (see isRetryable), when ctx is done and
+// when Options.Interrupted says so. Each attempt resumes from the offset
+// the server reports.
+func (c *Client) withRetry(ctx context.Context, attempt func() error) error {
+    retries := c.opts.Retries
+    var err error
+    for i := 1; i <= retries; i++ {
+        err = attempt()
+        if err == nil {
+            return nil
+        }
+        if !isRetryable(err) {
+            return err
+        }
+        if err := deadlineErr(ctx); err != nil {
+            return fmt.Errorf("deadline exceeded after attempt %d/%d: %w", i, retries, err)
+        }
+        c.log.Warnf("Attempt %d/%d failed: %v\n", i, retries, err)
+        if c.opts.Interrupted != nil && c.opts.Interrupted() {
+            return fmt.Errorf("interrupted after attempt %d/%d: %w", i, retries, err)
+        }
+        if i < retries {
+            delay := c.retryDelay(i)
+            c.log.Infof("Retrying...\n")
+            c.log.Debugf("Waiting %s before attempt %d/%d.\n", delay.Round(time.Millisecond), i+1, retries)
+            select {
+            case <-ctx.Done():
+                return fmt.Errorf("deadline exceeded while waiting to retry: %w", ctx.Err())
+            case <-time.After(delay):
+            }
+        }
+    }
+    return fmt.Errorf("all %d attempts failed: %w", retries, err)
+}
+
+// deadlineErr returns ctx.Err(), or context.DeadlineExceeded once ctx's
+// deadline has passed: the connection deadline set from it can fire a
+// moment before ctx itself is done.
+func deadlineErr(ctx context.Context) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+        return context.DeadlineExceeded
+    }
+    return nil
+}
+
+// retryDelay is how long to wait after the given failed attempt (1-based):
+// Options.RetryBase doubled per attempt and capped at Options.RetryMax,
+// then jittered to between half and all of that so retrying clients spread
+// out.
+func (c *Client) retryDelay(attempt int) time.Duration {
+    d, max := c.opts.RetryBase, c.opts.RetryMax
+    for i := 1; i < attempt && d < max; i++ {
+        d *= 2
+    }
+    if d > max {
+        d = max
+    }
+    if d <= 0 {
+        return 0
+    }
+    half := d / 2
+    return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
@@ -0,0 +1,82 @@
+package transfer
+
+import (
+    "context"
+    "encoding/binary"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// TestSendRetriesPerIPRejection sends to a server that turns the first
+// connection away as over its per-IP limit, and checks the client retries
+// and the second connection carries the file.
+func TestSendRetriesPerIPRejection(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    writeTestFrame := func(conn net.Conn, payload string) {
+        binary.Write(conn, binary.BigEndian, uint32(len(payload)))
+        io.WriteString(conn, payload)
+    }
+    received := make(chan []byte, 1)
+    go func() {
+        for i := 1; ; i++ {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            conn.SetDeadline(time.Now().Add(5 * time.Second))
+            if i == 1 {
+                writeTestFrame(conn, "too many connections")
+                conn.Close()
+                continue
+            }
+            info, err := readFrame(conn, 1<<20)
+            if err != nil {
+                conn.Close()
+                return
+            }
+            fields := strings.Split(string(info), "|")
+            size, _ := strconv.Atoi(fields[fieldSize])
+            writeTestFrame(conn, "0||")
+            data := make([]byte, size+len(fields[fieldHash]))
+            if _, err := io.ReadFull(conn, data); err != nil {
+                conn.Close()
+                return
+            }
+            received <- data[:size]
+            writeTestFrame(conn, statusComplete+"|"+fields[fieldHash])
+            conn.Close()
+        }
+    }()
+
+    data := []byte("sent on the second connection")
+    path := filepath.Join(t.TempDir(), "r.txt")
+    if err := os.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    client, err := NewClient(listener.Addr().String(), Options{Retries: 3, RetryBase: time.Millisecond, RetryMax: time.Millisecond})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+    if err := client.Send(context.Background(), path); err != nil {
+        t.Fatalf("Send = %v, want the retry to succeed", err)
+    }
+    select {
+    case got := <-received:
+        if string(got) != string(data) {
+            t.Errorf("server received %q, want %q", got, data)
+        }
+    default:
+        t.Error("the retry did not send the file")
+    }
+}
@@ -0,0 +1,343 @@
+package transfer
+
+import (
+    "context"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Send uploads the file at filePath into Options.Dest, resuming whatever
+// the server already has of it and retrying failed attempts.
+func (c *Client) Send(ctx context.Context, filePath string) error {
+    return c.SendTo(ctx, filePath, c.opts.Dest)
+}
+
+// SendTo is Send with dest, a subdirectory of the server's storage
+// directory, instead of Options.Dest.
+func (c *Client) SendTo(ctx context.Context, filePath, dest string) error {
+    if err := checkLocalFile(filePath); err != nil {
+        return err
+    }
+    if c.opts.Parallel > 1 {
+        return c.sendParallel(ctx, filePath, dest)
+    }
+    return c.withRetry(ctx, func() error {
+        return c.sendFile(ctx, filePath, dest, "")
+    })
+}
+
+// SendLink is SendTo for a file that is a hard link to linkTo, the path of
+// a file already sent, relative to the server's storage directory. The
+// server recreates the link, or copies linkTo where it cannot, once it has
+// checked that linkTo holds the same data, and only receives the data if
+// it has no such file. Signed uploads always send the data, since the
+// server has to verify their signature.
+func (c *Client) SendLink(ctx context.Context, filePath, dest, linkTo string) error {
+    if c.opts.SignKey != nil {
+        return c.SendTo(ctx, filePath, dest)
+    }
+    if err := checkLocalFile(filePath); err != nil {
+        return err
+    }
+    return c.withRetry(ctx, func() error {
+        return c.sendFile(ctx, filePath, dest, linkTo)
+    })
+}
+
+// checkLocalFile rejects a file no attempt could send, before any
+// connection is made: one that is missing, unreadable or not a regular file.
+func checkLocalFile(filePath string) error {
+    info, err := os.Stat(filePath)
+    if err == nil && info.IsDir() {
+        return permanent(errors.New("is a directory"))
+    }
+    if err == nil && !info.Mode().IsRegular() {
+        return permanent(errors.New("not a regular file"))
+    }
+    if err == nil {
+        // Stat succeeds without read permission, opening does not.
+        var file *os.File
+        if file, err = os.Open(filePath); err == nil {
+            file.Close()
+            return nil
+        }
+    }
+    switch {
+    case errors.Is(err, fs.ErrNotExist):
+        return permanent(errors.New("no such file"))
+    case errors.Is(err, fs.ErrPermission):
+        return permanent(errors.New("permission denied"))
+    }
+    return permanent(err)
+}
+
+// fileMeta is what the info header says about the file being sent.
+type fileMeta struct {
+    name       string
+    size       int64
+    hash       string
+    modTime    time.Time // sent with Options.PreserveTimes
+    transferID string    // see transferid.go
+    dest       string    // server directory, see SendTo
+    linkTo     string    // stored file this one is a hard link to, see SendLink
+}
+
+func (c *Client) statFileMeta(filePath, dest string) (fileMeta, error) {
+    meta := fileMeta{name: filepath.Base(filePath), dest: dest}
+    info, err := os.Stat(filePath)
+    if err != nil {
+        return meta, permanent(fmt.Errorf("failed to get file size: %w", err))
+    }
+    meta.size = info.Size()
+    meta.modTime = info.ModTime()
+
+    meta.hash, err = c.Hash(filePath)
+    if err != nil {
+        return meta, permanent(fmt.Errorf("failed to calculate file hash: %w", err))
+    }
+    return meta, nil
+}
+
+func (c *Client) sendFile(ctx context.Context, filePath, dest, linkTo string) (err error) {
+    sess := c.sess
+    file, err := os.Open(filePath)
+    if err != nil {
+        return permanent(fmt.Errorf("failed to open file: %w", err))
+    }
+    defer file.Close()
+
+    meta, err := c.statFileMeta(filePath, dest)
+    if err != nil {
+        return err
+    }
+    meta.linkTo = linkTo
+    if meta.transferID, err = transferIDFor(c.opts.HashAlgorithm, meta); err != nil {
+        return err
+    }
+
+    conn, err := sess.get(ctx)
+    if err != nil {
+        return err
+    }
+    // After a failure the stream is out of step with the server.
+    defer func() {
+        if err != nil {
+            sess.drop()
+        }
+    }()
+
+    progress := newProgressTracker(0, meta.size, c.opts.Progress, c.opts.ProgressInterval)
+    var counted int64
+    if err := c.sendRange(conn, file, meta, "", transferRange{0, meta.size}, progress, &counted); err != nil {
+        return err
+    }
+    forgetTransferID(c.opts.HashAlgorithm, meta)
+    progress.Finish()
+    // Windows cannot remove a file that is still open.
+    file.Close()
+    return c.removeSentFile(filePath, meta)
+}
+
+// sendRange sends the bytes of r over conn, resuming wherever the server
+// says, followed by the hash and signature. group is empty for a whole-file
+// transfer. counted holds how many bytes of r progress has already been
+// told about, so a retried range is not counted twice.
+func (c *Client) sendRange(conn net.Conn, file *os.File, meta fileMeta, group string, r transferRange, progress *progressTracker, counted *int64) error {
+    // The server does not resume a link; it links or starts over.
+    resume := !c.distrustsPrefix(meta, r) && meta.linkTo == ""
+    signed := c.opts.SignKey != nil
+    fields := make([]string, headerFields)
+    fields[fieldVersion] = strconv.Itoa(ProtocolVersion)
+    fields[fieldName] = meta.name
+    fields[fieldSize] = strconv.FormatInt(meta.size, 10)
+    fields[fieldHash] = meta.hash
+    fields[fieldResume] = strconv.FormatBool(resume)
+    fields[fieldSigned] = strconv.FormatBool(signed)
+    fields[fieldIfMatch] = c.opts.IfMatch
+    fields[fieldReliable] = strconv.FormatBool(c.opts.Reliable)
+    fields[fieldHashAlgo] = c.opts.HashAlgorithm
+    fields[fieldDest] = meta.dest
+    fields[fieldTransferID] = meta.transferID
+    fields[fieldLinkTo] = meta.linkTo
+    if c.opts.Compress {
+        fields[fieldCompress] = compressDeflate
+    }
+    if c.opts.Sparse {
+        fields[fieldSparse] = "true"
+    }
+    if c.opts.PreserveTimes {
+        fields[fieldModTime] = strconv.FormatInt(meta.modTime.UnixNano(), 10)
+    }
+    if group != "" {
+        fields[fieldGroup] = group
+        fields[fieldRangeStart] = strconv.FormatInt(r.Start, 10)
+        fields[fieldRangeEnd] = strconv.FormatInt(r.End, 10)
+    }
+    if resume {
+        limit, err := c.resumeLimit(conn, file, meta, r)
+        if err != nil {
+            return err
+        }
+        fields[fieldResumeLimit] = limit
+    }
+    fields[fieldAuth] = c.headerMAC(strings.Join(fields[:fieldAuth], "|"))
+    info := strings.Join(fields, "|")
+    infoLength := uint32(len(info))
+    lengthBuf := make([]byte, 4)
+    binary.BigEndian.PutUint32(lengthBuf, infoLength)
+
+    err := writeFull(conn, lengthBuf)
+    if err != nil {
+        return fmt.Errorf("failed to send info length: %w", err)
+    }
+    err = writeFull(conn, []byte(info))
+    if err != nil {
+        return fmt.Errorf("failed to send file info: %w", err)
+    }
+
+    reply, err := readFrame(conn, maxReplyLen)
+    if err != nil {
+        return fmt.Errorf("failed to read resume offset: %w", err)
+    }
+    offsetStr := string(reply)
+    replyFields := strings.SplitN(offsetStr, "|", 3)
+    offset, err := strconv.ParseInt(replyFields[0], 10, 64)
+    if err != nil {
+        return rejectionError(offsetStr)
+    }
+
+    if offset < r.Start || offset > r.End {
+        return fmt.Errorf("server sent resume offset %d for range %d-%d", offset, r.Start, r.End)
+    }
+    if len(replyFields) != 3 {
+        return fmt.Errorf("malformed server reply %q", offsetStr)
+    }
+    prefixHash, storedAs := replyFields[1], replyFields[2]
+    if group == "" {
+        c.log.Debugf("Sent header for %s (%d bytes, %s %s); server has it up to byte %d.\n",
+            meta.name, meta.size, c.opts.HashAlgorithm, meta.hash, offset)
+    } else {
+        c.log.Debugf("Sent header for %s bytes %d-%d; server has them up to byte %d.\n", meta.name, r.Start, r.End, offset)
+    }
+    // The server already has the whole file, and its hash covering all of
+    // it matches ours: nothing is sent and the result follows right away.
+    if group == "" && !signed && offset == meta.size && offset > 0 && strings.EqualFold(prefixHash, meta.hash) {
+        if meta.linkTo != "" {
+            c.log.Infof("%s was recreated on the server from %s.\n", meta.name, meta.linkTo)
+        } else {
+            c.log.Infof("%s is already complete on the server.\n", meta.name)
+        }
+        progress.Skip(offset - r.Start - *counted)
+        *counted = offset - r.Start
+        result, err := readFrame(conn, maxReplyLen)
+        if err != nil {
+            return fmt.Errorf("failed to read transfer result: %w", err)
+        }
+        return c.checkResult(meta, string(result))
+    }
+    if offset > r.Start {
+        if err := c.checkPrefix(file, meta, r, offset, prefixHash); err != nil {
+            return err
+        }
+    }
+    if storedAs != "" && r.Start == 0 {
+        c.log.Infof("%s already exists on the server, storing it as %s.\n", meta.name, storedAs)
+    }
+
+    if group == "" {
+        if offset > 0 {
+            c.log.Infof("Resuming from byte %d of %d.\n", offset, meta.size)
+        }
+        c.log.Infof("Transfer started.\n")
+    }
+
+    progress.Skip(offset - r.Start - *counted)
+    *counted = offset - r.Start
+    buf := make([]byte, c.opts.ChunkSize)
+    section := io.NewSectionReader(file, offset, r.End-offset)
+    var deflater *chunkDeflater
+    if c.opts.Compress {
+        deflater = &chunkDeflater{acquireCPU: c.acquireCPU}
+    }
+    var sparse *sparseSender
+    if c.opts.Sparse {
+        sparse = &sparseSender{}
+    }
+    for {
+        n, err := section.Read(buf)
+        if err != nil {
+            if err == io.EOF {
+                break
+            }
+            return permanent(fmt.Errorf("failed to read from file: %w", err))
+        }
+
+        // With Sparse only what is not skipped uses up bandwidth.
+        if sparse == nil {
+            c.limiter.Wait(n)
+        }
+        if sparse != nil {
+            var sent int
+            sent, err = sparse.send(conn, buf[:n])
+            c.limiter.Wait(sent)
+        } else if c.opts.Reliable {
+            err = sendCheckedChunk(conn, buf[:n])
+        } else if deflater != nil {
+            err = deflater.send(conn, buf[:n])
+        } else if err = writeFull(conn, buf[:n]); err != nil {
+            err = fmt.Errorf("failed to send data: %w", err)
+        }
+        if err != nil {
+            return err
+        }
+        progress.Add(n)
+        *counted += int64(n)
+    }
+    if sparse != nil {
+        if err := sparse.flush(conn); err != nil {
+            return err
+        }
+    }
+
+    err = writeFull(conn, []byte(meta.hash))
+    if err != nil {
+        return fmt.Errorf("failed to send file hash: %w", err)
+    }
+
+    if signed {
+        if err := sendSignature(conn, c.opts.SignKey, meta.hash); err != nil {
+            return fmt.Errorf("failed to send signature: %w", err)
+        }
+    }
+
+    result, err := readFrame(conn, maxReplyLen)
+    if err != nil {
+        return fmt.Errorf("failed to read transfer result: %w", err)
+    }
+    return c.checkResult(meta, string(result))
+}
+
+func (c *Client) calculateFileHash(filePath string) (string, error) {
+    file, err := os.Open(filePath)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    defer c.acquireCPU()()
+    hasher := c.newFileHash()
+    if _, err := io.Copy(hasher, file); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hasher.Sum(nil)), nil
+}
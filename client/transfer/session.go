@@ -0,0 +1,54 @@
+package transfer
+
+import (
+    "context"
+    "fmt"
+    "net"
+)
+
+// session keeps one connection to the server open across the files of a
+// batch; the server reads one header after another until the connection is
+// closed. Any failed transfer drops the connection so the retry redials.
+type session struct {
+    client *Client
+    conn   net.Conn
+}
+
+func (c *Client) newSession() *session {
+    return &session{client: c}
+}
+
+// get returns the open connection, dialing a new one if there is none.
+func (s *session) get(ctx context.Context) (net.Conn, error) {
+    if s.conn != nil {
+        return s.conn, nil
+    }
+    c := s.client
+    conn, err := c.dial(ctx)
+    if err != nil {
+        c.log.Warnf("Connection failed: %v\n", err)
+        return nil, fmt.Errorf("error connecting to server: %w", err)
+    }
+
+    // Reads and writes fail with a timeout once the overall deadline passes.
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+
+    c.log.Debugf("Connected to %s (%s).\n", c.addr, c.Scheme())
+    c.log.Infof("Connection successful.\n")
+    s.conn = conn
+    return conn, nil
+}
+
+// drop closes the current connection, if any.
+func (s *session) drop() {
+    if s.conn != nil {
+        s.conn.Close()
+        s.conn = nil
+    }
+}
+
+func (s *session) Close() {
+    s.drop()
+}
@@ -0,0 +1,47 @@
+package transfer
+
+import (
+    "crypto/ed25519"
+    "crypto/x509"
+    "encoding/binary"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+)
+
+// LoadPrivateKey reads a PEM "PRIVATE KEY" (PKCS#8) ed25519 key, as written
+// by `openssl genpkey -algorithm ed25519`, for Options.SignKey.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, errors.New("no PEM data found")
+    }
+    key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, err
+    }
+    priv, ok := key.(ed25519.PrivateKey)
+    if !ok {
+        return nil, fmt.Errorf("unsupported private key type %T, want ed25519", key)
+    }
+    return priv, nil
+}
+
+// sendSignature writes a detached signature over the hex content hash as a
+// 4-byte big-endian length followed by the signature bytes.
+func sendSignature(w io.Writer, key ed25519.PrivateKey, hash string) error {
+    sig := ed25519.Sign(key, []byte(hash))
+    lengthBuf := make([]byte, 4)
+    binary.BigEndian.PutUint32(lengthBuf, uint32(len(sig)))
+    if _, err := w.Write(lengthBuf); err != nil {
+        return err
+    }
+    _, err := w.Write(sig)
+    return err
+}
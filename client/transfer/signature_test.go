@@ -0,0 +1,64 @@
+package transfer
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "crypto/x509"
+    "encoding/binary"
+    "encoding/pem"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// TestSignatureRoundTrip loads a PKCS#8 key as -sign-key does and checks
+// that the frame sendSignature writes verifies against the hash, and fails
+// to once it is tampered with.
+func TestSignatureRoundTrip(t *testing.T) {
+    pub, priv, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    der, err := x509.MarshalPKCS8PrivateKey(priv)
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "key.pem")
+    if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+        t.Fatal(err)
+    }
+    key, err := LoadPrivateKey(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    hash := "467abc3dce4e46c30cb43b3fa2e43a24e2b19c7e7d9655586f35bc4152062e09"
+    var frame bytes.Buffer
+    if err := sendSignature(&frame, key, hash); err != nil {
+        t.Fatal(err)
+    }
+    length := binary.BigEndian.Uint32(frame.Bytes())
+    sig := frame.Bytes()[4:]
+    if int(length) != len(sig) {
+        t.Fatalf("frame length %d, signature %d bytes", length, len(sig))
+    }
+    if !ed25519.Verify(pub, []byte(hash), sig) {
+        t.Error("signature does not verify")
+    }
+    sig[0] ^= 0xff
+    if ed25519.Verify(pub, []byte(hash), sig) {
+        t.Error("tampered signature verifies")
+    }
+}
+
+func TestLoadPrivateKeyRejectsOtherKeys(t *testing.T) {
+    dir := t.TempDir()
+    garbage := filepath.Join(dir, "garbage.pem")
+    os.WriteFile(garbage, []byte("not a key"), 0600)
+    if _, err := LoadPrivateKey(garbage); err == nil {
+        t.Error("LoadPrivateKey accepted a file without PEM data")
+    }
+    if _, err := LoadPrivateKey(filepath.Join(dir, "missing.pem")); err == nil {
+        t.Error("LoadPrivateKey accepted a missing file")
+    }
+}
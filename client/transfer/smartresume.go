@@ -0,0 +1,135 @@
+package transfer
+
+import (
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// resumeBlockSize is the size of the blocks compared by
+// Options.SmartResume.
+const resumeBlockSize = 1024 * 1024
+
+// blocksRequest starts a header asking for the hashes of the blocks of the
+// server's partial data, see the server's smartresume.go.
+const blocksRequest = "BLOCKS"
+
+// Blocks header fields, in wire order.
+const (
+    bkFieldType     = iota // blocksRequest
+    bkFieldVersion         // ProtocolVersion
+    bkFieldName
+    bkFieldDest     // as fieldDest
+    bkFieldHashAlgo // as fieldHashAlgo, used for the block hashes
+    bkFieldHash     // our hash of the whole file
+    bkFieldStart    // first byte of the range, 0 for a whole file
+    bkFieldBlock    // block size in bytes
+    bkFieldAuth     // HMAC of the fields before it, see Options.Token
+    blocksFields
+)
+
+// compareBlocks in resumeLimits asks the next attempt to compare blocks
+// before sending its header.
+const compareBlocks = -1
+
+// resumeLimit returns the fieldResumeLimit value for r, empty when the
+// server's offset can be taken as is. A range waiting for compareBlocks has
+// its blocks compared on conn first.
+func (c *Client) resumeLimit(conn net.Conn, file *os.File, meta fileMeta, r transferRange) (string, error) {
+    key := prefixKey{meta.name, meta.hash, r.Start}
+    val, ok := c.resumeLimits.Load(key)
+    if !ok {
+        return "", nil
+    }
+    limit := val.(int64)
+    if limit == compareBlocks {
+        var err error
+        if limit, err = c.findResumePoint(conn, file, meta, r); err != nil {
+            return "", err
+        }
+        c.resumeLimits.Store(key, limit)
+    }
+    return strconv.FormatInt(limit, 10), nil
+}
+
+// findResumePoint asks the server for the hashes of the blocks it has for r
+// and returns where the first one that differs from file starts, or the
+// server's offset if none does.
+func (c *Client) findResumePoint(conn net.Conn, file *os.File, meta fileMeta, r transferRange) (int64, error) {
+    fields := make([]string, blocksFields)
+    fields[bkFieldType] = blocksRequest
+    fields[bkFieldVersion] = strconv.Itoa(ProtocolVersion)
+    fields[bkFieldName] = meta.name
+    fields[bkFieldDest] = meta.dest
+    fields[bkFieldHashAlgo] = c.opts.HashAlgorithm
+    fields[bkFieldHash] = meta.hash
+    fields[bkFieldStart] = strconv.FormatInt(r.Start, 10)
+    fields[bkFieldBlock] = strconv.Itoa(resumeBlockSize)
+    fields[bkFieldAuth] = c.headerMAC(strings.Join(fields[:bkFieldAuth], "|"))
+    request := strings.Join(fields, "|")
+    lengthBuf := make([]byte, 4)
+    binary.BigEndian.PutUint32(lengthBuf, uint32(len(request)))
+    if err := writeFull(conn, append(lengthBuf, request...)); err != nil {
+        return 0, fmt.Errorf("failed to send blocks request: %w", err)
+    }
+
+    reply, err := readFrame(conn, maxReplyLen)
+    if err != nil {
+        return 0, fmt.Errorf("failed to read block hashes: %w", err)
+    }
+    offset, err := strconv.ParseInt(string(reply), 10, 64)
+    if err != nil {
+        return 0, rejectionError(string(reply))
+    }
+    if offset < r.Start || offset > r.End {
+        return 0, fmt.Errorf("server sent resume offset %d for range %d-%d", offset, r.Start, r.End)
+    }
+
+    // Read every frame even after a difference, so the connection stays in
+    // step for the upload that follows.
+    point := int64(-1)
+    buf := make([]byte, resumeBlockSize)
+    for pos := r.Start; ; pos += resumeBlockSize {
+        frame, err := readFrame(conn, maxReplyLen)
+        if err != nil {
+            return 0, fmt.Errorf("failed to read block hashes: %w", err)
+        }
+        if len(frame) == 0 {
+            break
+        }
+        if pos >= offset {
+            return 0, fmt.Errorf("server sent more block hashes than its offset %d covers", offset)
+        }
+        if point >= 0 {
+            continue
+        }
+        n := offset - pos
+        if n > resumeBlockSize {
+            n = resumeBlockSize
+        }
+        if _, err := io.ReadFull(io.NewSectionReader(file, pos, n), buf[:n]); err != nil {
+            return 0, permanent(fmt.Errorf("failed to read from file: %w", err))
+        }
+        release := c.acquireCPU()
+        hasher := c.newFileHash()
+        hasher.Write(buf[:n])
+        release()
+        if !strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), string(frame)) {
+            point = pos
+        }
+    }
+    if point < 0 {
+        point = offset
+    }
+    if point > r.Start {
+        c.log.Infof("%s: server's partial data matches up to byte %d, resuming from there.\n", meta.name, point)
+    } else {
+        c.log.Infof("%s: server's partial data differs from the first block, starting over.\n", meta.name)
+    }
+    return point, nil
+}
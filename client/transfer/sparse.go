@@ -0,0 +1,93 @@
+package transfer
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "net"
+)
+
+// sparseHoleFlag marks a chunk length that counts skipped zeros.
+const sparseHoleFlag = 1 << 31
+
+// maxSparseHole is the most zeros one hole chunk can skip.
+const maxSparseHole = sparseHoleFlag - 1
+
+// sparseBlock is the granularity zeros are looked for at: a file system
+// block, so the holes the server leaves are ones its disk can keep.
+const sparseBlock = 4096
+
+var sparseZeroBlock = make([]byte, sparseBlock)
+
+// sparseSender skips the runs of zeros of Options.Sparse, such as the holes
+// of a VM disk image: the data goes as length-prefixed chunks and each run
+// of zeros as just its length, which the server leaves as a hole in the
+// stored file. See the server's sparse.go. The hash is still that of the
+// file itself. A hole is held back until the data after it, or the end of
+// the range, so that runs of zeros across chunks go as one.
+type sparseSender struct {
+    hole int64
+}
+
+// send sends data, returning how many bytes of it actually crossed the
+// network.
+func (s *sparseSender) send(conn net.Conn, data []byte) (int, error) {
+    sent := 0
+    for i := 0; i < len(data); {
+        end := i + sparseBlock
+        if end > len(data) {
+            end = len(data)
+        }
+        if bytes.Equal(data[i:end], sparseZeroBlock[:end-i]) {
+            s.hole += int64(end - i)
+            i = end
+            continue
+        }
+        for end < len(data) {
+            next := end + sparseBlock
+            if next > len(data) {
+                next = len(data)
+            }
+            if bytes.Equal(data[end:next], sparseZeroBlock[:next-end]) {
+                break
+            }
+            end = next
+        }
+        if err := s.flush(conn); err != nil {
+            return sent, err
+        }
+        if err := sendSparseChunk(conn, uint32(end-i), data[i:end]); err != nil {
+            return sent, err
+        }
+        sent += end - i
+        i = end
+    }
+    return sent, nil
+}
+
+// flush sends the hole held back, if any.
+func (s *sparseSender) flush(conn net.Conn) error {
+    for s.hole > 0 {
+        n := s.hole
+        if n > maxSparseHole {
+            n = maxSparseHole
+        }
+        if err := sendSparseChunk(conn, sparseHoleFlag|uint32(n), nil); err != nil {
+            return err
+        }
+        s.hole -= n
+    }
+    return nil
+}
+
+func sendSparseChunk(conn net.Conn, length uint32, data []byte) error {
+    var header [4]byte
+    binary.BigEndian.PutUint32(header[:], length)
+    if err := writeFull(conn, header[:]); err != nil {
+        return fmt.Errorf("failed to send data: %w", err)
+    }
+    if err := writeFull(conn, data); err != nil {
+        return fmt.Errorf("failed to send data: %w", err)
+    }
+    return nil
+}
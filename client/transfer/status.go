@@ -0,0 +1,64 @@
+package transfer
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+)
+
+// statusRequest asks the server for its status instead of sending a file.
+const statusRequest = "STATUS"
+
+// ErrStatusUnsupported is returned by Status when the server answers the
+// request with a rejection, as servers that predate it do, rather than
+// with its status.
+var ErrStatusUnsupported = errors.New("server does not support status requests")
+
+// ServerStatus is the server's reply to a status request. FreeBytes is -1
+// when the server cannot tell.
+type ServerStatus struct {
+    FreeBytes         int64 `json:"free_bytes"`
+    ActiveConnections int64 `json:"active_connections"`
+}
+
+// Status asks the server for its status, over a connection of its own.
+func (c *Client) Status(ctx context.Context) (ServerStatus, error) {
+    var status ServerStatus
+
+    conn, err := c.dial(ctx)
+    if err != nil {
+        return status, fmt.Errorf("error connecting to server: %w", err)
+    }
+    defer conn.Close()
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+
+    request := statusRequest
+    if mac := c.headerMAC(statusRequest); mac != "" {
+        request += "|" + mac
+    }
+    lengthBuf := make([]byte, 4)
+    binary.BigEndian.PutUint32(lengthBuf, uint32(len(request)))
+    if _, err := conn.Write(append(lengthBuf, request...)); err != nil {
+        return status, fmt.Errorf("failed to send status request: %w", err)
+    }
+
+    payload, err := readFrame(conn, 64*1024)
+    if err != nil {
+        return status, fmt.Errorf("failed to read status: %w", err)
+    }
+    if string(payload) == authFailed {
+        return status, ErrAuthFailed
+    }
+    if !bytes.HasPrefix(payload, []byte("{")) {
+        return status, fmt.Errorf("%w: %s", ErrStatusUnsupported, payload)
+    }
+    if err := json.Unmarshal(payload, &status); err != nil {
+        return status, fmt.Errorf("invalid status reply: %w", err)
+    }
+    return status, nil
+}
@@ -0,0 +1,148 @@
+package transfer
+
+import (
+    "context"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+)
+
+// streamSize is the header's size for a stream.
+const streamSize = -1
+
+// SendStream sends what write produces as the file name, stored in
+// Options.Dest, without knowing its size up front; the client uses it to
+// send a directory while it is being archived. The data goes as
+// length-prefixed chunks ended by an empty one (see the server's
+// stream.go) and cannot be resumed: every attempt calls write again, so it
+// must produce the same data each time. An error from write fails the
+// transfer without a retry.
+func (c *Client) SendStream(ctx context.Context, name string, write func(w io.Writer) error) error {
+    if c.opts.ChunkSize > MaxFramedChunkSize {
+        return errors.New("streams need a chunk size of at most 64MB")
+    }
+    return c.withRetry(ctx, func() error {
+        return c.sendStream(ctx, name, write)
+    })
+}
+
+func (c *Client) sendStream(ctx context.Context, name string, write func(io.Writer) error) (err error) {
+    sess := c.sess
+    conn, err := sess.get(ctx)
+    if err != nil {
+        return err
+    }
+    // After a failure the stream is out of step with the server.
+    defer func() {
+        if err != nil {
+            sess.drop()
+        }
+    }()
+
+    signed := c.opts.SignKey != nil
+    fields := make([]string, headerFields)
+    fields[fieldVersion] = strconv.Itoa(ProtocolVersion)
+    fields[fieldName] = name
+    fields[fieldSize] = strconv.Itoa(streamSize)
+    fields[fieldResume] = "false"
+    fields[fieldSigned] = strconv.FormatBool(signed)
+    fields[fieldIfMatch] = c.opts.IfMatch
+    fields[fieldReliable] = "false"
+    fields[fieldHashAlgo] = c.opts.HashAlgorithm
+    fields[fieldDest] = c.opts.Dest
+    fields[fieldAuth] = c.headerMAC(strings.Join(fields[:fieldAuth], "|"))
+    info := strings.Join(fields, "|")
+    lengthBuf := make([]byte, 4)
+    binary.BigEndian.PutUint32(lengthBuf, uint32(len(info)))
+    if err := writeFull(conn, append(lengthBuf, info...)); err != nil {
+        return fmt.Errorf("failed to send file info: %w", err)
+    }
+
+    reply, err := readFrame(conn, maxReplyLen)
+    if err != nil {
+        return fmt.Errorf("failed to read resume offset: %w", err)
+    }
+    replyFields := strings.SplitN(string(reply), "|", 3)
+    offset, err := strconv.ParseInt(replyFields[0], 10, 64)
+    if err != nil {
+        return rejectionError(string(reply))
+    }
+    if offset != 0 || len(replyFields) != 3 {
+        return fmt.Errorf("malformed server reply %q", reply)
+    }
+    if storedAs := replyFields[2]; storedAs != "" {
+        c.log.Infof("%s already exists on the server, storing it as %s.\n", name, storedAs)
+    }
+    c.log.Infof("Streaming started.\n")
+
+    // Closing the read end stops write if sending fails.
+    pr, pw := io.Pipe()
+    defer pr.Close()
+    go func() {
+        pw.CloseWithError(write(pw))
+    }()
+
+    hasher := c.newFileHash()
+    progress := newProgressTracker(0, 0, c.opts.Progress, c.opts.ProgressInterval)
+    buf := make([]byte, c.opts.ChunkSize)
+    var sent int64
+    for {
+        n, readErr := io.ReadFull(pr, buf)
+        if n > 0 {
+            c.limiter.Wait(n)
+            if err := sendStreamChunk(conn, buf[:n]); err != nil {
+                return err
+            }
+            release := c.acquireCPU()
+            hasher.Write(buf[:n])
+            release()
+            sent += int64(n)
+            progress.Add(n)
+        }
+        if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+            break
+        }
+        if readErr != nil {
+            return permanent(fmt.Errorf("failed to produce stream: %w", readErr))
+        }
+    }
+    if err := sendStreamChunk(conn, nil); err != nil {
+        return err
+    }
+
+    meta := fileMeta{name: name, size: sent, hash: hex.EncodeToString(hasher.Sum(nil))}
+    if err := writeFull(conn, []byte(meta.hash)); err != nil {
+        return fmt.Errorf("failed to send file hash: %w", err)
+    }
+    if signed {
+        if err := sendSignature(conn, c.opts.SignKey, meta.hash); err != nil {
+            return fmt.Errorf("failed to send signature: %w", err)
+        }
+    }
+
+    result, err := readFrame(conn, maxReplyLen)
+    if err != nil {
+        return fmt.Errorf("failed to read transfer result: %w", err)
+    }
+    progress.Finish()
+    c.log.Infof("Streamed %s (%d bytes, hash %s).\n", name, sent, meta.hash)
+    return c.checkResult(meta, string(result))
+}
+
+// sendStreamChunk sends data with its 4-byte length; an empty chunk ends
+// the stream.
+func sendStreamChunk(conn io.Writer, data []byte) error {
+    lengthBuf := make([]byte, 4)
+    binary.BigEndian.PutUint32(lengthBuf, uint32(len(data)))
+    if err := writeFull(conn, lengthBuf); err != nil {
+        return fmt.Errorf("failed to send data: %w", err)
+    }
+    if err := writeFull(conn, data); err != nil {
+        return fmt.Errorf("failed to send data: %w", err)
+    }
+    return nil
+}
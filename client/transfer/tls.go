@@ -0,0 +1,44 @@
+package transfer
+
+import (
+    "context"
+    "crypto/tls"
+    "net"
+)
+
+// dial opens a connection to the server, through Options.Proxy if one is
+// set and over TLS when Options.TLS is set. TLS runs end to end on top of
+// the proxied connection, so the proxy only sees encrypted data.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+    // Keepalive is set up by setKeepAlive once connected.
+    netDialer := &net.Dialer{KeepAlive: -1}
+    var conn net.Conn
+    var err error
+    if c.opts.Proxy == nil {
+        conn, err = netDialer.DialContext(ctx, "tcp", c.addr)
+    } else {
+        conn, err = dialProxy(ctx, netDialer, c.opts.Proxy, c.addr)
+    }
+    if err != nil {
+        return nil, err
+    }
+    setKeepAlive(conn, c.opts.KeepAlive)
+    if !c.opts.TLS {
+        return conn, nil
+    }
+
+    host, _, err := net.SplitHostPort(c.addr)
+    if err != nil {
+        host = c.addr
+    }
+    tlsConn := tls.Client(conn, &tls.Config{
+        ServerName:         host,
+        InsecureSkipVerify: c.opts.TLSInsecure,
+        MinVersion:         tls.VersionTLS12,
+    })
+    if err := tlsConn.HandshakeContext(ctx); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return tlsConn, nil
+}
@@ -0,0 +1,243 @@
+// Package transfer sends files to and fetches them from an EileCores
+// server. The client command is a thin wrapper around it; other programs
+// can use it to transfer files without running the command:
+//
+//    err := transfer.SendFile(ctx, "backup.example.com:59999", "db.dump", transfer.Options{
+//        Token:    secret,
+//        Progress: func(p transfer.Progress) { log.Printf("%d/%d", p.Sent, p.Total) },
+//    })
+package transfer
+
+import (
+    "context"
+    "crypto/ed25519"
+    "errors"
+    "fmt"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Defaults for the zero values of Options.
+const (
+    DefaultChunkSize        = 4 * 1024 * 1024
+    DefaultRetries          = 5
+    DefaultRetryBase        = 1 * time.Second
+    DefaultRetryMaxInterval = 30 * time.Second
+    DefaultKeepAlive        = 15 * time.Second
+)
+
+// Options configure a Client. The zero value sends over plain TCP, hashes
+// with SHA-256 and retries a failed transfer up to DefaultRetries times.
+type Options struct {
+    // Token is the server's -token, used to authenticate every header.
+    Token string
+    // HashAlgorithm names the file hash, see HashAlgorithms. Empty means
+    // DefaultHashAlgorithm.
+    HashAlgorithm string
+    // ChunkSize is how much of a file is read and sent at a time. 0 means
+    // DefaultChunkSize; Reliable, Compress, Sparse and streams allow at
+    // most 64MB.
+    ChunkSize int
+    // Dest is the subdirectory of the server's storage directory files are
+    // stored in by Send. Empty stores them at its root.
+    Dest string
+    // IfMatch, when set, has the server accept an upload only if the file
+    // it already stores has this hash.
+    IfMatch string
+    // PreserveTimes asks the server to give stored files their source's
+    // modification time.
+    PreserveTimes bool
+
+    // Reliable sends every chunk with a CRC32 and waits for the server to
+    // acknowledge it, resending corrupted chunks.
+    Reliable bool
+    // Compress deflates the data in transit.
+    Compress bool
+    // Sparse skips runs of zeros, which the server stores as holes.
+    Sparse bool
+    // SmartResume resumes from the first block that differs when the
+    // server's partial data does not match, instead of starting over.
+    SmartResume bool
+    // Parallel splits each file into this many ranges sent over
+    // connections of their own. 0 and 1 use one connection.
+    Parallel int
+    // RateLimit caps the upload speed in bytes per second, shared by the
+    // connections of a parallel transfer. 0 means unlimited.
+    RateLimit int64
+    // CPUs bounds how many goroutines hash or compress at once, such as
+    // the connections of a parallel transfer checking their resumed data
+    // or deflating their chunks. Those wait for a turn while the data
+    // already prepared keeps flowing. 0 means no limit.
+    CPUs int
+
+    // SignKey, when set, signs the hash of every upload.
+    SignKey ed25519.PrivateKey
+    // Verify fails a transfer unless the server reports it stored the file
+    // with the same hash. Without it a mismatch is only logged.
+    Verify bool
+    // RemoveSource deletes each file once the server verified it. It
+    // implies Verify.
+    RemoveSource bool
+
+    // TLS connects over TLS; TLSInsecure skips certificate verification.
+    TLS         bool
+    TLSInsecure bool
+    // Proxy is a socks5://, socks5h:// or http:// proxy to connect
+    // through, see ParseProxy. nil dials the server directly.
+    Proxy *url.URL
+    // KeepAlive is the TCP keepalive period. 0 means DefaultKeepAlive, a
+    // negative value turns keepalive off.
+    KeepAlive time.Duration
+
+    // Retries is how many attempts a transfer gets. 0 means
+    // DefaultRetries.
+    Retries int
+    // RetryBase and RetryMax bound the wait between attempts, which
+    // doubles from RetryBase up to RetryMax. 0 means the defaults, a
+    // negative value no wait.
+    RetryBase time.Duration
+    RetryMax  time.Duration
+    // Interrupted, when set, is asked after every failed attempt; if it
+    // returns true the transfer is given up instead of retried, and can be
+    // resumed later.
+    Interrupted func() bool
+
+    // Progress, when set, is called with how far a file being sent or
+    // received has got: at most once per ProgressInterval while data
+    // flows, and once more with Done set when it is complete. It runs in
+    // the goroutine doing the transfer, and holds it up, but is never
+    // called concurrently, not even by the connections of a parallel
+    // transfer.
+    Progress func(Progress)
+    // ProgressInterval is the least time between two Progress calls. 0
+    // means DefaultProgressInterval.
+    ProgressInterval time.Duration
+    // Logger receives messages about what the client is doing. nil
+    // discards them.
+    Logger Logger
+}
+
+// Logger receives the client's messages. Formats end in a newline.
+type Logger interface {
+    // Warnf reports problems that do not fail the transfer by themselves,
+    // such as an attempt that is about to be retried.
+    Warnf(format string, args ...interface{})
+    // Infof reports routine progress, such as a connection being made.
+    Infof(format string, args ...interface{})
+    // Debugf reports details such as the server's replies.
+    Debugf(format string, args ...interface{})
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Warnf(string, ...interface{})  {}
+func (discardLogger) Infof(string, ...interface{})  {}
+func (discardLogger) Debugf(string, ...interface{}) {}
+
+// Client transfers files to one server. It sends one file at a time and
+// keeps its connection open between them; a parallel transfer opens more.
+// Close closes the connection.
+type Client struct {
+    addr    string
+    opts    Options
+    log     Logger
+    limiter *tokenBucket
+    sess    *session
+    // cpuSlots holds a token for every goroutine hashing or compressing,
+    // see acquireCPU. nil without Options.CPUs.
+    cpuSlots chan struct{}
+
+    // distrustedPrefixes records ranges whose partial data on the server
+    // failed checkPrefix; their next attempt asks the server to start over.
+    distrustedPrefixes sync.Map // prefixKey -> struct{}
+    // resumeLimits records, for ranges whose prefix check failed under
+    // SmartResume, the offset their next attempt may resume from at most.
+    resumeLimits sync.Map // prefixKey -> int64
+}
+
+// NewClient checks opts and returns a client for the server at addr
+// (host:port). No connection is made until the first transfer.
+func NewClient(addr string, opts Options) (*Client, error) {
+    if opts.HashAlgorithm == "" {
+        opts.HashAlgorithm = DefaultHashAlgorithm
+    }
+    if _, ok := hashAlgorithms[opts.HashAlgorithm]; !ok {
+        return nil, fmt.Errorf("unsupported hash algorithm %q, use one of %s", opts.HashAlgorithm, strings.Join(HashAlgorithms(), ", "))
+    }
+    if opts.ChunkSize == 0 {
+        opts.ChunkSize = DefaultChunkSize
+    }
+    if opts.ChunkSize < 0 {
+        return nil, fmt.Errorf("invalid chunk size %d", opts.ChunkSize)
+    }
+    if (opts.Reliable || opts.Compress || opts.Sparse) && opts.ChunkSize > MaxFramedChunkSize {
+        return nil, errors.New("Reliable, Compress and Sparse need a chunk size of at most 64MB")
+    }
+    if opts.Compress && opts.Reliable || opts.Sparse && (opts.Reliable || opts.Compress) {
+        return nil, errors.New("only one of Reliable, Compress and Sparse can be set")
+    }
+    if opts.Parallel < 1 {
+        opts.Parallel = 1
+    }
+    if opts.CPUs < 0 {
+        return nil, fmt.Errorf("invalid CPU limit %d", opts.CPUs)
+    }
+    if opts.KeepAlive == 0 {
+        opts.KeepAlive = DefaultKeepAlive
+    }
+    if opts.Retries <= 0 {
+        opts.Retries = DefaultRetries
+    }
+    if opts.RetryBase == 0 {
+        opts.RetryBase = DefaultRetryBase
+    }
+    if opts.RetryMax == 0 {
+        opts.RetryMax = DefaultRetryMaxInterval
+    }
+    if opts.RemoveSource {
+        opts.Verify = true
+    }
+    if opts.ProgressInterval <= 0 {
+        opts.ProgressInterval = DefaultProgressInterval
+    }
+    c := &Client{addr: addr, opts: opts, log: opts.Logger, limiter: newTokenBucket(float64(opts.RateLimit))}
+    if c.log == nil {
+        c.log = discardLogger{}
+    }
+    if opts.CPUs > 0 {
+        c.cpuSlots = make(chan struct{}, opts.CPUs)
+    }
+    c.sess = c.newSession()
+    return c, nil
+}
+
+// Close closes the client's connection, if one is open.
+func (c *Client) Close() error {
+    c.sess.drop()
+    return nil
+}
+
+// SendFile sends the file at path to the server at addr with a new Client.
+func SendFile(ctx context.Context, addr, path string, opts Options) error {
+    c, err := NewClient(addr, opts)
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+    return c.Send(ctx, path)
+}
+
+// Scheme describes how the client reaches the server, such as
+// "tls via socks5://127.0.0.1:1080".
+func (c *Client) Scheme() string {
+    scheme := "tcp"
+    if c.opts.TLS {
+        scheme = "tls"
+    }
+    if c.opts.Proxy != nil {
+        scheme += " via " + proxyName(c.opts.Proxy)
+    }
+    return scheme
+}
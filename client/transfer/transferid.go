@@ -0,0 +1,124 @@
+package transfer
+
+import (
+    "crypto/rand"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+)
+
+// Each upload carries a transfer ID, a random UUID kept in the user cache
+// directory for as long as the upload is unfinished. It is looked up by the
+// file's content rather than its path, so re-running the command after
+// renaming or moving the file sends the same ID, and the server resumes
+// from the partial data it stored under the old name.
+
+var (
+    transferIDs       map[string]string // content key -> UUID
+    transferIDsMu     sync.Mutex
+    transferIDsLoaded bool
+)
+
+// transferIDsPath is where the IDs are kept between runs, or "" if there is
+// no user cache directory.
+func transferIDsPath() string {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+        return ""
+    }
+    return filepath.Join(dir, "eilecores", "transfers.json")
+}
+
+func transferIDKey(algorithm string, meta fileMeta) string {
+    return algorithm + ":" + meta.hash + ":" + strconv.FormatInt(meta.size, 10)
+}
+
+// transferIDFor returns the ID of the upload of meta's content, hashed with
+// algorithm, creating and saving one the first time.
+func transferIDFor(algorithm string, meta fileMeta) (string, error) {
+    transferIDsMu.Lock()
+    defer transferIDsMu.Unlock()
+    if !transferIDsLoaded {
+        loadTransferIDs()
+    }
+    key := transferIDKey(algorithm, meta)
+    if id, ok := transferIDs[key]; ok {
+        return id, nil
+    }
+    id, err := newUUID()
+    if err != nil {
+        return "", err
+    }
+    transferIDs[key] = id
+    saveTransferIDs()
+    return id, nil
+}
+
+// forgetTransferID drops the ID of meta's content once it was uploaded, so
+// sending the same content again later starts a new transfer.
+func forgetTransferID(algorithm string, meta fileMeta) {
+    transferIDsMu.Lock()
+    defer transferIDsMu.Unlock()
+    if !transferIDsLoaded {
+        loadTransferIDs()
+    }
+    key := transferIDKey(algorithm, meta)
+    if _, ok := transferIDs[key]; ok {
+        delete(transferIDs, key)
+        saveTransferIDs()
+    }
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+    var b [16]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return "", fmt.Errorf("failed to create transfer ID: %w", err)
+    }
+    b[6] = b[6]&0x0f | 0x40
+    b[8] = b[8]&0x3f | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// loadTransferIDs must be called with transferIDsMu held. A missing or
+// corrupt file just starts empty.
+func loadTransferIDs() {
+    transferIDsLoaded = true
+    transferIDs = make(map[string]string)
+    path := transferIDsPath()
+    if path == "" {
+        return
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return
+    }
+    if err := json.Unmarshal(data, &transferIDs); err != nil {
+        transferIDs = make(map[string]string)
+    }
+}
+
+// saveTransferIDs must be called with transferIDsMu held. Failing to save
+// only means a later run cannot follow a renamed file, so errors are
+// ignored.
+func saveTransferIDs() {
+    path := transferIDsPath()
+    if path == "" {
+        return
+    }
+    data, err := json.Marshal(transferIDs)
+    if err != nil {
+        return
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return
+    }
+    os.Rename(tmp, path)
+}
@@ -0,0 +1,53 @@
+package transfer
+
+import (
+    "fmt"
+    "os"
+    "strings"
+)
+
+// Server statuses sent in the transfer result.
+const (
+    statusComplete  = "传输完成"
+    statusRangeDone = "分段完成" // a parallel range, the file is not complete yet
+)
+
+// checkResult looks at the server's "status|hash" result for a transfer of
+// meta. Without Options.Verify a problem is only logged, except a version
+// conflict: the server kept its own file instead of the upload.
+func (c *Client) checkResult(meta fileMeta, result string) error {
+    status, serverHash, _ := strings.Cut(result, "|")
+    if status == statusRangeDone || status == statusComplete && strings.EqualFold(serverHash, meta.hash) {
+        return nil
+    }
+    if status == versionConflict {
+        return ErrVersionConflict
+    }
+    err := fmt.Errorf("server reported %s (server hash %q, local hash %s)", status, serverHash, meta.hash)
+    if !c.opts.Verify {
+        c.log.Warnf("Warning: %v\n", err)
+        return nil
+    }
+    return permanent(err)
+}
+
+// removeSentFile deletes filePath after a verified upload of meta when
+// Options.RemoveSource is set, unless it changed after it was hashed: what
+// the server stored would then not be what gets deleted.
+func (c *Client) removeSentFile(filePath string, meta fileMeta) error {
+    if !c.opts.RemoveSource {
+        return nil
+    }
+    info, err := os.Stat(filePath)
+    if err != nil {
+        return permanent(fmt.Errorf("failed to check %s before removing it: %w", filePath, err))
+    }
+    if info.Size() != meta.size || !info.ModTime().Equal(meta.modTime) {
+        return permanent(fmt.Errorf("%s changed while it was being sent, not removing it", filePath))
+    }
+    if err := os.Remove(filePath); err != nil {
+        return permanent(fmt.Errorf("failed to remove %s: %w", filePath, err))
+    }
+    c.log.Infof("Removed %s.\n", filePath)
+    return nil
+}
@@ -0,0 +1,92 @@
+package transfer
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// verifyRequest starts a header asking the server to hash a stored file and
+// compare it with ours, without sending any data.
+const verifyRequest = "VERIFY"
+
+// Verify header fields, in wire order.
+const (
+    vfFieldType     = iota // verifyRequest
+    vfFieldVersion         // ProtocolVersion
+    vfFieldName
+    vfFieldDest     // as fieldDest
+    vfFieldHashAlgo // as fieldHashAlgo
+    vfFieldHash     // our hash of the file
+    vfFieldAuth     // HMAC of the fields before it, see Options.Token
+    verifyFields
+)
+
+// Results of a verify request.
+const (
+    verifyMatch    = "match"
+    verifyMismatch = "mismatch"
+)
+
+// ErrStoredMismatch is returned by VerifyStored when the server's copy
+// differs from the local file.
+var ErrStoredMismatch = errors.New("stored file does not match")
+
+// VerifyStored has the server hash its copy of the file at filePath, stored
+// in the server directory dest, and compare it with the local file's hash,
+// which it returns. No file data is sent.
+func (c *Client) VerifyStored(ctx context.Context, filePath, dest string) (string, error) {
+    meta, err := c.statFileMeta(filePath, dest)
+    if err != nil {
+        return "", err
+    }
+    err = c.withRetry(ctx, func() error {
+        return c.verifyStored(ctx, meta)
+    })
+    return meta.hash, err
+}
+
+func (c *Client) verifyStored(ctx context.Context, meta fileMeta) (err error) {
+    sess := c.sess
+    conn, err := sess.get(ctx)
+    if err != nil {
+        return err
+    }
+    // After a failure the stream is out of step with the server.
+    defer func() {
+        if err != nil && !errors.Is(err, ErrStoredMismatch) {
+            sess.drop()
+        }
+    }()
+
+    fields := make([]string, verifyFields)
+    fields[vfFieldType] = verifyRequest
+    fields[vfFieldVersion] = strconv.Itoa(ProtocolVersion)
+    fields[vfFieldName] = meta.name
+    fields[vfFieldDest] = meta.dest
+    fields[vfFieldHashAlgo] = c.opts.HashAlgorithm
+    fields[vfFieldHash] = meta.hash
+    fields[vfFieldAuth] = c.headerMAC(strings.Join(fields[:vfFieldAuth], "|"))
+    request := strings.Join(fields, "|")
+    lengthBuf := make([]byte, 4)
+    binary.BigEndian.PutUint32(lengthBuf, uint32(len(request)))
+    if err := writeFull(conn, append(lengthBuf, request...)); err != nil {
+        return fmt.Errorf("failed to send verify request: %w", err)
+    }
+
+    reply, err := readFrame(conn, maxReplyLen)
+    if err != nil {
+        return fmt.Errorf("failed to read verify result: %w", err)
+    }
+    replyFields := strings.Split(string(reply), "|")
+    switch {
+    case len(replyFields) == 3 && replyFields[0] == verifyMatch:
+        return nil
+    case len(replyFields) == 3 && replyFields[0] == verifyMismatch:
+        return permanent(fmt.Errorf("%w: server has %s (%s bytes), local %s", ErrStoredMismatch, replyFields[1], replyFields[2], meta.hash))
+    }
+    return rejectionError(string(reply))
+}
@@ -0,0 +1,43 @@
+package main
+
+import "fmt"
+
+var (
+    // quiet (-quiet) keeps only errors and warnings, for cron jobs and
+    // scripts that check the exit status.
+    quiet bool
+    // verbose (-verbose) adds connection details, server replies and a
+    // progress line every second.
+    verbose bool
+)
+
+// infof prints routine messages about what the client is doing. -quiet
+// suppresses them.
+func infof(format string, args ...interface{}) {
+    if !quiet {
+        fmt.Printf(format, args...)
+    }
+}
+
+// debugf prints details only shown with -verbose.
+func debugf(format string, args ...interface{}) {
+    if verbose {
+        fmt.Printf(format, args...)
+    }
+}
+
+// consoleLogger prints the transfer package's messages as the client's own,
+// so -quiet and -verbose apply to them too.
+type consoleLogger struct{}
+
+func (consoleLogger) Warnf(format string, args ...interface{}) {
+    fmt.Printf(format, args...)
+}
+
+func (consoleLogger) Infof(format string, args ...interface{}) {
+    infof(format, args...)
+}
+
+func (consoleLogger) Debugf(format string, args ...interface{}) {
+    debugf(format, args...)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+    "context"
+    "fmt"
+
+    "wenPlus/transfer"
+)
+
+// verifyStoredFiles asks the server to check each of files against the
+// copy it stores, without sending any data (-verify-only), and returns how
+// many did not match or could not be checked.
+func verifyStoredFiles(ctx context.Context, client *transfer.Client, files []string) int {
+    failed := 0
+    for _, path := range files {
+        hash, err := client.VerifyStored(ctx, path, fileDest(path))
+        if err != nil {
+            fmt.Printf("FAILED   %s: %v\n", path, err)
+            failed++
+            continue
+        }
+        fmt.Printf("OK       %s (%s %s)\n", path, opts.HashAlgorithm, hash)
+    }
+    fmt.Printf("Verified %d file(s), %d failed.\n", len(files), failed)
+    return failed
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"wenPlus/transfer"
+)
+
+// Capabilities describes what this binary supports so operators can check
+// client/server compatibility before starting a transfer. The field names and
+// the text layout are consumed by tooling, so only ever append to them.
+// Compression lists the codecs of data on the wire, as the client's does.
+// ArchiveFormats stays empty: the server stores archives as any other file.
+type Capabilities struct {
+	Binary           string   `json:"binary"`
+	HashAlgorithms   []string `json:"hash_algorithms"`
+	Compression      []string `json:"compression"`
+	ProtocolVersions []int    `json:"protocol_versions"`
+	Features         []string `json:"features"`
+	ArchiveFormats   []string `json:"archive_formats,omitempty"`
+}
+
+func serverCapabilities() Capabilities {
+	return Capabilities{
+		Binary:           "server",
+		HashAlgorithms:   transfer.HashAlgorithms(),
+		Compression:      []string{"deflate"},
+		ProtocolVersions: []int{transfer.ProtocolVersion},
+		Features:         []string{"compress", "dest", "download", "events", "hardlinks", "list", "reliable", "resume", "smart-resume", "s3-backend", "signature", "sparse", "stream", "tls", "verify-only"},
+	}
+}
+
+// printCapabilities writes caps to w, either as a single JSON object or as
+// one "key: v1,v2" line per field.
+func printCapabilities(w io.Writer, caps Capabilities, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		return enc.Encode(caps)
+	}
+
+	versions := make([]string, len(caps.ProtocolVersions))
+	for i, v := range caps.ProtocolVersions {
+		versions[i] = strconv.Itoa(v)
+	}
+	_, err := fmt.Fprintf(w, "binary: %s\nhash_algorithms: %s\ncompression: %s\nprotocol_versions: %s\nfeatures: %s\n",
+		caps.Binary,
+		strings.Join(caps.HashAlgorithms, ","),
+		strings.Join(caps.Compression, ","),
+		strings.Join(versions, ","),
+		strings.Join(caps.Features, ","))
+	if err == nil && len(caps.ArchiveFormats) > 0 {
+		_, err = fmt.Fprintf(w, "archive_formats: %s\n", strings.Join(caps.ArchiveFormats, ","))
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// minStatusRows is how many rows the status area needs before the banner is
+// dropped on small terminals.
+const minStatusRows = 4
+
+// listeningMsg is repeated when the banner is redrawn after a resize.
+var listeningMsg string
+
+// refreshInterval is how often the dashboard is redrawn (-refresh).
+var refreshInterval = 500 * time.Millisecond
+
+// stdoutIsTerminal reports whether stdout can take cursor movement and
+// colors, as opposed to a pipe, a file or the systemd journal.
+func stdoutIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// renderFrame builds one redraw of the status area from row start. Each line
+// overwrites the previous frame's in place and then clears the rest of its
+// row, so the area is never blank in between; written at once, the terminal
+// shows either the old frame or the new one.
+func renderFrame(start int, lines []string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s%d;1H", esc, start)
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString(esc + "K\n")
+	}
+	// Rows the previous frame used beyond this one.
+	b.WriteString(esc + "J")
+	return b.Bytes()
+}
+
+// runeWidth approximates how many terminal columns r occupies: East Asian
+// wide characters (such as the Chinese status words) take two.
+func runeWidth(r rune) int {
+	switch {
+	case r >= 0x1100 && r <= 0x115f,
+		r >= 0x2e80 && r <= 0xa4cf,
+		r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff,
+		r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6:
+		return 2
+	}
+	return 1
+}
+
+func displayWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+// truncateLine cuts s so that it fits in width columns, marking the cut with
+// "…". A width <= 0 means unknown and leaves s alone.
+func truncateLine(s string, width int) string {
+	if width <= 0 || displayWidth(s) <= width {
+		return s
+	}
+	var b strings.Builder
+	used := 0
+	for _, r := range s {
+		w := runeWidth(r)
+		if used+w > width-1 {
+			break
+		}
+		b.WriteRune(r)
+		used += w
+	}
+	b.WriteString("…")
+	return b.String()
+}
+
+// fitToTerminal truncates lines to width and keeps at most rows of them,
+// summarising the rest. rows <= 0 means unlimited.
+func fitToTerminal(lines []string, width, rows int) []string {
+	if rows > 0 && len(lines) > rows {
+		hidden := len(lines) - rows + 1
+		lines = append(lines[:rows-1:rows-1], fmt.Sprintf("... and %d more", hidden))
+	}
+	fitted := make([]string, len(lines))
+	for i, line := range lines {
+		fitted[i] = truncateLine(line, width)
+	}
+	return fitted
+}
+
+// wrappedRows is how many terminal rows s takes once wrapped at width.
+func wrappedRows(s string, width int) int {
+	w := displayWidth(s)
+	if width <= 0 || w <= width {
+		return 1
+	}
+	return (w + width - 1) / width
+}
+
+// bannerRows is the height of the banner, welcome line, spacer and listening
+// message at the given width.
+func bannerRows(width int) int {
+	rows := 0
+	for _, line := range strings.Split(strings.TrimSuffix(asciiArt, "\n"), "\n") {
+		rows += wrappedRows(line, width)
+	}
+	rows += wrappedRows(welcomeMsg, width) + 1
+	rows += wrappedRows(listeningMsg, width)
+	return rows
+}
+
+// drawHeader clears the screen, draws the banner if it fits and returns the
+// row where the status area starts.
+func drawHeader(width, height int) int {
+	clearScreen()
+	moveCursor(1, 1)
+
+	rows := bannerRows(width)
+	if height > 0 && rows+minStatusRows > height {
+		return 1
+	}
+	displayBanner()
+	fmt.Println()
+	fmt.Println(truncateLine(listeningMsg, width))
+	return rows + 1
+}
+
+// statusRows is how many rows are free below start without scrolling, or 0
+// when the height is unknown.
+func statusRows(start, height int) int {
+	if height <= 0 {
+		return 0
+	}
+	if rows := height - start; rows > 1 {
+		return rows
+	}
+	return 1
+}
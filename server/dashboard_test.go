@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTruncateLine(t *testing.T) {
+	tests := []struct {
+		in    string
+		width int
+		want  string
+	}{
+		{"hello world", 0, "hello world"},
+		{"hello world", 11, "hello world"},
+		{"hello world", 8, "hello w…"},
+		{"hello world", 1, "…"},
+		// The status words take two columns per character.
+		{"状态: 传输中", 12, "状态: 传输中"},
+		{"状态: 传输中", 11, "状态: 传输…"},
+		{"状态: 传输中", 10, "状态: 传…"},
+		{"状态: 传输中", 7, "状态: …"},
+	}
+	for _, tt := range tests {
+		got := truncateLine(tt.in, tt.width)
+		if got != tt.want {
+			t.Errorf("truncateLine(%q, %d) = %q, want %q", tt.in, tt.width, got, tt.want)
+		}
+		if tt.width > 0 && displayWidth(got) > tt.width {
+			t.Errorf("truncateLine(%q, %d) is %d columns wide", tt.in, tt.width, displayWidth(got))
+		}
+	}
+}
+
+func TestFitToTerminal(t *testing.T) {
+	lines := make([]string, 6)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("transfer %d of six", i+1)
+	}
+	tests := []struct {
+		name        string
+		width, rows int
+		want        []string
+	}{
+		{"unlimited", 0, 0, lines},
+		{"room for all", 0, 6, lines},
+		{"rows cut", 0, 3, []string{lines[0], lines[1], "... and 4 more"}},
+		{"one row", 0, 1, []string{"... and 6 more"}},
+		{"narrow", 12, 2, []string{"transfer 1 …", "... and 5 m…"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fitToTerminal(lines, tt.width, tt.rows)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fitToTerminal(%d, %d) = %q, want %q", tt.width, tt.rows, got, tt.want)
+			}
+		})
+	}
+	if lines[2] != "transfer 3 of six" {
+		t.Errorf("fitToTerminal changed its input: %q", lines)
+	}
+}
+
+// TestLayoutOnResize follows the layout math through a terminal that is
+// resized: wrapped rows, the banner's height and the rows left for the
+// status area.
+func TestLayoutOnResize(t *testing.T) {
+	if got := wrappedRows(strings.Repeat("x", 100), 40); got != 3 {
+		t.Errorf("100 columns at width 40 wrap to %d rows, want 3", got)
+	}
+	if got := wrappedRows("传输中", 4); got != 2 {
+		t.Errorf("6 columns at width 4 wrap to %d rows, want 2", got)
+	}
+	if got := wrappedRows("anything", 0); got != 1 {
+		t.Errorf("unknown width wraps to %d rows, want 1", got)
+	}
+
+	listeningMsg = strings.Repeat("l", 60)
+	t.Cleanup(func() { listeningMsg = "" })
+	wide, narrow := bannerRows(200), bannerRows(20)
+	if narrow <= wide {
+		t.Errorf("banner takes %d rows at width 20 and %d at 200, want more when narrow", narrow, wide)
+	}
+
+	tests := []struct {
+		start, height, want int
+	}{
+		{10, 0, 0}, // unknown height: unlimited
+		{10, 30, 20},
+		{10, 11, 1}, // shrunk below the banner: one row
+		{1, 5, 4},   // banner dropped
+	}
+	for _, tt := range tests {
+		if got := statusRows(tt.start, tt.height); got != tt.want {
+			t.Errorf("statusRows(%d, %d) = %d, want %d", tt.start, tt.height, got, tt.want)
+		}
+	}
+}
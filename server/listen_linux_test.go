@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestListenWithBacklog checks that -backlog sets the accept queue: with
+// nobody accepting, the kernel completes backlog+1 handshakes and lets
+// further connection attempts wait.
+func TestListenWithBacklog(t *testing.T) {
+	for _, backlog := range []int{2, 5} {
+		t.Run(fmt.Sprint(backlog), func(t *testing.T) {
+			listener, err := listenWithBacklog("tcp", "127.0.0.1:0", backlog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			queued := 0
+			for ; queued < backlog+10; queued++ {
+				conn, err := net.DialTimeout("tcp", listener.Addr().String(), 200*time.Millisecond)
+				if err != nil {
+					break
+				}
+				defer conn.Close()
+			}
+			if queued != backlog+1 {
+				t.Errorf("%d connections queued, want %d", queued, backlog+1)
+			}
+		})
+	}
+}
+
+// BenchmarkAcceptBurst measures how fast bursts of short connections are
+// accepted, with the system's default queue and with -backlog set.
+func BenchmarkAcceptBurst(b *testing.B) {
+	const burst = 200
+	for _, backlog := range []int{0, 16, 1024} {
+		b.Run(fmt.Sprintf("backlog=%d", backlog), func(b *testing.B) {
+			listener, err := listenWithBacklog("tcp", "127.0.0.1:0", backlog)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < burst; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						conn, err := net.Dial("tcp", listener.Addr().String())
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						conn.Close()
+					}()
+				}
+				wg.Wait()
+			}
+			b.ReportMetric(float64(b.N*burst)/b.Elapsed().Seconds(), "conns/s")
+		})
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+
+	"wenPlus/transfer"
+)
+
+// listenWithBacklog ignores backlog on platforms where the net package gives
+// no way to set it; the system default is used instead.
+func listenWithBacklog(network, address string, backlog int) (net.Listener, error) {
+	if backlog > 0 {
+		transfer.LogWarn("-backlog is not supported on this platform, using the system default")
+	}
+	return net.Listen(network, address)
+}
@@ -2,53 +2,24 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
-	"encoding/hex"
+	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
-	"path/filepath"
-	"strconv"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fatih/color"
+	"wenPlus/transfer"
 )
 
-const ChunkSize = 4 * 1024 * 1024 // 3MB
-
-var (
-	// 使用 sync.Map 来安全地在多个 goroutine 中存储和访问文件的偏移量
-	fileState             sync.Map
-	storageDir            = "./uploads"
-	activeConnections     int64
-	totalBytesTransferred int64
-	serverStartTime       time.Time
-	mu                    sync.Mutex
-	clients               = make(map[string]*Client)
-	clientsMu             sync.Mutex
-	completedClients      []*Client
-	completedClientsMu    sync.Mutex
-)
-
-// Client struct to track each client's transfer status
-type Client struct {
-	ID             string
-	IP             string
-	FileName       string
-	FileSize       int64
-	Received       int64
-	Status         string
-	Speed          float64
-	StartTime      time.Time
-	CalculatedHash string
-}
-
 // ASCII Art
 const asciiArt = `
   ______ _ _        _____                     
@@ -63,263 +34,302 @@ const asciiArt = `
 `
 
 func main() {
+	var opts transfer.Options
 	port := flag.String("port", "59999", "Port to listen on")
+	flag.StringVar(&opts.Manifest, "manifest", "", "Append a JSON record of every finished transfer (name, size, hash, client, times, status) to this file")
+	flag.StringVar(&opts.Webhook, "webhook", "", "URL to POST a JSON summary to whenever a transfer completes or fails")
+	bind := flag.String("bind", "", "Address or host name to listen on; empty listens on all IPv4 and IPv6 addresses")
+	flag.StringVar(&opts.Dir, "dir", transfer.DefaultDir, "Directory to store received files in, created if missing; a comma-separated list spreads files over several directories (see -shard-policy), the first also holds the server's state files")
+	flag.StringVar(&opts.ShardPolicy, "shard-policy", "least-full", "How a new file picks one of several -dir directories: least-full (most free space) or round-robin; directories without room for the file are skipped")
+	showCaps := flag.Bool("capabilities", false, "Print supported algorithms and features, then exit")
+	capsJSON := flag.Bool("json", false, "Print -capabilities output as JSON")
+	globalRate := flag.String("global-rate", "", "Total receive bandwidth shared fairly by all transfers, e.g. 50MB (per second)")
+	maxRate := flag.String("maxrate", "", "Receive bandwidth limit per transfer, e.g. 10MB (per second)")
+	flag.StringVar(&opts.TransferLogs, "transfer-logs", "", "Directory for per-transfer log files (disabled if empty)")
+	flag.DurationVar(&opts.TransferLogsMaxAge, "transfer-logs-max-age", transfer.DefaultTransferLogsAge, "Delete per-transfer logs older than this")
+	flag.IntVar(&opts.TransferLogsMaxCount, "transfer-logs-max-count", transfer.DefaultTransferLogs, "Maximum number of per-transfer logs to keep")
+	showLog := flag.String("show-log", "", "Print the log of the given transfer ID from -transfer-logs, then exit")
+	listIncomplete := flag.Bool("list-incomplete", false, "Print the uploads that can be resumed from the saved state of -dir, with how much of each arrived and when, then exit")
+	backlog := flag.Int("backlog", 0, "Listen backlog (accept queue length), 0 uses the system default")
+	flag.IntVar(&opts.AcceptWorkers, "accept-workers", 1, "Number of goroutines accepting connections")
+	pubKeyPath := flag.String("pubkey", "", "PEM ed25519 public key used to verify detached signatures")
+	flag.BoolVar(&opts.RequireSignature, "require-signature", false, "Reject transfers that are not signed (needs -pubkey)")
+	flag.IntVar(&opts.MaxConn, "maxconn", 0, "Maximum concurrent connections; further clients are told \"server busy\", 0 disables the limit")
+	flag.DurationVar(&refreshInterval, "refresh", refreshInterval, "How often the status screen is redrawn")
+	flag.DurationVar(&opts.ProgressInterval, "progress-interval", transfer.DefaultProgressInterval, "Least time between two progress events of one transfer on -events-socket")
+	flag.DurationVar(&opts.SpeedWindow, "speed-window", transfer.DefaultSpeedWindow, "Time over which the displayed transfer speeds are averaged; longer is steadier, shorter reacts faster")
+	flag.IntVar(&opts.History, "history", transfer.DefaultHistory, "Number of finished transfers kept for the status screen and /stats; older ones are only in server.log and -manifest")
+	flag.DurationVar(&opts.KeepAlive, "keepalive", transfer.DefaultKeepAlive, "Send TCP keepalive probes after this much silence, so clients that vanished are disconnected and their transfers marked 传输中断 (0 disables)")
+	flag.DurationVar(&drainTimeout, "drain-timeout", drainTimeout, "On SIGINT or SIGTERM, stop accepting connections and wait this long for transfers in progress to finish before exiting")
+	flag.DurationVar(&opts.IdleTimeout, "idle-timeout", transfer.DefaultIdleTimeout, "Disconnect a client that sends nothing for this long, marking its transfer 超时 (0 waits forever)")
+	flag.Float64Var(&opts.PerIPConnRate, "per-ip-conn-rate", 0, "Maximum new connections per second from a single IP, 0 disables the limit")
+	flag.BoolVar(&opts.Preallocate, "preallocate", false, "Reserve disk space for the whole file before receiving it")
+	eventsTarget := flag.String("events-socket", "", "Emit JSON-lines transfer events to this Unix socket, or to stdout if \"-\" (disables the dashboard)")
+	flag.BoolVar(&opts.CaseInsensitive, "case-insensitive", false, "Treat file names differing only by case as the same file (auto-detected for local storage)")
+	flag.StringVar(&opts.Backend, "backend", "", "Storage backend, e.g. s3://bucket/prefix (default: local storage directory)")
+	flag.StringVar(&opts.S3Endpoint, "s3-endpoint", os.Getenv("AWS_ENDPOINT_URL"), "S3-compatible endpoint URL (default: AWS, or $AWS_ENDPOINT_URL)")
+	flag.StringVar(&opts.S3Region, "s3-region", os.Getenv("AWS_REGION"), "S3 region (default: $AWS_REGION or us-east-1)")
+	useTLS := flag.Bool("tls", false, "Accept TLS connections only (needs -cert and -key)")
+	certFile := flag.String("cert", "", "PEM certificate for -tls")
+	keyFile := flag.String("key", "", "PEM private key for -tls")
+	httpAddr := flag.String("http", "", "Serve JSON statistics at /stats on this address, e.g. :8080 (disabled if empty)")
+	flag.StringVar(&opts.Overwrite, "overwrite", "always", "When the uploaded file already exists: always (replace it), never (refuse the upload) or rename (store it as name(1).ext)")
+	maxSize := flag.String("maxsize", "", "Refuse files larger than this, e.g. 10GB")
+	flag.IntVar(&opts.MaxNameLength, "max-name", transfer.DefaultMaxNameLength, "Refuse file and directory names longer than this many bytes")
+	quota := flag.String("quota", "", "Refuse transfers that would grow the storage directory beyond this, e.g. 500GB")
+	flag.StringVar(&opts.Token, "token", "", "Shared secret; clients must authenticate each header with an HMAC keyed with it")
+	chunk := flag.String("chunk", "", "Receive buffer size per connection, e.g. 1MB or 8MB (default 4MB)")
+	logMax := flag.String("logmax", "100MB", "Rotate server.log once it reaches this size, e.g. 50MB (0 never rotates)")
+	logKeep := flag.Int("logkeep", 5, "Number of rotated logs to keep as server.log.1, server.log.2, ...")
+	flag.StringVar(&opts.LogLevel, "loglevel", "info", "Lowest level written to server.log: debug, info, warn or error")
 	flag.Parse()
 
-	// Configure logging
-	logFile, err := os.OpenFile("server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		fmt.Println("Failed to open log file:", err)
+	if *showCaps {
+		if err := printCapabilities(os.Stdout, serverCapabilities(), *capsJSON); err != nil {
+			fmt.Println("Failed to print capabilities:", err)
+		}
 		return
 	}
-	defer logFile.Close()
-	log.SetOutput(logFile)
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	// Create storage directory
-	err = os.MkdirAll(storageDir, os.ModePerm)
-	if err != nil {
-		log.Println("Failed to create storage directory:", err)
+	if *showLog != "" {
+		if opts.TransferLogs == "" {
+			fmt.Println("-show-log requires -transfer-logs")
+			return
+		}
+		if err := transfer.ShowTransferLog(os.Stdout, opts.TransferLogs, *showLog); err != nil {
+			fmt.Println("Failed to read transfer log:", err)
+		}
 		return
 	}
 
-	// Initialize screen
-	clearScreen()
-	moveCursor(1, 1)
-
-	// Display banner once
-	displayBanner()
-
-	// Display initial static information
-	fmt.Println("\n") // Add some space after the banner
-
-	// Start listening on IPv4
-	listener, err := net.Listen("tcp4", "0.0.0.0:"+*port)
-	if err != nil {
-		log.Println("Error starting server:", err)
-		color.Red("Error starting server: %v\n", err)
-		return
+	sizes := []struct {
+		name  string
+		value string
+		dst   *int64
+	}{
+		{"-global-rate", *globalRate, &opts.GlobalRate},
+		{"-maxrate", *maxRate, &opts.MaxRate},
+		{"-maxsize", *maxSize, &opts.MaxSize},
+		{"-quota", *quota, &opts.Quota},
 	}
-	defer listener.Close()
-	log.Printf("File server is listening on port %s...\n", *port)
-	color.Green("File server is listening on port %s...\n", *port)
-
-	// Initialize server start time
-	serverStartTime = time.Now()
-
-	// Start status monitor
-	go monitorStatus()
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Error accepting connection:", err)
+	for _, s := range sizes {
+		if s.value == "" {
 			continue
 		}
-		go handleConnection(conn)
+		size, err := transfer.ParseSize(s.value)
+		if err != nil {
+			fmt.Printf("Invalid %s: %v\n", s.name, err)
+			return
+		}
+		*s.dst = size
 	}
-}
-
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-
-	clientIP := conn.RemoteAddr().String()
-	clientID := fmt.Sprintf("%d", time.Now().UnixNano())
-
-	log.Printf("Client %s connected.\n", clientIP)
-	fmt.Printf("Client %s connected.\n", clientIP)
-
-	// Read file info length
-	lengthBuf := make([]byte, 4)
-	_, err := io.ReadFull(conn, lengthBuf)
-	if err != nil {
-		log.Printf("Client %s: Error reading info length: %v\n", clientIP, err)
+	if refreshInterval <= 0 {
+		fmt.Println("Invalid -refresh:", refreshInterval)
 		return
 	}
-	infoLength := binary.BigEndian.Uint32(lengthBuf)
-
-	// Read file info
-	infoBuf := make([]byte, infoLength)
-	_, err = io.ReadFull(conn, infoBuf)
-	if err != nil {
-		log.Printf("Client %s: Error reading file info: %v\n", clientIP, err)
+	if opts.MaxNameLength <= 0 {
+		fmt.Println("Invalid -max-name:", opts.MaxNameLength)
 		return
 	}
-
-	info := strings.Split(string(infoBuf), "|")
-	if len(info) < 4 {
-		log.Printf("Client %s: Received incomplete file info\n", clientIP)
+	if opts.SpeedWindow <= 0 {
+		fmt.Println("Invalid -speed-window:", opts.SpeedWindow)
 		return
 	}
-	fileName := sanitizeFileName(info[0])
-	fileSize, err := strconv.ParseInt(info[1], 10, 64)
-	if err != nil {
-		log.Printf("Client %s: Invalid file size: %v\n", clientIP, err)
+	if opts.ProgressInterval <= 0 {
+		fmt.Println("Invalid -progress-interval:", opts.ProgressInterval)
 		return
 	}
-	// Remove hash and resume from info, since server will compute hash
-	// hash := info[2]
-	resume := info[3] == "true"
-
-	log.Printf("Client %s: File Name: %s, File Size: %d, Resume: %t\n", clientIP, fileName, fileSize, resume)
+	if opts.History < 0 {
+		fmt.Println("Invalid -history:", opts.History)
+		return
+	}
+	// 0 turns these off on the command line; the zero Options mean the
+	// defaults.
+	if opts.History == 0 {
+		opts.History = -1
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = -1
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = -1
+	}
+	if *chunk != "" {
+		size, err := transfer.ParseSize(*chunk)
+		if err != nil || size <= 0 || size > math.MaxInt32 {
+			fmt.Println("Invalid -chunk:", *chunk)
+			return
+		}
+		opts.ChunkSize = int(size)
+	}
 
-	var offset int64 = 0
-	if resume {
-		if val, ok := fileState.Load(fileName); ok {
-			offset = val.(int64)
-			if offset > fileSize {
-				offset = 0 // Prevent offset from exceeding file size
-			}
+	if *listIncomplete {
+		// The state a running server saves is at most a few seconds old;
+		// /incomplete reports it live.
+		if err := transfer.PrintIncomplete(os.Stdout, opts); err != nil {
+			fmt.Println("Failed to list incomplete uploads:", err)
 		}
-		// Send offset back to client
-		offsetStr := fmt.Sprintf("%d", offset)
-		_, err = conn.Write([]byte(offsetStr))
+		return
+	}
+
+	if *pubKeyPath != "" {
+		key, err := transfer.LoadPublicKey(*pubKeyPath)
 		if err != nil {
-			log.Printf("Client %s: Error sending resume offset: %v\n", clientIP, err)
+			fmt.Println("Failed to load -pubkey:", err)
 			return
 		}
-		log.Printf("Client %s: Sent resume offset: %d\n", clientIP, offset)
-	} else {
-		// If not resuming, send 0 offset
-		_, err = conn.Write([]byte("0"))
+		opts.VerifyKey = key
+	} else if opts.RequireSignature {
+		fmt.Println("-require-signature needs -pubkey")
+		return
+	}
+
+	var tlsConfig *tls.Config
+	if *useTLS {
+		config, err := loadTLSConfig(*certFile, *keyFile)
 		if err != nil {
-			log.Printf("Client %s: Error sending initial offset: %v\n", clientIP, err)
+			fmt.Println("Failed to load TLS certificate:", err)
 			return
 		}
-		log.Printf("Client %s: Sent initial offset: 0\n", clientIP)
+		tlsConfig = config
 	}
 
-	filePath := filepath.Join(storageDir, fileName)
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
+	// Configure logging
+	logMaxSize, err := transfer.ParseSize(*logMax)
 	if err != nil {
-		log.Printf("Client %s: Error creating/opening file: %v\n", clientIP, err)
+		fmt.Println("Invalid -logmax:", err)
 		return
 	}
-	defer file.Close()
-
-	// Seek to offset
-	_, err = file.Seek(offset, 0)
+	logFile, err := openRotatingWriter("server.log", logMaxSize, *logKeep)
 	if err != nil {
-		log.Printf("Client %s: Error seeking file: %v\n", clientIP, err)
+		fmt.Println("Failed to open log file:", err)
 		return
 	}
+	defer logFile.Close()
+	log.SetOutput(logFile)
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	// Initialize client status
-	client := &Client{
-		ID:             clientID,
-		IP:             clientIP,
-		FileName:       fileName,
-		FileSize:       fileSize,
-		Received:       offset,
-		Status:         "传输中",
-		Speed:          0.0,
-		StartTime:      time.Now(),
-		CalculatedHash: "",
+	// Events on stdout leave no room for the console.
+	consoleEnabled := *eventsTarget != "-"
+	if consoleEnabled {
+		opts.Console = os.Stdout
+	}
+	srv, err := transfer.NewServer(opts)
+	if err != nil {
+		fmt.Println("Failed to start server:", err)
+		return
 	}
 
-	// Add client to clients map
-	clientsMu.Lock()
-	clients[clientID] = client
-	activeConnections++
-	clientsMu.Unlock()
-
-	log.Printf("Client %s: Started transferring file %s (%d bytes)\n", clientIP, fileName, fileSize)
-	fmt.Printf("Client %s: Started transferring file %s (%d bytes)\n", clientIP, fileName, fileSize)
-
-	buf := make([]byte, ChunkSize)
-	startTime := time.Now()
-
-	for client.Received < client.FileSize {
-		n, err := conn.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Client %s: Error reading file chunk: %v\n", clientIP, err)
-			client.Status = "传输中断"
-			break
+	if *eventsTarget != "" {
+		if err := srv.ServeEvents(*eventsTarget); err != nil {
+			transfer.LogError("failed to start event stream", "err", err)
+			fmt.Println("Failed to start event stream:", err)
+			return
 		}
+	}
 
-		// Write to file
-		_, err = file.Write(buf[:n])
-		if err != nil {
-			log.Printf("Client %s: Error writing to file: %v\n", clientIP, err)
-			client.Status = "写入错误"
-			break
+	if *httpAddr != "" {
+		if err := srv.ServeStats(*httpAddr); err != nil {
+			transfer.LogError("failed to start stats endpoint", "err", err)
+			fmt.Println("Failed to start stats endpoint:", err)
+			return
 		}
+	}
 
-		client.Received += int64(n)
-		mu.Lock()
-		totalBytesTransferred += int64(n)
-		mu.Unlock()
-		fileState.Store(fileName, client.Received)
+	// Under systemd, in a container or behind a pipe, escape sequences
+	// would only garble the log, so the console is then plain text.
+	interactive := stdoutIsTerminal()
+	if !interactive {
+		color.NoColor = true
+	}
+	if consoleEnabled && interactive {
+		// Initialize screen
+		clearScreen()
+		moveCursor(1, 1)
+
+		// Display banner once
+		displayBanner()
+
+		// Display initial static information
+		fmt.Println() // Add some space after the banner
+	} else if consoleEnabled {
+		fmt.Println(welcomeMsg)
+	}
 
-		// Calculate transfer speed
-		elapsed := time.Since(startTime).Seconds()
-		if elapsed > 0 {
-			client.Speed = float64(n) / elapsed / (1024 * 1024) // MB/s
-		}
-		startTime = time.Now()
+	// Start listening, on both IPv4 and IPv6 unless -bind picks an address
+	listener, err := listenWithBacklog("tcp", net.JoinHostPort(*bind, *port), *backlog)
+	if err != nil {
+		transfer.LogError("error starting server", "err", err)
+		color.Red("Error starting server: %v\n", err)
+		return
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	defer listener.Close()
+	listeningMsg = fmt.Sprintf("File server is listening on %s...", listener.Addr())
+	if consoleEnabled {
+		color.Green("%s\n", listeningMsg)
 	}
 
-	// Close the file to ensure all data is written
-	file.Close()
+	// Start status monitor; typing a transfer's ID cancels it.
+	if consoleEnabled {
+		go monitorStatus(srv)
+		go readCancelCommands(srv, os.Stdin)
+	}
 
-	// Compute hash of received file
-	calculatedHash, err := calculateFileHash(filePath)
-	if err != nil {
-		log.Printf("Client %s: Error calculating file hash: %v\n", clientIP, err)
-		client.Status = "哈希计算错误"
-	} else {
-		client.CalculatedHash = calculatedHash
-		client.Status = "传输完成"
-		log.Printf("Client %s: File %s received successfully (%d bytes). Hash: %s\n", clientIP, fileName, client.Received, calculatedHash)
-		fmt.Printf("Client %s: File %s received successfully (%d bytes). Hash: %s\n", clientIP, fileName, client.Received, calculatedHash)
-	}
-
-	// Move client to completedClients if transfer is completed or encountered an error
-	if client.Status == "传输完成" || client.Status != "传输中" {
-		completedClientsMu.Lock()
-		completedClients = append(completedClients, client)
-		completedClientsMu.Unlock()
-
-		// Remove from active clients map
-		clientsMu.Lock()
-		delete(clients, clientID)
-		activeConnections--
-		clientsMu.Unlock()
-	}
-
-	log.Printf("Client %s: Connection closed.\n", clientIP)
-	fmt.Printf("Client %s: Connection closed.\n", clientIP)
+	go drainOnSignal(srv, listener, consoleEnabled)
+	srv.Serve(listener)
+	srv.Shutdown(drainTimeout)
 }
 
-func calculateFileHash(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
+// drainTimeout is how long a shutdown waits for the transfers in progress to
+// finish before exiting anyway (-drain-timeout). Interrupted uploads resume
+// from the saved state after the restart.
+var drainTimeout = 5 * time.Minute
+
+// drainOnSignal closes listener on SIGINT or SIGTERM so Serve returns,
+// after marking the server unhealthy. A second signal exits at once.
+func drainOnSignal(srv *transfer.Server, listener net.Listener, consoleEnabled bool) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	sig := <-ch
+	transfer.LogInfo("shutting down, no longer accepting connections", "signal", sig, "drain_timeout", drainTimeout)
+	if consoleEnabled {
+		fmt.Println("Shutting down, waiting for transfers in progress (signal again to exit now)...")
 	}
-	defer file.Close()
+	srv.Drain()
+	listener.Close()
+	<-ch
+	transfer.LogWarn("second signal, exiting without draining", "signal", sig)
+	srv.SaveState()
+	os.Exit(1)
+}
 
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		return "", err
+// readCancelCommands cancels the transfer whose ID is typed on each line of r,
+// as listed on the status screen.
+func readCancelCommands(srv *transfer.Server, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		id := strings.TrimSpace(scanner.Text())
+		if id == "" {
+			continue
+		}
+		if srv.Cancel(id) {
+			transfer.LogInfo("transfer cancelled from the console", "transfer", id)
+			fmt.Printf("Cancelled transfer %s\n", id)
+		} else {
+			fmt.Printf("No active transfer %s\n", id)
+		}
 	}
-	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func sanitizeFileName(fileName string) string {
-	// Remove path, keep base file name
-	baseName := filepath.Base(fileName)
-	// Further remove special characters like '..'
-	baseName = strings.ReplaceAll(baseName, "..", "")
-	return baseName
-}
+const welcomeMsg = "Welcome to the Enhanced File Transfer Server!"
 
 func displayBanner() {
 	c := color.New(color.FgCyan).Add(color.Bold)
-	c.Println(asciiArt)
-	c.Println("Welcome to the Enhanced File Transfer Server!")
+	c.Print(asciiArt)
+	c.Println(welcomeMsg)
 }
 
 // ANSI escape codes for terminal control
@@ -340,80 +350,52 @@ func moveCursor(row, col int) {
 }
 
 // monitorStatus periodically updates the server status on the terminal
-func monitorStatus() {
-	ticker := time.NewTicker(500 * time.Millisecond) // 500ms 更新频率
+func monitorStatus(srv *transfer.Server) {
+	if !stdoutIsTerminal() {
+		printStatus(srv)
+		return
+	}
+	ticker := time.NewTicker(refreshInterval)
 	defer ticker.Stop()
+	resized := watchResize()
+
+	// The banner was drawn by main; work out where it ends for the current
+	// terminal size and lay out again whenever the size changes.
+	width, height, _ := terminalSize()
+	statusStartLine := bannerRows(width) + 1
+	if height > 0 && statusStartLine-1+minStatusRows > height {
+		statusStartLine = drawHeader(width, height)
+	}
 
-	// Initial position after the banner and initial static information
-	// Count the number of lines in asciiArt plus additional lines
-	bannerLines := strings.Count(asciiArt, "\n") + 2 // 加上欢迎信息和空行
-	statusStartLine := bannerLines + 2               // Adjust based on your layout
-
-	for range ticker.C {
-		// Move cursor to status start position
-		moveCursor(statusStartLine, 1)
-
-		// Clear from the current line to the end of the screen
-		fmt.Print("\033[J") // Clear from cursor to end of screen
-
-		// Collect status information
-		mu.Lock()
-		conn := activeConnections
-		bytesTransferred := totalBytesTransferred
-		mu.Unlock()
-
-		// Calculate transfer speed
-		elapsed := time.Since(serverStartTime).Seconds()
-		var speed float64
-		if elapsed > 0 {
-			speed = float64(bytesTransferred) / elapsed / (1024 * 1024) // MB/s
+	for {
+		select {
+		case <-ticker.C:
+		case <-resized:
 		}
 
-		// Build main status string
-		mainStatus := fmt.Sprintf("Active Connections: %d | Total Bytes Transferred: %.2f MB | Current Speed: %.2f MB/s",
-			conn, float64(bytesTransferred)/(1024*1024), speed)
-
-		fmt.Println(mainStatus)
-		fmt.Println("------------------------------------------------------------")
-
-		// Build client status strings
-		clientsMu.Lock()
-		completedClientsMu.Lock()
-		if len(clients) == 0 && len(completedClients) == 0 {
-			fmt.Println("No active clients.")
-		} else {
-			// Display active clients
-			for _, client := range clients {
-				if client.Status == "传输中" {
-					status := fmt.Sprintf("Client %s: %s | File: %s | Size: %s | Received: %s | Speed: %.2f MB/s",
-						client.IP, client.Status, client.FileName, formatBytes(client.FileSize), formatBytes(client.Received), client.Speed)
-					fmt.Println(status)
-				}
-			}
-
-			// Display completed clients
-			for _, client := range completedClients {
-				status := fmt.Sprintf("Client %s: %s | File: %s | Size: %s | Hash: %s",
-					client.IP, client.Status, client.FileName, formatBytes(client.FileSize), client.CalculatedHash)
-				fmt.Println(status)
-			}
+		// Also re-measure on every tick, not every platform signals resizes.
+		if w, h, _ := terminalSize(); w != width || h != height {
+			width, height = w, h
+			statusStartLine = drawHeader(width, height)
 		}
-		completedClientsMu.Unlock()
-		clientsMu.Unlock()
 
+		lines := fitToTerminal(srv.StatusLines(), width, statusRows(statusStartLine, height))
+		os.Stdout.Write(renderFrame(statusStartLine, lines))
 	}
 }
 
-// formatBytes formats bytes as human-readable strings
-func formatBytes(bytes int64) string {
-	const unit = 1024
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
-	}
-	div, exp := int64(unit), 0
-	for n := bytes / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+// printStatus is monitorStatus for a stdout that is not a terminal: each
+// refresh appends the status as plain lines, skipped when nothing changed.
+func printStatus(srv *transfer.Server) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	var last string
+	for range ticker.C {
+		frame := strings.Join(srv.StatusLines(), "\n") + "\n"
+		if frame == last {
+			continue
+		}
+		last = frame
+		fmt.Println(frame)
 	}
-	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
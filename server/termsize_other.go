@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import "os"
+
+// terminalSize is unknown on this platform; the dashboard then draws without
+// truncating or limiting rows.
+func terminalSize() (width, height int, ok bool) {
+	return 0, 0, false
+}
+
+// watchResize returns a nil channel, which never fires.
+func watchResize() <-chan os.Signal {
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// loadTLSConfig builds the listener config for -tls from a PEM certificate
+// and key pair.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls needs both -cert and -key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,27 @@
+package transfer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// authToken is the shared secret set with -token. When it is set, every
+// header must carry a valid HMAC-SHA256 of its other fields keyed with it.
+var authToken []byte
+
+// authenticate reports whether mac (hex) is the HMAC of payload. It always
+// succeeds when no token is configured.
+func authenticate(payload, mac string) bool {
+	if len(authToken) == 0 {
+		return true
+	}
+	got, err := hex.DecodeString(mac)
+	if err != nil {
+		return false
+	}
+	h := hmac.New(sha256.New, authToken)
+	h.Write([]byte(payload))
+	// hmac.Equal compares in constant time.
+	return hmac.Equal(got, h.Sum(nil))
+}
@@ -0,0 +1,31 @@
+package transfer
+
+import (
+	"time"
+)
+
+// cancelTransfer aborts the active transfer with the given client ID. It
+// returns false if no such transfer is running.
+func cancelTransfer(id string) bool {
+	clientsMu.Lock()
+	client, ok := clients[id]
+	clientsMu.Unlock()
+	if !ok {
+		return false
+	}
+	client.cancelOnce.Do(func() {
+		close(client.cancel)
+		// Wake the read loop if it is blocked waiting for data.
+		client.conn.SetReadDeadline(time.Now())
+	})
+	return true
+}
+
+func (c *Client) cancelled() bool {
+	select {
+	case <-c.cancel:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,63 @@
+package transfer
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// caseInsensitive is set when the storage directory treats "Foo.txt" and
+// "foo.txt" as the same file (macOS and Windows defaults).
+var caseInsensitive bool
+
+// detectCaseInsensitive probes dir by creating a mixed-case file and looking
+// it up in lower case. Errors are treated as case-sensitive.
+func detectCaseInsensitive(dir string) bool {
+	probe, err := os.CreateTemp(dir, ".CaseProbe-*")
+	if err != nil {
+		return false
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	lower := filepath.Join(dir, strings.ToLower(filepath.Base(probe.Name())))
+	_, err = os.Stat(lower)
+	return err == nil
+}
+
+// canonicalFileName maps name onto an existing file or in-progress transfer
+// that differs from it only by case, so that on a case-insensitive store both
+// uploads are handled as the same file instead of one silently clobbering
+// the other under a different resume key.
+func canonicalFileName(name string) string {
+	if !caseInsensitive {
+		return name
+	}
+
+	found := ""
+	fileState.Range(func(key, _ interface{}) bool {
+		if s := key.(resumeKey).name; s != name && strings.EqualFold(s, name) {
+			found = s
+			return false
+		}
+		return true
+	})
+	if found != "" {
+		return found
+	}
+
+	dir, base := path.Split(name)
+	for _, root := range localRoots() {
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Name() != base && strings.EqualFold(entry.Name(), base) {
+				return dir + entry.Name()
+			}
+		}
+	}
+	return name
+}
@@ -0,0 +1,77 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestOverwriteOnCaseInsensitiveStorage uploads FOO.bin over a stored
+// foo.bin with case-insensitive storage forced on, and checks -overwrite
+// treats the two names as one file.
+func TestOverwriteOnCaseInsensitiveStorage(t *testing.T) {
+	stored, data := testData(500), testData(20000)
+
+	tests := []struct {
+		policy          string
+		caseInsensitive bool
+		wantReply       string
+		wantFiles       []string // in the storage directory afterwards
+		wantData        string   // file holding the upload, empty if refused
+	}{
+		{overwriteNever, true, fileExists, []string{"foo.bin"}, ""},
+		{overwriteRename, true, "0||foo(1).bin", []string{"foo(1).bin", "foo.bin"}, "foo(1).bin"},
+		{overwriteAlways, true, "0||", []string{"foo.bin"}, "foo.bin"},
+		// A case-sensitive store keeps both names apart.
+		{overwriteNever, false, "0||", []string{"FOO.bin", "foo.bin"}, "FOO.bin"},
+	}
+	for _, tt := range tests {
+		name := tt.policy
+		if !tt.caseInsensitive {
+			name += " case-sensitive"
+		}
+		t.Run(name, func(t *testing.T) {
+			useTestStorage(t, "")
+			oldPolicy, oldCase := overwritePolicy, caseInsensitive
+			t.Cleanup(func() { overwritePolicy, caseInsensitive = oldPolicy, oldCase })
+			overwritePolicy, caseInsensitive = tt.policy, tt.caseInsensitive
+			storeTestFile(t, "foo.bin", stored)
+
+			reply, result := upload(t, uploadHeader("FOO.bin", data), data)
+			if reply != tt.wantReply {
+				t.Fatalf("reply %q, want %q", reply, tt.wantReply)
+			}
+			if tt.wantData != "" && !strings.HasPrefix(result, "传输完成|") {
+				t.Fatalf("result %q, want the upload stored", result)
+			}
+
+			entries, err := os.ReadDir(localRoots()[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, entry := range entries {
+				if !strings.HasPrefix(entry.Name(), ".") {
+					files = append(files, entry.Name())
+				}
+			}
+			sort.Strings(files)
+			if strings.Join(files, ",") != strings.Join(tt.wantFiles, ",") {
+				t.Errorf("stored files %q, want %q", files, tt.wantFiles)
+			}
+			if tt.wantData != "" {
+				if got := readStored(t, tt.wantData); sha256Hex(got) != sha256Hex(data) {
+					t.Errorf("%s does not hold the upload", tt.wantData)
+				}
+			}
+			if tt.wantData != "foo.bin" {
+				got, err := os.ReadFile(filepath.Join(localRoots()[0], "foo.bin"))
+				if err != nil || sha256Hex(got) != sha256Hex(stored) {
+					t.Errorf("foo.bin changed: %v", err)
+				}
+			}
+		})
+	}
+}
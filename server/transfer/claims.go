@@ -0,0 +1,92 @@
+package transfer
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileBusy rejects an upload of a file another client is still writing.
+const fileBusy = "file busy"
+
+// claimTakeoverWait bounds how long a retried upload waits for the stale
+// transfer it replaces to let go of the file.
+const claimTakeoverWait = 5 * time.Second
+
+var errFileBusy = errors.New("file is being uploaded by another client")
+
+// uploadClaim is held by the transfers writing one part file: a single
+// whole-file upload, or the ranges of one parallel upload.
+type uploadClaim struct {
+	hash     string
+	group    string
+	holders  map[string]bool // client IDs
+	released chan struct{}   // closed when the last holder leaves
+}
+
+var (
+	uploadClaimsMu sync.Mutex
+	uploadClaims   = make(map[string]*uploadClaim)
+)
+
+// claimUpload registers clientID as writing the part file of name. Ranges of
+// the same parallel upload share the claim. A whole-file upload of the same
+// content cancels the transfer holding it and takes over, since that is
+// usually the client retrying before its old connection has timed out. Any
+// other upload gets errFileBusy.
+func claimUpload(name, hash, group, clientID string) (release func(), err error) {
+	hash = strings.ToLower(hash)
+	deadline := time.Now().Add(claimTakeoverWait)
+	for {
+		uploadClaimsMu.Lock()
+		claim := uploadClaims[name]
+		if claim == nil {
+			claim = &uploadClaim{hash: hash, group: group, holders: make(map[string]bool), released: make(chan struct{})}
+			uploadClaims[name] = claim
+		}
+		if claim.hash == hash && claim.group == group && (group != "" || len(claim.holders) == 0) {
+			claim.holders[clientID] = true
+			uploadClaimsMu.Unlock()
+			return func() { releaseUpload(name, claim, clientID) }, nil
+		}
+		takeover := claim.hash == hash && group == "" && claim.group == ""
+		var holders []string
+		for id := range claim.holders {
+			holders = append(holders, id)
+		}
+		uploadClaimsMu.Unlock()
+
+		if !takeover {
+			return nil, errFileBusy
+		}
+		for _, id := range holders {
+			cancelTransfer(id)
+		}
+		select {
+		case <-claim.released:
+		case <-time.After(time.Until(deadline)):
+			return nil, errFileBusy
+		}
+	}
+}
+
+// uploadActive reports whether a transfer is currently writing the part file
+// of name.
+func uploadActive(name string) bool {
+	uploadClaimsMu.Lock()
+	defer uploadClaimsMu.Unlock()
+	return uploadClaims[name] != nil
+}
+
+func releaseUpload(name string, claim *uploadClaim, clientID string) {
+	uploadClaimsMu.Lock()
+	defer uploadClaimsMu.Unlock()
+	delete(claim.holders, clientID)
+	if len(claim.holders) == 0 {
+		if uploadClaims[name] == claim {
+			delete(uploadClaims, name)
+		}
+		close(claim.released)
+	}
+}
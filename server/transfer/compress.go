@@ -0,0 +1,75 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// compressDeflate in the header's fieldCompress has the client send the
+// data as chunks, each prefixed with its 4-byte big-endian length and
+// compressed on its own with deflate. The hash still covers the original
+// bytes, as they are hashed after inflating.
+const compressDeflate = "deflate"
+
+// unsupportedCompression rejects a header naming another compression.
+const unsupportedCompression = "unsupported compression"
+
+// maxCompressedChunk bounds the compressed length a client may announce:
+// the client's chunks are at most maxCheckedChunk, and deflate adds a few
+// bytes per 64KB block to data that does not compress.
+const maxCompressedChunk = maxCheckedChunk + maxCheckedChunk/1024
+
+// chunkInflater reads compressed chunks, reusing its buffers and
+// decompressor between them.
+type chunkInflater struct {
+	packed []byte
+	out    bytes.Buffer
+	r      io.ReadCloser
+}
+
+// read reads one compressed chunk and inflates it into *buf, growing it if
+// needed. The chunk must inflate to between 1 and limit bytes.
+func (c *chunkInflater) read(conn net.Conn, buf *[]byte, limit int64) (int, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n == 0 || n > maxCompressedChunk {
+		return 0, fmt.Errorf("invalid compressed chunk length %d", n)
+	}
+	if int(n) > cap(c.packed) {
+		c.packed = make([]byte, n)
+	}
+	c.packed = c.packed[:n]
+	if _, err := io.ReadFull(conn, c.packed); err != nil {
+		return 0, err
+	}
+
+	if c.r == nil {
+		c.r = flate.NewReader(bytes.NewReader(c.packed))
+	} else if err := c.r.(flate.Resetter).Reset(bytes.NewReader(c.packed), nil); err != nil {
+		return 0, err
+	}
+	if limit > maxCheckedChunk {
+		limit = maxCheckedChunk
+	}
+	c.out.Reset()
+	// One byte past limit tells a chunk that inflates too far from one that
+	// fits exactly.
+	m, err := c.out.ReadFrom(io.LimitReader(c.r, limit+1))
+	if err != nil {
+		return 0, fmt.Errorf("invalid compressed chunk: %w", err)
+	}
+	if m == 0 || m > limit {
+		return 0, fmt.Errorf("compressed chunk inflates to an invalid length")
+	}
+	if m > int64(len(*buf)) {
+		*buf = make([]byte, m)
+	}
+	return copy(*buf, c.out.Bytes()), nil
+}
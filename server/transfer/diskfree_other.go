@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package transfer
+
+// freeSpace is not implemented on this platform.
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
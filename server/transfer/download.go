@@ -0,0 +1,185 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloadRequest starts a header asking for a stored file instead of
+// sending one.
+const downloadRequest = "DOWNLOAD"
+
+// Download header fields, in wire order.
+const (
+	dlFieldType    = iota // downloadRequest
+	dlFieldVersion        // ProtocolVersion
+	dlFieldName           // slash-separated path in the storage directory, as -list shows it
+	dlFieldOffset         // bytes the client already has
+	dlFieldAuth           // HMAC of the fields before it, see -token
+	downloadFields
+)
+
+// fileNotFound rejects a download of a file the server does not store.
+const fileNotFound = "file not found"
+
+// storedSHA256 remembers the SHA-256 of stored files, which every download
+// reply carries, so a file is hashed once rather than on every download.
+var storedSHA256 sync.Map // name -> cachedHash
+
+// cachedHash is a file's hash, valid while its size and modification time
+// are those it was taken at.
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// rememberSHA256 records that the stored file name, as described by info,
+// has the SHA-256 hash.
+func rememberSHA256(name string, info fs.FileInfo, hash string) {
+	storedSHA256.Store(name, cachedHash{size: info.Size(), modTime: info.ModTime(), hash: hash})
+}
+
+// fileSHA256 returns the SHA-256 of the stored file name described by info,
+// from storedSHA256 unless the file changed since.
+func fileSHA256(name string, info fs.FileInfo) (string, error) {
+	if v, ok := storedSHA256.Load(name); ok {
+		if c := v.(cachedHash); c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+			return c.hash, nil
+		}
+	}
+	hash, err := calculateFileHash(name, sha256.New)
+	if err != nil {
+		return "", err
+	}
+	rememberSHA256(name, info, hash)
+	return hash, nil
+}
+
+// handleDownload streams a stored file to the client from the offset it
+// asks for, and reports whether the connection is still in step.
+func handleDownload(conn net.Conn, clientIP, clientID string, info []string, tlog *transferLog) bool {
+	if len(info) != downloadFields {
+		tlog.Warn("malformed download request", "client_ip", clientIP, "fields", len(info))
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+	if version, err := strconv.Atoi(info[dlFieldVersion]); err != nil || version != ProtocolVersion {
+		tlog.Warn("unsupported protocol version", "client_ip", clientIP, "version", info[dlFieldVersion])
+		rejectConnection(conn, fmt.Sprintf("%s %s, server speaks %d", protocolMismatch, info[dlFieldVersion], ProtocolVersion))
+		return false
+	}
+	if !authenticate(strings.Join(info[:dlFieldAuth], "|"), info[dlFieldAuth]) {
+		tlog.Warn("rejected download with invalid token HMAC", "client_ip", clientIP)
+		rejectConnection(conn, authFailed)
+		return false
+	}
+	fileName, err := sanitizeStoredPath(info[dlFieldName])
+	if err != nil {
+		tlog.Warn("rejected file name", "client_ip", clientIP, "err", err)
+		rejectConnection(conn, "invalid file name")
+		return false
+	}
+	fileName = canonicalFileName(fileName)
+	offset, err := strconv.ParseInt(info[dlFieldOffset], 10, 64)
+	if err != nil || offset < 0 {
+		tlog.Warn("rejected invalid download offset", "client_ip", clientIP, "offset", info[dlFieldOffset])
+		rejectConnection(conn, "invalid range")
+		return false
+	}
+
+	stat, err := storage.Stat(fileName)
+	if err != nil || stat.IsDir() {
+		tlog.Warn("rejected download of missing file", "client_ip", clientIP, "file", fileName, "err", err)
+		rejectConnection(conn, fileNotFound)
+		return false
+	}
+	fileSize := stat.Size()
+	// A partial download longer than the file belongs to another version.
+	if offset > fileSize {
+		offset = 0
+	}
+	fileHash, err := fileSHA256(fileName, stat)
+	if err != nil {
+		tlog.Error("error hashing file", "client_ip", clientIP, "file", fileName, "err", err)
+		rejectConnection(conn, fileNotFound)
+		return false
+	}
+	// Let the client check that the bytes it has are ours before resuming.
+	prefixHash := ""
+	if offset > 0 {
+		hasher, err := hashSection(fileName, 0, offset, sha256.New)
+		if err != nil {
+			tlog.Warn("cannot read the bytes to resume from, starting over", "client_ip", clientIP, "file", fileName, "offset", offset, "err", err)
+			offset = 0
+		} else {
+			prefixHash = hex.EncodeToString(hasher.Sum(nil))
+		}
+	}
+
+	file, err := storage.Open(fileName)
+	if err != nil {
+		tlog.Error("error opening file", "client_ip", clientIP, "file", fileName, "err", err)
+		rejectConnection(conn, fileNotFound)
+		return false
+	}
+	defer file.Close()
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, file, offset)
+	}
+	if err != nil {
+		tlog.Error("error seeking file", "client_ip", clientIP, "file", fileName, "offset", offset, "err", err)
+		rejectConnection(conn, fileNotFound)
+		return false
+	}
+
+	reply := strings.Join([]string{strconv.FormatInt(offset, 10), strconv.FormatInt(fileSize, 10), fileHash, prefixHash}, "|")
+	if err := writeFrame(conn, []byte(reply)); err != nil {
+		tlog.Warn("error sending download offset", "client_ip", clientIP, "err", err)
+		return false
+	}
+	tlog.Info("download started", "client_ip", clientIP, "file", fileName, "size", fileSize, "offset", offset)
+	consolef("Client %s: Started downloading file %s (%d bytes)\n", clientIP, fileName, fileSize)
+
+	limiter := scheduler.Join(clientID)
+	defer scheduler.Leave(clientID)
+
+	buf := make([]byte, chunkSize)
+	sent := offset
+	for sent < fileSize {
+		chunk := buf
+		if remaining := fileSize - sent; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := io.ReadFull(file, chunk)
+		if err != nil {
+			tlog.Error("error reading file", "client_ip", clientIP, "file", fileName, "offset", sent, "err", err)
+			return false
+		}
+		// A client that stops reading is as idle as one that stops sending.
+		if idleTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+		}
+		if _, err := conn.Write(chunk[:n]); err != nil {
+			tlog.Warn("download interrupted", "client_ip", clientIP, "file", fileName, "bytes", sent, "size", fileSize, "err", err)
+			return false
+		}
+		sent += int64(n)
+		limiter.Wait(n, nil)
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	tlog.Info("download finished", "client_ip", clientIP, "file", fileName, "bytes", fileSize, "hash", fileHash)
+	consolef("Client %s: Finished downloading file %s\n", clientIP, fileName)
+	return true
+}
@@ -0,0 +1,149 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeStoredPath(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"x.bin", "x.bin", false},
+		{"a/b/x.bin", "a/b/x.bin", false},
+		{`a\b\x.bin`, "a/b/x.bin", false},
+		{"./a//x.bin", "a/x.bin", false},
+		{"../x.bin", "", true},
+		{"a/../../x.bin", "", true},
+		{"a/", "", true},
+		{"", "", true},
+		{"C:/x.bin", "", true},
+		{resumeStateFile, "", true},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeStoredPath(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("sanitizeStoredPath(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// download sends a download header for name from offset over a pipe to
+// handleDownload and returns the reply fields and the data that follows.
+func download(t *testing.T, name string, offset int64) (reply []string, data []byte) {
+	t.Helper()
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		defer server.Close()
+		fields := []string{downloadRequest, strconv.Itoa(ProtocolVersion), name, strconv.FormatInt(offset, 10)}
+		h := hmac.New(sha256.New, authToken)
+		h.Write([]byte(strings.Join(fields, "|")))
+		info := append(fields, hex.EncodeToString(h.Sum(nil)))
+		done <- handleDownload(server, "test", "test", info, nil)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	var length uint32
+	if err := binary.Read(client, binary.BigEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(client, frame); err != nil {
+		t.Fatal(err)
+	}
+	reply = strings.Split(string(frame), "|")
+	if len(reply) == 4 {
+		size, _ := strconv.ParseInt(reply[1], 10, 64)
+		start, _ := strconv.ParseInt(reply[0], 10, 64)
+		data = make([]byte, size-start)
+		if _, err := io.ReadFull(client, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	return reply, data
+}
+
+func TestHandleDownload(t *testing.T) {
+	root := t.TempDir()
+	oldStorage, oldToken := storage, authToken
+	t.Cleanup(func() { storage, authToken = oldStorage, oldToken })
+	storage, authToken = localStorage{root: root}, []byte("secret")
+	content := testData(1000)
+	storeTestFile(t, "a/b/x.bin", content)
+	storeTestFile(t, "top.bin", content[:10])
+
+	tests := []struct {
+		name       string
+		file       string
+		offset     int64
+		wantOffset string
+		wantData   []byte
+		wantReject string
+	}{
+		{"top level file", "top.bin", 0, "0", content[:10], ""},
+		{"file in a subdirectory", "a/b/x.bin", 0, "0", content, ""},
+		{"resumed", "a/b/x.bin", 600, "600", content[600:], ""},
+		{"offset past the end starts over", "a/b/x.bin", 5000, "0", content, ""},
+		{"base name only", "x.bin", 0, "", nil, fileNotFound},
+		{"directory", "a/b", 0, "", nil, fileNotFound},
+		{"climbing out", "../x.bin", 0, "", nil, "invalid file name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, data := download(t, tt.file, tt.offset)
+			if tt.wantReject != "" {
+				if len(reply) != 1 || reply[0] != tt.wantReject {
+					t.Fatalf("reply %q, want rejection %q", reply, tt.wantReject)
+				}
+				return
+			}
+			if len(reply) != 4 {
+				t.Fatalf("reply %q, want offset|size|hash|prefix", reply)
+			}
+			sum := sha256.Sum256(readStored(t, tt.file))
+			if reply[0] != tt.wantOffset || reply[2] != hex.EncodeToString(sum[:]) {
+				t.Errorf("reply %q, want offset %s and hash %x", reply, tt.wantOffset, sum)
+			}
+			if !bytes.Equal(data, tt.wantData) {
+				t.Errorf("got %d bytes of data, want %d", len(data), len(tt.wantData))
+			}
+		})
+	}
+}
+
+func TestFileSHA256Cache(t *testing.T) {
+	root := t.TempDir()
+	oldStorage := storage
+	t.Cleanup(func() { storage = oldStorage; storedSHA256.Delete("f") })
+	storage = localStorage{root: root}
+	path := filepath.Join(root, "f")
+	os.WriteFile(path, []byte("one"), 0644)
+	info, _ := os.Stat(path)
+	rememberSHA256("f", info, "cached")
+
+	if got, err := fileSHA256("f", info); err != nil || got != "cached" {
+		t.Fatalf("fileSHA256 = %q, %v; want the cached hash", got, err)
+	}
+	// A changed file is hashed again.
+	os.WriteFile(path, []byte("other"), 0644)
+	info, _ = os.Stat(path)
+	sum := sha256.Sum256([]byte("other"))
+	if got, err := fileSHA256("f", info); err != nil || got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("fileSHA256 = %q, %v; want %x", got, err, sum)
+	}
+}
@@ -0,0 +1,213 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types published on the event bus.
+const (
+	EventStart    = "start"
+	EventProgress = "progress"
+	EventComplete = "complete"
+	EventError    = "error"
+)
+
+// progressEventInterval (-progress-interval) is the least time between two
+// progress reports of one connection's upload.
+var progressEventInterval = DefaultProgressInterval
+
+// Event is one transfer lifecycle event. It is written as a single JSON line
+// by -events-socket. Speed is in bytes per second, as in Progress.
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	TransferID string    `json:"transfer_id"`
+	ClientIP   string    `json:"client_ip"`
+	FileName   string    `json:"file_name"`
+	FileSize   int64     `json:"file_size"`
+	Received   int64     `json:"received"`
+	Speed      float64   `json:"speed_bytes_per_second,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	Status     string    `json:"status,omitempty"`
+}
+
+// eventBus fans events out to subscribers. Publishing never blocks: a
+// subscriber that falls behind misses events rather than stalling transfers.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+var events = &eventBus{subs: make(map[chan Event]struct{})}
+
+// Subscribe returns a channel of future events and a function that ends the
+// subscription.
+func (b *eventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 256)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *eventBus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishClientEvent publishes an event of type typ describing client.
+func publishClientEvent(typ string, client *Client) {
+	events.Publish(Event{
+		Type:       typ,
+		Time:       time.Now(),
+		TransferID: client.ID,
+		ClientIP:   client.IP,
+		FileName:   client.FileName,
+		FileSize:   client.FileSize,
+		Received:   client.Received,
+		Speed:      client.speed.Rate(),
+		Hash:       client.CalculatedHash,
+		Status:     client.Status,
+	})
+}
+
+// Progress is how far the upload on one connection has got, for the hooks
+// registered with Server.OnProgress. TransferID tells the connections
+// apart. Received includes the resume offset; Total is 0 for a stream,
+// whose size is only known once it is done.
+type Progress struct {
+	TransferID string
+	ClientIP   string
+	FileName   string
+	Received   int64
+	Total      int64
+	Speed      float64 // bytes per second
+}
+
+// progressHook is told how far the upload of one connection has got.
+// client.ID identifies the connection, for hooks that keep state per
+// connection.
+type progressHook func(client *Client)
+
+var (
+	progressHooksMu sync.Mutex
+	// progressHooks are called by every connection's progressReporter, in
+	// order. They run in the connection's goroutine and hold up its
+	// upload, so they must not block.
+	progressHooks = []progressHook{
+		func(client *Client) { publishClientEvent(EventProgress, client) },
+	}
+)
+
+// OnProgress registers hook to be called with the progress of every upload
+// that starts from now on, at most once per Options.ProgressInterval for
+// each connection. Hooks run in the goroutine receiving the upload and hold
+// it up, so they should return quickly.
+func (s *Server) OnProgress(hook func(Progress)) {
+	progressHooksMu.Lock()
+	defer progressHooksMu.Unlock()
+	progressHooks = append(progressHooks, func(client *Client) {
+		hook(Progress{
+			TransferID: client.ID,
+			ClientIP:   client.IP,
+			FileName:   client.FileName,
+			Received:   client.Received,
+			Total:      client.FileSize,
+			Speed:      client.speed.Rate(),
+		})
+	})
+}
+
+// progressReporter rate-limits the progress reports of one connection, so
+// a fast chunk loop calls its hooks at most once per progressEventInterval.
+// The hooks are those registered when the upload started.
+type progressReporter struct {
+	client *Client
+	hooks  []progressHook
+	last   time.Time
+}
+
+func newProgressReporter(client *Client) *progressReporter {
+	progressHooksMu.Lock()
+	hooks := progressHooks[:len(progressHooks):len(progressHooks)]
+	progressHooksMu.Unlock()
+	return &progressReporter{client: client, hooks: hooks, last: time.Now()}
+}
+
+// report calls the hooks unless they were called less than
+// progressEventInterval ago.
+func (r *progressReporter) report() {
+	if time.Since(r.last) < progressEventInterval {
+		return
+	}
+	r.last = time.Now()
+	for _, hook := range r.hooks {
+		hook(r.client)
+	}
+}
+
+// writeEvents copies events to w as newline-delimited JSON until a write
+// fails.
+func writeEvents(w io.Writer) {
+	ch, cancel := events.Subscribe()
+	defer cancel()
+	enc := json.NewEncoder(w)
+	for e := range ch {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+}
+
+// serveEvents streams events to stdout when target is "-", otherwise to every
+// reader connected to the Unix socket at target. It returns the socket's
+// listener, nil for stdout.
+func serveEvents(target string) (net.Listener, error) {
+	if target == "-" {
+		go writeEvents(os.Stdout)
+		return nil, nil
+	}
+
+	os.Remove(target) // stale socket from a previous run
+	listener, err := net.Listen("unix", target)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				logError("error accepting events connection", "err", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				writeEvents(conn)
+			}()
+		}
+	}()
+	return listener, nil
+}
@@ -0,0 +1,116 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOnProgress(t *testing.T) {
+	oldHooks, oldInterval := progressHooks, progressEventInterval
+	t.Cleanup(func() { progressHooks, progressEventInterval = oldHooks, oldInterval })
+	progressHooks = nil
+
+	var got []Progress
+	var s Server
+	s.OnProgress(func(p Progress) { got = append(got, p) })
+
+	client := &Client{ID: "7", IP: "192.0.2.1:4000", FileName: "a.bin", FileSize: 100, Received: 40}
+	progressEventInterval = 0
+	r := newProgressReporter(client)
+	// Hooks registered after the upload started are not called for it.
+	s.OnProgress(func(Progress) { t.Error("late hook called") })
+	r.report()
+	want := Progress{TransferID: "7", ClientIP: "192.0.2.1:4000", FileName: "a.bin", Received: 40, Total: 100}
+	if len(got) != 1 || got[0] != want {
+		t.Fatalf("got %+v, want [%+v]", got, want)
+	}
+
+	progressEventInterval = time.Hour
+	client.Received = 60
+	r.report()
+	if len(got) != 1 {
+		t.Errorf("report within the interval called the hook again: %+v", got)
+	}
+	r.last = time.Now().Add(-2 * time.Hour)
+	r.report()
+	if len(got) != 2 || got[1].Received != 60 {
+		t.Errorf("got %+v after the interval, want a second report at 60 bytes", got)
+	}
+}
+
+// TestEventStream uploads a file and then a corrupted one with a listener
+// on -events-socket, and checks each upload's events arrive in order under
+// a transfer ID of its own.
+func TestEventStream(t *testing.T) {
+	useTestStorage(t, "")
+	oldInterval := progressEventInterval
+	t.Cleanup(func() { progressEventInterval = oldInterval })
+	progressEventInterval = 0
+
+	socket := filepath.Join(t.TempDir(), "events.sock")
+	listener, err := serveEvents(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Events published before the stream subscribes are not sent to it.
+	for subscribers := 0; subscribers == 0; time.Sleep(time.Millisecond) {
+		events.mu.Lock()
+		subscribers = len(events.subs)
+		events.mu.Unlock()
+	}
+
+	data := testData(100000)
+	upload(t, uploadHeader("good.bin", data), data)
+	upload(t, uploadHeader("bad.bin", data), testData(len(data) + 1)[1:])
+
+	scanner := bufio.NewScanner(conn)
+	var ids []string
+	for _, tt := range []struct {
+		file, last string
+	}{{"good.bin", EventComplete}, {"bad.bin", EventError}} {
+		var types []string
+		var id string
+		for len(types) == 0 || types[len(types)-1] != tt.last {
+			if !scanner.Scan() {
+				t.Fatalf("event stream ended after %v: %v", types, scanner.Err())
+			}
+			var e Event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Fatalf("event %q: %v", scanner.Text(), err)
+			}
+			if e.FileName != tt.file {
+				t.Fatalf("%s event for %s while %s is uploaded", e.Type, e.FileName, tt.file)
+			}
+			if id == "" {
+				id = e.TransferID
+			} else if e.TransferID != id {
+				t.Errorf("%s event of %s has transfer ID %q, the upload started as %q", e.Type, tt.file, e.TransferID, id)
+			}
+			types = append(types, e.Type)
+		}
+		if types[0] != EventStart || len(types) < 3 {
+			t.Errorf("%s: events %v, want start, progress, then %s", tt.file, types, tt.last)
+		}
+		for _, typ := range types[1 : len(types)-1] {
+			if typ != EventProgress {
+				t.Errorf("%s: events %v, want only progress between start and %s", tt.file, types, tt.last)
+				break
+			}
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("transfer IDs %q, want a distinct one for each upload", ids)
+	}
+}
@@ -0,0 +1,36 @@
+package transfer
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameLength (-max-name) bounds each file or directory name a client
+// sends, in bytes, which is how most filesystems count their limit.
+var maxNameLength = DefaultMaxNameLength
+
+// checkNameChars refuses a client-supplied name that is not valid UTF-8 or
+// holds control characters (newlines, escapes, NUL, ...) or invisible
+// format characters such as bidi overrides and zero-width spaces. Such
+// names break logs and tooling or pass for a different name, so they are
+// refused rather than cleaned up.
+func checkNameChars(what, name string) error {
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%s %q is not valid UTF-8", what, name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return fmt.Errorf("%s %q contains the character %U", what, name, r)
+		}
+	}
+	return nil
+}
+
+// checkNameLength refuses a single name element longer than maxNameLength.
+func checkNameLength(what, elem string) error {
+	if len(elem) > maxNameLength {
+		return fmt.Errorf("%s %.40q... is %d bytes long, the limit is %d", what, elem, len(elem), maxNameLength)
+	}
+	return nil
+}
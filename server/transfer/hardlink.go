@@ -0,0 +1,95 @@
+package transfer
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errPartLinked means a part file could not be unlinked from the stored file
+// it was linked to, so writing to it would change that file.
+var errPartLinked = errors.New("part file still linked to a stored file")
+
+// linkStoredFile gives the part file of name the content of target, a file
+// stored earlier that the client says name is a hard link to. The part file
+// becomes a hard link to target where the storage allows it and a copy of
+// it otherwise, which copied reports. Either is only kept if it is size
+// bytes with hash wantHash; the returned hasher has consumed it.
+func linkStoredFile(target, name string, size int64, wantHash string, newHash func() hash.Hash) (hasher hash.Hash, copied bool, err error) {
+	info, err := storage.Stat(target)
+	if err != nil {
+		return nil, false, err
+	}
+	if info.IsDir() || info.Size() != size {
+		return nil, false, fmt.Errorf("%s is not a file of %d bytes", target, size)
+	}
+	part := partName(name)
+	if err := hardLink(target, part); err != nil {
+		release, err := reserveSpace(size)
+		if err != nil {
+			return nil, true, err
+		}
+		defer release()
+		if err := copyStored(target, part, size); err != nil {
+			return nil, true, err
+		}
+		copied = true
+	}
+	hasher, err = hashSection(part, 0, size, newHash)
+	if err == nil && !strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), wantHash) {
+		err = fmt.Errorf("%s does not hold the data of %s", target, name)
+	}
+	if err != nil {
+		// A wrong copy is overwritten by the upload; a link must go first.
+		if !copied {
+			if rmErr := os.Remove(storage.(localStorage).path(part)); rmErr != nil {
+				return nil, false, fmt.Errorf("%w: %v", errPartLinked, rmErr)
+			}
+		}
+		return nil, copied, err
+	}
+	return hasher, copied, nil
+}
+
+// hardLink makes newName a hard link to the stored file oldName. Only a
+// single local storage directory can link; shards and remote backends fail
+// and are copied to instead, as are file systems without hard links.
+func hardLink(oldName, newName string) error {
+	l, ok := storage.(localStorage)
+	if !ok {
+		return errors.New("storage backend cannot link files")
+	}
+	newPath := l.path(newName)
+	if err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
+		return err
+	}
+	// A part file left by an earlier upload of the name is in the way.
+	if err := os.Remove(newPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Link(l.path(oldName), newPath)
+}
+
+// copyStored copies the size bytes of the stored file oldName to newName.
+func copyStored(oldName, newName string, size int64) error {
+	src, err := storage.Open(oldName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := storage.Create(newName, size, true)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.NewOffsetWriter(dst, 0), io.LimitReader(src, size)); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,129 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// storeTestFile puts data into storage under name, as a finished upload.
+func storeTestFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	file, err := storage.Create(partName(name), int64(len(data)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAtFull(file, data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Rename(partName(name), name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readStored returns the content of the stored file name.
+func readStored(t *testing.T, name string) []byte {
+	t.Helper()
+	r, err := storage.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLinkStoredFileReconstructsHardLinks(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T) Storage
+		wantCopied bool
+	}{
+		{"local storage links", func(t *testing.T) Storage { return localStorage{root: t.TempDir()} }, false},
+		{"shards copy", func(t *testing.T) Storage { return newShardedStorage([]string{t.TempDir(), t.TempDir()}) }, true},
+		{"s3 copies", func(t *testing.T) Storage { s, _ := newTestS3(t); return s }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldStorage := storage
+			t.Cleanup(func() { storage = oldStorage })
+			storage = tt.setup(t)
+
+			data := testData(100)
+			storeTestFile(t, "tree/a.bin", data)
+			hasher, copied, err := linkStoredFile("tree/a.bin", "tree/sub/b.bin", int64(len(data)), sha256Hex(data), sha256.New)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if copied != tt.wantCopied {
+				t.Errorf("copied = %v, want %v", copied, tt.wantCopied)
+			}
+			if got := hex.EncodeToString(hasher.Sum(nil)); got != sha256Hex(data) {
+				t.Errorf("hasher has %s, want %s", got, sha256Hex(data))
+			}
+			if err := storage.Rename(partName("tree/sub/b.bin"), "tree/sub/b.bin"); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"tree/a.bin", "tree/sub/b.bin"} {
+				if got := readStored(t, name); !bytes.Equal(got, data) {
+					t.Errorf("%s holds %v, want %v", name, got, data)
+				}
+			}
+			if l, ok := storage.(localStorage); ok {
+				a, errA := os.Stat(l.path("tree/a.bin"))
+				b, errB := os.Stat(l.path("tree/sub/b.bin"))
+				if errA != nil || errB != nil || !os.SameFile(a, b) {
+					t.Errorf("tree/sub/b.bin is not a hard link to tree/a.bin (%v, %v)", errA, errB)
+				}
+			}
+		})
+	}
+}
+
+func TestLinkStoredFileRefusesOtherData(t *testing.T) {
+	data := testData(100)
+	tests := []struct {
+		name string
+		size int64
+		hash string
+	}{
+		{"other hash", 100, sha256Hex(testData(99))},
+		{"other size", 99, sha256Hex(data)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldStorage := storage
+			t.Cleanup(func() { storage = oldStorage })
+			root := t.TempDir()
+			storage = localStorage{root: root}
+
+			storeTestFile(t, "a.bin", data)
+			if _, _, err := linkStoredFile("a.bin", "b.bin", tt.size, tt.hash, sha256.New); err == nil {
+				t.Fatal("linked a file with other data")
+			}
+			// The upload that follows writes the part file, which must not
+			// be a link to a.bin any more.
+			if _, err := os.Stat(filepath.Join(root, partName("b.bin"))); !os.IsNotExist(err) {
+				t.Errorf("part file left behind: %v", err)
+			}
+			if got := readStored(t, "a.bin"); !bytes.Equal(got, data) {
+				t.Errorf("a.bin changed to %v", got)
+			}
+		})
+	}
+}
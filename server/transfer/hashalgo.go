@@ -0,0 +1,31 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"hash/crc32"
+	"sort"
+)
+
+// hashAlgorithms are the file hashes a client may pick with -hash; the
+// header's fieldHashAlgo names one of them. CRC32C is only for trusted
+// links: it catches corruption, not tampering.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// unsupportedHash rejects a header naming an algorithm not in hashAlgorithms.
+const unsupportedHash = "unsupported hash algorithm"
+
+// HashAlgorithms lists the hash algorithms the server accepts, sorted.
+func HashAlgorithms() []string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
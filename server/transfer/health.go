@@ -0,0 +1,85 @@
+package transfer
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// accepting is set while the listener takes connections, and draining once
+// a shutdown was requested. /healthz reports 503 unless accepting is set and
+// draining is not, so a load balancer stops sending new clients before the
+// listener closes.
+var accepting, draining atomic.Bool
+
+// checkHealth reports why the server should not get new clients, or nil.
+func checkHealth() error {
+	if draining.Load() {
+		return errors.New("shutting down")
+	}
+	if !accepting.Load() {
+		return errors.New("not accepting connections")
+	}
+	roots := localRoots()
+	if roots == nil {
+		// Remote backends spool nothing here, but the state files still
+		// live in storageDir.
+		roots = []string{storageDir}
+	}
+	for _, dir := range roots {
+		if err := probeWritable(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// probeWritable writes and removes one byte in dir, which also fails when
+// the disk is full, unlike creating an empty file.
+func probeWritable(dir string) error {
+	if free, ok := freeSpace(dir); ok && free == 0 {
+		return errors.New(dir + " is full")
+	}
+	probe, err := os.CreateTemp(dir, ".write-test-*")
+	if err != nil {
+		return errors.New(dir + " is not writable")
+	}
+	defer os.Remove(probe.Name())
+	_, err = probe.Write([]byte{0})
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New(dir + " is not writable")
+	}
+	return nil
+}
+
+// drain waits up to timeout for the transfers in progress to finish, then
+// saves the resume state so what is left can resume after a restart.
+func drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		clientsMu.Lock()
+		active := activeConnections
+		clientsMu.Unlock()
+		if active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			logWarn("drain timeout, exiting with transfers in progress", "active", active)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	saveState()
+	logInfo("server stopped")
+}
+
+// saveState writes out what persistResumeState and persistIPUsage would
+// have written on their next tick.
+func saveState() {
+	saveResumeState()
+	saveIPUsage()
+}
@@ -0,0 +1,169 @@
+package transfer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clientStats is one transfer in the /stats reply.
+type clientStats struct {
+	ID       string  `json:"id"`
+	IP       string  `json:"ip"`
+	FileName string  `json:"file_name"`
+	Status   string  `json:"status"`
+	Received int64   `json:"received"`
+	Size     int64   `json:"size"`
+	Speed    float64 `json:"speed"` // MB/s
+	Hash     string  `json:"hash,omitempty"`
+	Active   bool    `json:"active"`
+}
+
+// stats is the /stats reply.
+type stats struct {
+	ActiveConnections     int64         `json:"active_connections"`
+	TotalBytesTransferred int64         `json:"total_bytes_transferred"`
+	ServerStartTime       time.Time     `json:"server_start_time"`
+	Clients               []clientStats `json:"clients"`
+	// IPBytes is what each source IP has sent over the server's lifetime,
+	// across restarts.
+	IPBytes map[string]int64 `json:"ip_bytes"`
+}
+
+// newClientStats reports a speed only for active transfers; a finished
+// one receives nothing.
+func newClientStats(c *Client, active bool) clientStats {
+	s := clientStats{
+		ID:       c.ID,
+		IP:       c.IP,
+		FileName: c.FileName,
+		Status:   c.Status,
+		Received: c.Received,
+		Size:     c.FileSize,
+		Hash:     c.CalculatedHash,
+		Active:   active,
+	}
+	if active {
+		s.Speed = c.Speed()
+	}
+	return s
+}
+
+func currentStats() stats {
+	s := stats{ServerStartTime: serverStartTime, Clients: []clientStats{}, IPBytes: ipUsageSnapshot()}
+	mu.Lock()
+	s.TotalBytesTransferred = totalBytesTransferred
+	mu.Unlock()
+
+	clientsMu.Lock()
+	s.ActiveConnections = activeConnections
+	for _, c := range clients {
+		s.Clients = append(s.Clients, newClientStats(c, true))
+	}
+	clientsMu.Unlock()
+
+	completedClientsMu.Lock()
+	for _, c := range completedClients {
+		s.Clients = append(s.Clients, newClientStats(c, false))
+	}
+	completedClientsMu.Unlock()
+	return s
+}
+
+// withToken serves h only to requests carrying -token as "Authorization:
+// Bearer <token>". Without -token it serves h to anyone, unless guarded is
+// set: a handler that can stop transfers is then not served at all.
+func withToken(guarded bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(authToken) == 0 {
+			if guarded {
+				http.Error(w, "disabled, start the server with -token to enable it", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+			return
+		}
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), authToken) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, authFailed, http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// loopbackAddr reports whether the listen address addr only accepts
+// connections from this machine.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+// serveStats starts an HTTP listener on addr exposing /stats as JSON and
+// /metrics for Prometheus, for dashboards and alerting when the server runs
+// without a terminal, /incomplete listing the uploads that can be resumed
+// (see incomplete.go), POST /cancel?id=<client id> to abort an active
+// transfer, and /healthz for load balancers (see health.go). With -token,
+// /stats, /incomplete and /cancel, which name clients and files, need it as
+// a bearer token; without, /cancel is refused. It returns the listener.
+func serveStats(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(listener, statsHandler())
+	logInfo("serving statistics", "url", "http://"+addr+"/stats")
+	if len(authToken) == 0 && !loopbackAddr(addr) {
+		logWarn("without -token, /stats and /incomplete show client addresses and file names to anyone who can reach -http", "addr", addr)
+	}
+	return listener, nil
+}
+
+// statsHandler routes the endpoints serveStats listens for.
+func statsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", withToken(false, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentStats())
+	}))
+	mux.HandleFunc("/incomplete", withToken(false, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(incompleteUploads())
+	}))
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := checkHealth(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/cancel", withToken(true, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.FormValue("id")
+		if !cancelTransfer(id) {
+			http.Error(w, "no active transfer "+id, http.StatusNotFound)
+			return
+		}
+		logInfo("transfer cancelled via HTTP", "transfer", id, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return mux
+}
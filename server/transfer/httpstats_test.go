@@ -0,0 +1,63 @@
+package transfer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		guarded bool
+		header  string
+		want    int
+	}{
+		{"no token, open endpoint", "", false, "", http.StatusOK},
+		{"no token, guarded endpoint", "", true, "", http.StatusForbidden},
+		{"no token, guarded endpoint with a bearer", "", true, "Bearer s3cret", http.StatusForbidden},
+		{"token missing", "s3cret", false, "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", true, "Bearer wrong", http.StatusUnauthorized},
+		{"not a bearer", "s3cret", true, "Basic s3cret", http.StatusUnauthorized},
+		{"right token", "s3cret", true, "Bearer s3cret", http.StatusOK},
+		{"right token, open endpoint", "s3cret", false, "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldToken := authToken
+			t.Cleanup(func() { authToken = oldToken })
+			authToken = []byte(tt.token)
+
+			h := withToken(tt.guarded, func(w http.ResponseWriter, r *http.Request) {})
+			r := httptest.NewRequest(http.MethodPost, "/cancel?id=1", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"192.0.2.1:8080", false},
+	}
+	for _, tt := range tests {
+		if got := loopbackAddr(tt.addr); got != tt.want {
+			t.Errorf("loopbackAddr(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
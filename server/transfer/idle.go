@@ -0,0 +1,40 @@
+package transfer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// idleTimeout disconnects a client that sends nothing for this long, whether
+// it stalls before its header, between files or in the middle of one
+// (-idle-timeout). 0 waits forever.
+var idleTimeout = DefaultIdleTimeout
+
+// statusTimedOut marks a transfer whose client went quiet for idleTimeout.
+const statusTimedOut = "超时"
+
+// refreshIdleDeadline gives conn another idleTimeout to deliver data.
+func refreshIdleDeadline(conn net.Conn) {
+	if idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	}
+}
+
+// refreshDeadline is refreshIdleDeadline for a running transfer. It must
+// not undo the deadline cancelTransfer sets to wake the read loop, so a
+// transfer cancelled meanwhile gets that deadline back.
+func (c *Client) refreshDeadline() {
+	refreshIdleDeadline(c.conn)
+	if c.cancelled() {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// isTimeout reports whether err is the idle deadline expiring. A dead peer
+// found by keepalive (see keepalive.go) also reports a timeout, ETIMEDOUT,
+// but that is a broken connection rather than an idle client.
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,125 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// partialSizes remembers the size each partial upload announced, which
+// fileState alone does not know, so incompleteUploads can tell how much is
+// missing. It is saved with the resume state.
+var partialSizes sync.Map // resumeTarget -> int64
+
+// recordPartialSize notes that the upload of name with hash is fileSize
+// bytes in total.
+func recordPartialSize(name, hash string, fileSize int64) {
+	partialSizes.Store(resumeTarget{name: name, hash: strings.ToLower(hash)}, fileSize)
+}
+
+// partialSize returns the recorded size of the upload of name with hash, or
+// -1 if it is unknown.
+func partialSize(name, hash string) int64 {
+	if size, ok := partialSizes.Load(resumeTarget{name: name, hash: hash}); ok {
+		return size.(int64)
+	}
+	return -1
+}
+
+// prunePartialSizes drops the sizes of files that have no resume state left.
+func prunePartialSizes() {
+	live := make(map[resumeTarget]bool)
+	fileState.Range(func(key, _ interface{}) bool {
+		k := key.(resumeKey)
+		live[resumeTarget{name: k.name, hash: k.hash}] = true
+		return true
+	})
+	partialSizes.Range(func(key, _ interface{}) bool {
+		if target := key.(resumeTarget); !live[target] && !uploadActive(target.name) {
+			partialSizes.Delete(key)
+		}
+		return true
+	})
+}
+
+// incompleteUpload is one entry of the /incomplete reply and of
+// -list-incomplete: a file whose upload stopped, or is still going, before
+// all of it arrived.
+type incompleteUpload struct {
+	Name     string `json:"name"`
+	Hash     string `json:"hash"`
+	Received int64  `json:"received"`
+	// Size is -1 for uploads saved by a server that did not record it.
+	Size int64 `json:"size"`
+	// LastWrite is when the part file last changed, zero if it is gone.
+	LastWrite   time.Time `json:"last_write"`
+	IdleSeconds float64   `json:"idle_seconds"`
+	Active      bool      `json:"active"`
+}
+
+// incompleteUploads lists the uploads fileState can resume, by name. The
+// ranges of a parallel upload add up to one entry.
+func incompleteUploads() []incompleteUpload {
+	received := make(map[resumeTarget]int64)
+	fileState.Range(func(key, value interface{}) bool {
+		k := key.(resumeKey)
+		received[resumeTarget{name: k.name, hash: k.hash}] += value.(int64)
+		return true
+	})
+	now := time.Now()
+	uploads := []incompleteUpload{}
+	for target, n := range received {
+		size := partialSize(target.name, target.hash)
+		if size >= 0 && n >= size {
+			continue
+		}
+		u := incompleteUpload{Name: target.name, Hash: target.hash, Received: n, Size: size, Active: uploadActive(target.name)}
+		if info, err := storage.Stat(partName(target.name)); err == nil {
+			u.LastWrite = info.ModTime()
+			u.IdleSeconds = now.Sub(u.LastWrite).Seconds()
+		}
+		uploads = append(uploads, u)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Name != uploads[j].Name {
+			return uploads[i].Name < uploads[j].Name
+		}
+		return uploads[i].Hash < uploads[j].Hash
+	})
+	return uploads
+}
+
+// printIncomplete writes incompleteUploads as a table, for -list-incomplete.
+func printIncomplete(w io.Writer) error {
+	uploads := incompleteUploads()
+	if len(uploads) == 0 {
+		_, err := fmt.Fprintln(w, "No incomplete uploads.")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tRECEIVED\tSIZE\tLAST BYTE")
+	for _, u := range uploads {
+		size := "unknown"
+		if u.Size >= 0 {
+			size = fmt.Sprintf("%s (%.1f%%)", formatBytes(u.Size), percentOf(u.Received, u.Size))
+		}
+		idle := "part file missing"
+		if !u.LastWrite.IsZero() {
+			idle = time.Duration(u.IdleSeconds*float64(time.Second)).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Name, formatBytes(u.Received), size, idle)
+	}
+	return tw.Flush()
+}
+
+// percentOf returns n as a percentage of total, 100 for an empty total.
+func percentOf(n, total int64) float64 {
+	if total <= 0 {
+		return 100
+	}
+	return float64(n) * 100 / float64(total)
+}
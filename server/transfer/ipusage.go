@@ -0,0 +1,90 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ipUsageFile keeps ipBytes across restarts, next to resumeStateFile in
+// storageDir, so uploads cannot use this name either.
+const ipUsageFile = ".ip-usage.json"
+
+func ipUsagePath() string {
+	return filepath.Join(storageDir, ipUsageFile)
+}
+
+// loadIPUsage adds the saved per-IP totals to ipBytes.
+func loadIPUsage() error {
+	data, err := os.ReadFile(ipUsagePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved map[string]int64
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for ip, n := range saved {
+		ipBytes[ip] += n
+	}
+	return nil
+}
+
+// ipUsageSnapshot copies ipBytes.
+func ipUsageSnapshot() map[string]int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	usage := make(map[string]int64, len(ipBytes))
+	for ip, n := range ipBytes {
+		usage[ip] = n
+	}
+	return usage
+}
+
+// persistIPUsage writes ipBytes out every interval when it changed, the
+// same way persistResumeState does.
+func persistIPUsage(interval time.Duration, stop <-chan struct{}) {
+	var last []byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		data, err := json.MarshalIndent(ipUsageSnapshot(), "", "  ")
+		if err != nil {
+			logError("failed to encode per-IP usage", "err", err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		if err := writeStateFile(ipUsagePath(), data); err != nil {
+			logError("failed to save per-IP usage", "err", err)
+			continue
+		}
+		last = data
+	}
+}
+
+// saveIPUsage writes ipBytes out once, on shutdown.
+func saveIPUsage() {
+	data, err := json.MarshalIndent(ipUsageSnapshot(), "", "  ")
+	if err == nil {
+		err = writeStateFile(ipUsagePath(), data)
+	}
+	if err != nil {
+		logError("failed to save per-IP usage", "err", err)
+	}
+}
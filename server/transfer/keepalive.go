@@ -0,0 +1,38 @@
+package transfer
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// keepAlivePeriod is how long a connection may sit silent before TCP
+// keepalive probes check that the client is still there, and the interval
+// between probes (-keepalive). A client that vanished without closing its
+// connection (power loss, a dropped link) is then noticed after
+// keepAliveProbes unanswered probes instead of the system's TCP timeout.
+// 0 turns keepalive off.
+var keepAlivePeriod = DefaultKeepAlive
+
+// keepAliveProbes is how many probes go unanswered before the connection is
+// given up, where the platform lets us set it (see keepalive_linux.go).
+const keepAliveProbes = 3
+
+// setKeepAlive applies keepAlivePeriod to an accepted connection.
+func setKeepAlive(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if keepAlivePeriod <= 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(keepAlivePeriod)
+	if err := setKeepAliveProbes(tcpConn, keepAlivePeriod); err != nil {
+		logWarn("cannot set the keepalive probe interval", "client_ip", conn.RemoteAddr(), "err", err)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package transfer
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// setKeepAliveProbes sends conn's keepalive probes every interval and gives
+// up after keepAliveProbes of them. SetKeepAlivePeriod alone only sets the
+// idle time before the first probe on newer Go releases, leaving the
+// interval and count at their much longer defaults.
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration) error {
+	secs := int(interval / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+		if sockErr == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, keepAliveProbes)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
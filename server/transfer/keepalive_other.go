@@ -0,0 +1,14 @@
+//go:build !linux
+
+package transfer
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAliveProbes leaves the probe interval and count to the system on
+// platforms where the net package gives no way to set them.
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration) error {
+	return nil
+}
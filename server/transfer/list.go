@@ -0,0 +1,113 @@
+package transfer
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listRequest starts a header asking for the files in the storage
+// directory instead of sending one.
+const listRequest = "LIST"
+
+// List header fields, in wire order.
+const (
+	lsFieldType    = iota // listRequest
+	lsFieldVersion        // ProtocolVersion
+	lsFieldAuth           // HMAC of the fields before it, see -token
+	listFields
+)
+
+// listUnsupported rejects a listing when files are not kept on local disk.
+const listUnsupported = "listing not supported by this storage"
+
+// handleList walks the storage directories and sends one frame per stored
+// file, "size|hashAlgo|hash|name", then an empty frame. name is
+// slash-separated and relative to its -dir shard, and comes last as it may contain "|". The
+// hash is that of the latest completed transfer in -manifest, and empty
+// without one or when the file's size no longer matches it. Part files and
+// the server's own files are left out. It reports whether the connection
+// is still in step.
+func handleList(conn net.Conn, clientIP string, info []string, tlog *transferLog) bool {
+	if len(info) != listFields {
+		tlog.Warn("malformed list request", "client_ip", clientIP, "fields", len(info))
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+	if version, err := strconv.Atoi(info[lsFieldVersion]); err != nil || version != ProtocolVersion {
+		tlog.Warn("unsupported protocol version", "client_ip", clientIP, "version", info[lsFieldVersion])
+		rejectConnection(conn, fmt.Sprintf("%s %s, server speaks %d", protocolMismatch, info[lsFieldVersion], ProtocolVersion))
+		return false
+	}
+	if !authenticate(strings.Join(info[:lsFieldAuth], "|"), info[lsFieldAuth]) {
+		tlog.Warn("rejected list request with invalid token HMAC", "client_ip", clientIP)
+		rejectConnection(conn, authFailed)
+		return false
+	}
+	roots := localRoots()
+	if roots == nil {
+		tlog.Warn("rejected list request for non-local storage", "client_ip", clientIP)
+		rejectConnection(conn, listUnsupported)
+		return false
+	}
+	hashes, err := storedHashes()
+	if err != nil {
+		// The listing is still useful without hashes.
+		tlog.Warn("cannot read the manifest for the listing", "client_ip", clientIP, "err", err)
+	}
+	manifestAbs, _ := filepath.Abs(manifestPath)
+
+	files := 0
+	for _, root := range roots {
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Skip what cannot be read rather than failing the listing.
+				tlog.Warn("cannot list", "client_ip", clientIP, "path", p, "err", err)
+				if d != nil && d.IsDir() && p != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return nil
+			}
+			name := filepath.ToSlash(rel)
+			if reservedName(name) || strings.HasSuffix(name, partSuffix) {
+				return nil
+			}
+			if abs, _ := filepath.Abs(p); manifestPath != "" && abs == manifestAbs {
+				return nil
+			}
+			stat, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			algo, hash := "", ""
+			if record, ok := hashes[name]; ok && record.FileSize == stat.Size() {
+				algo, hash = record.HashAlgorithm, record.Hash
+			}
+			entry := strings.Join([]string{strconv.FormatInt(stat.Size(), 10), algo, hash, name}, "|")
+			files++
+			return writeFrame(conn, []byte(entry))
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writeFrame(conn, nil)
+	}
+	if err != nil {
+		tlog.Warn("error sending file list", "client_ip", clientIP, "err", err)
+		return false
+	}
+	tlog.Info("sent file list", "client_ip", clientIP, "files", files)
+	return true
+}
@@ -0,0 +1,92 @@
+package transfer
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// logLevel orders server.log messages by severity; -loglevel drops the ones
+// below it.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// minLogLevel is set from -loglevel.
+var minLogLevel = levelInfo
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(logLevelNames[:], ", "))
+}
+
+// formatLogLine renders msg and its key/value pairs as
+//
+//	level=info msg="transfer started" client_ip=10.0.0.2:51234 file=a.bin size=1024
+//
+// quoting values that contain spaces, quotes or '=' so every line splits
+// the same way.
+func formatLogLine(level logLevel, msg string, kv []interface{}) string {
+	var b strings.Builder
+	b.WriteString("level=")
+	b.WriteString(level.String())
+	b.WriteString(" msg=")
+	b.WriteString(strconv.Quote(msg))
+	for i := 0; i < len(kv); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		b.WriteString(logValue(value))
+	}
+	return b.String()
+}
+
+func logValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// logAt writes one line to server.log. depth is the number of frames
+// between the caller being logged and logAt.
+func logAt(depth int, level logLevel, msg string, kv []interface{}) (string, bool) {
+	if level < minLogLevel {
+		return "", false
+	}
+	line := formatLogLine(level, msg, kv)
+	log.Output(depth+2, line)
+	return line, true
+}
+
+func logDebug(msg string, kv ...interface{}) { logAt(1, levelDebug, msg, kv) }
+func logInfo(msg string, kv ...interface{})  { logAt(1, levelInfo, msg, kv) }
+func logWarn(msg string, kv ...interface{})  { logAt(1, levelWarn, msg, kv) }
+func logError(msg string, kv ...interface{}) { logAt(1, levelError, msg, kv) }
+
+// LogInfo, LogWarn and LogError write msg and its key/value pairs to the
+// standard logger in the server's own format, for programs embedding it.
+func LogInfo(msg string, kv ...interface{})  { logAt(1, levelInfo, msg, kv) }
+func LogWarn(msg string, kv ...interface{})  { logAt(1, levelWarn, msg, kv) }
+func LogError(msg string, kv ...interface{}) { logAt(1, levelError, msg, kv) }
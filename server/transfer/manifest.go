@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// manifestPath is the audit log of finished transfers (-manifest), one
+// JSON record per line. Empty disables it.
+var manifestPath string
+
+// manifestMu keeps records from concurrent transfers on separate lines.
+var manifestMu sync.Mutex
+
+// manifestRecord describes one finished transfer. Hash is what the server
+// calculated with HashAlgorithm; the file was stored under FileName only if
+// Status is 传输完成.
+type manifestRecord struct {
+	TransferID    string    `json:"transfer_id"`
+	FileName      string    `json:"file_name"`
+	FileSize      int64     `json:"file_size"`
+	Received      int64     `json:"received"`
+	Hash          string    `json:"hash,omitempty"`
+	HashAlgorithm string    `json:"hash_algorithm"`
+	Signer        string    `json:"signer,omitempty"`
+	ClientIP      string    `json:"client_ip"`
+	StartTime     time.Time `json:"start_time"`
+	EndTime       time.Time `json:"end_time"`
+	Status        string    `json:"status"`
+	Shard         string    `json:"shard,omitempty"` // -dir directory holding the file, when several are given
+}
+
+// recordManifest appends the final state of client to the manifest. Each
+// record is written with a single append and synced before returning, so
+// a reader never sees half of one unless the machine dies mid-write.
+func recordManifest(client *Client, fileSize int64) error {
+	if manifestPath == "" {
+		return nil
+	}
+	line, err := json.Marshal(manifestRecord{
+		TransferID:    client.ID,
+		FileName:      client.FileName,
+		FileSize:      fileSize,
+		Received:      client.Received,
+		Hash:          client.CalculatedHash,
+		HashAlgorithm: client.HashAlgorithm,
+		Signer:        client.Signer,
+		ClientIP:      client.IP,
+		StartTime:     client.StartTime,
+		EndTime:       time.Now(),
+		Status:        client.Status,
+		Shard:         shardOf(client.FileName),
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	file, err := os.OpenFile(manifestPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// storedHashes returns, by file name, the latest manifest record of a
+// completed transfer, or nil without -manifest. Lines that do not parse are
+// skipped, so a record cut short by a crash costs only that record.
+func storedHashes() (map[string]manifestRecord, error) {
+	if manifestPath == "" {
+		return nil, nil
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	file, err := os.Open(manifestPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make(map[string]manifestRecord)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record manifestRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil || record.Status != "传输完成" || record.Hash == "" {
+			continue
+		}
+		records[record.FileName] = record
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,48 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+)
+
+// Finished uploads since the server started, for /metrics. A range of a
+// parallel upload is not a transfer of its own; the range that completes
+// the file counts for all of them. Guarded by mu.
+var (
+	transfersTotal  int64
+	transfersFailed int64
+)
+
+// countTransfer records the final status of an upload.
+func countTransfer(status string) {
+	if status == "分段完成" {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	transfersTotal++
+	if status != "传输完成" {
+		transfersFailed++
+	}
+}
+
+// writeMetrics writes the server's counters in the Prometheus text
+// exposition format.
+func writeMetrics(w io.Writer) {
+	mu.Lock()
+	total, failed, received := transfersTotal, transfersFailed, totalBytesTransferred
+	mu.Unlock()
+
+	clientsMu.Lock()
+	active := activeConnections
+	clientsMu.Unlock()
+
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("eilecores_transfers_total", "counter", "Uploads finished, successfully or not.", total)
+	metric("eilecores_transfers_failed_total", "counter", "Uploads that did not end with a verified file.", failed)
+	metric("eilecores_received_bytes_total", "counter", "File data received from clients.", received)
+	metric("eilecores_active_connections", "gauge", "Uploads in progress.", active)
+	metric("eilecores_receive_speed_bytes_per_second", "gauge", "Combined receive speed of the uploads in progress, in bytes per second.", receiveSpeed.Rate())
+}
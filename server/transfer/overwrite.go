@@ -0,0 +1,55 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Values of -overwrite, deciding what happens when an upload's file already
+// exists.
+const (
+	overwriteAlways = "always" // replace it
+	overwriteNever  = "never"  // refuse the upload
+	overwriteRename = "rename" // store the upload as name(1).ext, name(2).ext, ...
+)
+
+var overwritePolicy = overwriteAlways
+
+// fileExists rejects an upload under -overwrite never.
+const fileExists = "file exists"
+
+var errFileExists = errors.New("file already exists")
+
+func validOverwritePolicy(policy string) bool {
+	switch policy {
+	case overwriteAlways, overwriteNever, overwriteRename:
+		return true
+	}
+	return false
+}
+
+// resolveOverwrite applies overwritePolicy to an upload of name and returns
+// the name to store it under.
+func resolveOverwrite(name string) (string, error) {
+	if overwritePolicy == overwriteAlways || !storedFileExists(name) {
+		return name, nil
+	}
+	if overwritePolicy == overwriteNever {
+		return "", errFileExists
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s(%d)%s", base, i, ext)
+		if !storedFileExists(candidate) {
+			return candidate, nil
+		}
+	}
+}
+
+func storedFileExists(name string) bool {
+	_, err := storage.Stat(name)
+	return err == nil
+}
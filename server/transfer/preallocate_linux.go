@@ -0,0 +1,23 @@
+//go:build linux
+
+package transfer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE: reserve blocks without changing the
+// file length, so resume offsets and hashes still see only written bytes.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes for f. Running out of space is reported;
+// filesystems without fallocate support are silently skipped.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package transfer
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// usePreallocate turns -preallocate on for the test.
+func usePreallocate(t *testing.T) {
+	t.Helper()
+	old := preallocateFiles
+	t.Cleanup(func() { preallocateFiles = old })
+	preallocateFiles = true
+}
+
+// TestPreallocate checks that -preallocate reserves the whole file's blocks
+// up front without changing its length, and that an upload into the
+// reserved file, fresh or resumed, stores exactly the data sent.
+func TestPreallocate(t *testing.T) {
+	useTestStorage(t, "")
+	usePreallocate(t)
+	data := testData(3 << 20)
+
+	file, err := storage.Create(partName("x.bin"), int64(len(data)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := file.(*os.File).Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated := info.Sys().(*syscall.Stat_t).Blocks * 512
+	if allocated == 0 {
+		file.Close()
+		t.Skip("the file system does not support fallocate")
+	}
+	if allocated < int64(len(data)) {
+		t.Errorf("%d bytes allocated, want at least %d", allocated, len(data))
+	}
+	if info.Size() != 0 {
+		t.Errorf("preallocated file is %d bytes long, want 0", info.Size())
+	}
+	writeAtFull(file, data[:4000], 0)
+	file.Close()
+	fileState.Store(newResumeKey("x.bin", sha256Hex(data), 0), int64(4000))
+
+	reply, result := upload(t, uploadHeader("x.bin", data), data)
+	if want := "4000|" + sha256Hex(data[:4000]) + "|"; reply != want {
+		t.Fatalf("reply %q, want %q", reply, want)
+	}
+	if !strings.HasPrefix(result, "传输完成|") {
+		t.Fatalf("result %q, want the upload completed", result)
+	}
+	if got := readStored(t, "x.bin"); sha256Hex(got) != sha256Hex(data) {
+		t.Errorf("stored %d bytes that differ from the upload", len(got))
+	}
+
+	// A fresh upload into a preallocated part file.
+	other := testData(100000)
+	if _, result := upload(t, uploadHeader("y.bin", other), other); !strings.HasPrefix(result, "传输完成|") {
+		t.Fatalf("result %q, want the upload completed", result)
+	}
+	if got := readStored(t, "y.bin"); sha256Hex(got) != sha256Hex(other) {
+		t.Errorf("stored %d bytes that differ from the upload", len(got))
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package transfer
+
+import "os"
+
+// preallocate is a no-op where the file length cannot be reserved without
+// also changing it, which would confuse resume.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
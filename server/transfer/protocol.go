@@ -0,0 +1,118 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Wire format of one transfer, shared with the client's transfer/protocol.go:
+//
+//	client: 4-byte big-endian length, then the info header, whose
+//	        "|"-separated fields are listed below
+//	server: a rejection reason, or "offset|prefix|storedAs" framed with
+//	        the same 4-byte length: the resume offset as decimal ASCII;
+//	        past the start of the range, the hex hash of the bytes
+//	        already received, which the client checks against its own
+//	        before resuming; and the name the file is stored under if
+//	        -overwrite rename chose a new one. Empty fields stay empty
+//	client: file data from the offset, the hex hash, and for signed
+//	        transfers a 4-byte length plus the signature. A stream, whose
+//	        size field is -1, sends its data as length-prefixed chunks
+//	        ended by an empty one, see stream.go; a compressed upload as
+//	        length-prefixed deflate chunks, see compress.go; a sparse
+//	        upload as length-prefixed chunks and holes, see sparse.go
+//	server: the result, "status|hash" with the transfer's final status
+//	        and the hash the server calculated (empty if it did not get
+//	        that far), framed like the offset
+//
+// When an unsigned whole-file upload resumes at the end of the file and the
+// prefix hash equals the header's hash, the server already has the file:
+// the client sends no data, hash or signature, and the result follows the
+// offset reply directly. A header naming a stored file in fieldLinkTo gets
+// the same reply once that file has been linked or copied, see hardlink.go.
+//
+// A header of statusRequest, followed by "|" and its HMAC when a token is
+// in use, asks for the server status instead.
+//
+// A download header, downloadRequest followed by the fields listed in
+// download.go, asks for a stored file instead:
+//
+//	server: a rejection reason, or "offset|size|hash|prefix" framed like
+//	        the offset above: where the data starts (the client's offset,
+//	        or 0 if the server cannot resume from it), the file's size and
+//	        hex SHA-256, and the hash of the bytes before the offset
+//	server: the file data from the offset to the end
+//
+// A verify header, verifyRequest followed by the fields listed in
+// verifyonly.go, asks the server to check a stored file against the
+// client's hash:
+//
+//	server: a rejection reason, or "result|hash|size" framed like the
+//	        offset above: "match" or "mismatch", and the hash and size of
+//	        the stored file
+//
+// A list header, listRequest followed by the fields listed in list.go,
+// asks for the stored files:
+//
+//	server: a rejection reason, or one "size|hashAlgo|hash|name" frame
+//	        per file followed by an empty frame; see handleList
+//
+// A blocks header, blocksRequest followed by the fields listed in
+// smartresume.go, asks for the hashes of the data an upload would resume
+// from:
+//
+//	server: a rejection reason, or the absolute resume offset framed like
+//	        the offset above, then one frame per block of the part file up
+//	        to that offset with the block's hex hash, then an empty frame.
+//	        The client resumes its next upload no further than the first
+//	        block that differs, by sending it as fieldResumeLimit
+
+// ProtocolVersion is the first field of every info header. A server only
+// accepts headers carrying its own version.
+const ProtocolVersion = 20
+
+// Info header fields, in wire order.
+const (
+	fieldVersion = iota
+	fieldName
+	fieldSize
+	fieldHash
+	fieldResume
+	fieldSigned
+	fieldIfMatch
+	fieldGroup       // parallel transfer group ID, empty for a whole file
+	fieldRangeStart  // first byte of this connection's range
+	fieldRangeEnd    // end of the range (exclusive)
+	fieldReliable    // "true" for CRC-checked, acknowledged chunks, see reliable.go
+	fieldModTime     // source mtime in Unix nanoseconds, empty to keep the server's
+	fieldHashAlgo    // algorithm of fieldHash and the trailer, see hashalgo.go
+	fieldDest        // subdirectory of the storage directory, empty for its root
+	fieldTransferID  // client's UUID for this upload, see transferid.go; may be empty
+	fieldCompress    // compressDeflate for compressed chunks, see compress.go; may be empty
+	fieldResumeLimit // absolute offset not to resume beyond, see smartresume.go; may be empty
+	fieldSparse      // "true" for chunks that may skip runs of zeros, see sparse.go
+	fieldLinkTo      // stored file this one is a hard link to, see hardlink.go; may be empty
+	fieldAuth        // HMAC of the fields before it, see -token
+	headerFields     // number of fields
+)
+
+// maxInfoLen bounds the info header, or any other request, a client may
+// send; real ones are a few hundred bytes.
+const maxInfoLen = 64 * 1024
+
+// authFailed rejects a header whose HMAC does not match -token.
+const authFailed = "authentication failed"
+
+// protocolMismatch starts the rejection sent for an unsupported version.
+const protocolMismatch = "unsupported protocol version"
+
+// writeFrame writes payload prefixed with its 4-byte big-endian length.
+func writeFrame(w io.Writer, payload []byte) error {
+	lengthBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBuf, uint32(len(payload)))
+	if _, err := w.Write(lengthBuf); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
@@ -0,0 +1,157 @@
+package transfer
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// maxFileSize refuses files larger than this (-maxsize), 0 means no limit.
+	maxFileSize int64
+	// quotaBytes caps the total size of the storage directories (-quota), 0
+	// means no limit.
+	quotaBytes int64
+
+	quotaMu sync.Mutex
+	// reservedBytes is what running transfers may still write, so that
+	// concurrent uploads cannot overshoot the quota together.
+	reservedBytes int64
+	// usedBytes is what storageUsage last found, and settledBytes what
+	// transfers reserved and finished since that walk started; their data
+	// is on disk but may not have been counted yet.
+	usedBytes, settledBytes int64
+	usedAt                  time.Time
+
+	// usageMu lets one walk of the storage directories run at a time.
+	usageMu sync.Mutex
+)
+
+// usageRefresh is how long reserveSpace trusts the last storageUsage. A
+// walk of a large storage tree is slow, and settledBytes covers the
+// transfers that finished since.
+const usageRefresh = 10 * time.Second
+
+// storageUsage sums the sizes of all files under the storage directories.
+func storageUsage() (int64, error) {
+	var total int64
+	for _, root := range localRoots() {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				total += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// reservationStep is how much quota a stream, whose size is unknown, holds
+// at a time.
+const reservationStep = 64 * 1024 * 1024
+
+// spaceReservation holds quota for a transfer that only learns its size as
+// the data arrives, taking it in reservationStep increments.
+type spaceReservation struct {
+	held     int64
+	releases []func()
+}
+
+// grow makes sure at least total bytes are held.
+func (r *spaceReservation) grow(total int64) error {
+	for r.held < total {
+		release, err := reserveSpace(reservationStep)
+		if err != nil {
+			return err
+		}
+		r.releases = append(r.releases, release)
+		r.held += reservationStep
+	}
+	return nil
+}
+
+func (r *spaceReservation) release() {
+	for _, release := range r.releases {
+		release()
+	}
+}
+
+// reserveWrite reserves the space a transfer writing the bytes of name
+// from from to end can still add. Only what lies beyond the part file's
+// current size grows the storage: the bytes below it are already counted,
+// whether written by an earlier attempt, another range or -preallocate.
+func reserveWrite(name string, from, end int64) (release func(), err error) {
+	if quotaBytes <= 0 {
+		return func() {}, nil
+	}
+	if info, err := storage.Stat(partName(name)); err == nil && info.Size() > from {
+		from = info.Size()
+	}
+	if from >= end {
+		return func() {}, nil
+	}
+	return reserveSpace(end - from)
+}
+
+// reserveSpace checks that a transfer still needing need bytes fits in the
+// quota and holds them until release is called.
+func reserveSpace(need int64) (release func(), err error) {
+	if quotaBytes <= 0 {
+		return func() {}, nil
+	}
+	if err := refreshUsage(); err != nil {
+		return nil, err
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	used := usedBytes + settledBytes
+	if used+reservedBytes+need > quotaBytes {
+		return nil, fmt.Errorf("%s used, %s reserved, %s needed of %s quota",
+			formatBytes(used), formatBytes(reservedBytes), formatBytes(need), formatBytes(quotaBytes))
+	}
+	reservedBytes += need
+	return func() {
+		quotaMu.Lock()
+		reservedBytes -= need
+		settledBytes += need
+		quotaMu.Unlock()
+	}, nil
+}
+
+// refreshUsage walks the storage directories again once the last walk is
+// older than usageRefresh. The walk runs without quotaMu, so reservations
+// and releases carry on meanwhile.
+func refreshUsage() error {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	quotaMu.Lock()
+	fresh := time.Since(usedAt) < usageRefresh
+	settled := settledBytes
+	quotaMu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	used, err := storageUsage()
+	if err != nil {
+		return err
+	}
+	quotaMu.Lock()
+	usedBytes, usedAt = used, time.Now()
+	// Those transfers finished before the walk began, so it counted them.
+	settledBytes -= settled
+	quotaMu.Unlock()
+	return nil
+}
@@ -0,0 +1,86 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestQuota stores files in a temporary directory with a quota of quota
+// bytes and no reservations.
+func useTestQuota(t *testing.T, quota int64) string {
+	t.Helper()
+	root := t.TempDir()
+	oldStorage, oldQuota := storage, quotaBytes
+	t.Cleanup(func() {
+		storage, quotaBytes = oldStorage, oldQuota
+		reservedBytes, usedBytes, settledBytes, usedAt = 0, 0, 0, time.Time{}
+	})
+	storage, quotaBytes = localStorage{root: root}, quota
+	reservedBytes, usedBytes, settledBytes, usedAt = 0, 0, 0, time.Time{}
+	return root
+}
+
+func TestReserveWrite(t *testing.T) {
+	tests := []struct {
+		name         string
+		partSize     int64 // -1 for no part file
+		from, end    int64
+		wantReserved int64
+	}{
+		{"new upload", -1, 0, 100, 100},
+		{"resumed upload", 40, 40, 100, 60},
+		{"preallocated part file", 100, 40, 100, 0},
+		{"range below the part file's end", 100, 0, 50, 0},
+		{"last range past the part file's end", 50, 25, 100, 50},
+		{"fresh upload over a longer part file", 80, 0, 100, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := useTestQuota(t, 1000)
+			if tt.partSize >= 0 {
+				if err := os.WriteFile(filepath.Join(root, "f.part"), make([]byte, tt.partSize), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			release, err := reserveWrite("f", tt.from, tt.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reservedBytes != tt.wantReserved {
+				t.Errorf("reserved %d bytes, want %d", reservedBytes, tt.wantReserved)
+			}
+			release()
+			if reservedBytes != 0 {
+				t.Errorf("%d bytes still reserved after release", reservedBytes)
+			}
+		})
+	}
+}
+
+func TestReserveSpaceCountsFinishedTransfers(t *testing.T) {
+	root := useTestQuota(t, 100)
+	if err := os.WriteFile(filepath.Join(root, "stored"), make([]byte, 30), 0644); err != nil {
+		t.Fatal(err)
+	}
+	release, err := reserveSpace(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserveSpace(21); err == nil {
+		t.Fatal("reserved past the quota next to a running transfer")
+	}
+	// The finished transfer's data is not walked yet, but still counts.
+	release()
+	if _, err := reserveSpace(21); err == nil {
+		t.Fatal("reserved past the quota before the finished transfer was measured")
+	}
+	if err := os.WriteFile(filepath.Join(root, "finished"), make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	usedAt = time.Time{}
+	if _, err := reserveSpace(60); err != nil {
+		t.Fatalf("measured usage kept the finished reservation: %v", err)
+	}
+}
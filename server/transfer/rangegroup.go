@@ -0,0 +1,69 @@
+package transfer
+
+import "sync"
+
+// rangeGroupKey identifies one parallel transfer. The group ID comes from
+// the client, so the file it is for is part of the key as well.
+type rangeGroupKey struct {
+	group string
+	name  string
+	hash  string
+}
+
+var (
+	rangeGroupsMu sync.Mutex
+	// rangeGroups holds, per parallel transfer, the end of every range that
+	// has arrived, keyed by its start.
+	rangeGroups = make(map[rangeGroupKey]map[int64]int64)
+)
+
+// finishRange records [start, end) of a parallel transfer as received and
+// reports whether the file of size bytes is now complete, in which case the
+// group is forgotten. A range that is sent again is only counted once.
+func finishRange(key rangeGroupKey, start, end, size int64) bool {
+	rangeGroupsMu.Lock()
+	defer rangeGroupsMu.Unlock()
+
+	ranges := rangeGroups[key]
+	if ranges == nil {
+		// The upload claim lets one group at a time write a file, so any
+		// other group for it was abandoned. A client that starts over
+		// sends every range again under its new group.
+		for other := range rangeGroups {
+			if other.name == key.name {
+				delete(rangeGroups, other)
+			}
+		}
+		ranges = make(map[int64]int64)
+		rangeGroups[key] = ranges
+	}
+	ranges[start] = end
+
+	var received int64
+	for s, e := range ranges {
+		received += e - s
+	}
+	if received < size {
+		return false
+	}
+	delete(rangeGroups, key)
+	return true
+}
+
+// pruneRangeGroups drops the groups of abandoned parallel transfers whose
+// file has no resume state left.
+func pruneRangeGroups() {
+	live := make(map[resumeTarget]bool)
+	fileState.Range(func(key, _ interface{}) bool {
+		k := key.(resumeKey)
+		live[resumeTarget{name: k.name, hash: k.hash}] = true
+		return true
+	})
+	rangeGroupsMu.Lock()
+	defer rangeGroupsMu.Unlock()
+	for key := range rangeGroups {
+		if !live[resumeTarget{name: key.name, hash: key.hash}] && !uploadActive(key.name) {
+			delete(rangeGroups, key)
+		}
+	}
+}
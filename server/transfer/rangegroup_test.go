@@ -0,0 +1,51 @@
+package transfer
+
+import "testing"
+
+func TestFinishRange(t *testing.T) {
+	type call struct {
+		group      string
+		start, end int64
+		want       bool
+	}
+	tests := []struct {
+		name  string
+		calls []call
+	}{
+		{"in order", []call{{"g", 0, 50, false}, {"g", 50, 100, true}}},
+		{"out of order", []call{{"g", 50, 100, false}, {"g", 0, 50, true}}},
+		{"range sent twice", []call{{"g", 0, 50, false}, {"g", 0, 50, false}, {"g", 50, 100, true}}},
+		{"new group starts over", []call{{"old", 0, 50, false}, {"new", 50, 100, false}, {"new", 0, 50, true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { rangeGroups = make(map[rangeGroupKey]map[int64]int64) })
+			for i, c := range tt.calls {
+				if got := finishRange(rangeGroupKey{c.group, "f", "h"}, c.start, c.end, 100); got != c.want {
+					t.Errorf("call %d: finishRange(%s, %d, %d) = %v, want %v", i, c.group, c.start, c.end, got, c.want)
+				}
+			}
+			if len(rangeGroups) != 0 {
+				t.Errorf("groups left after the file completed: %v", rangeGroups)
+			}
+		})
+	}
+}
+
+func TestPruneRangeGroups(t *testing.T) {
+	t.Cleanup(func() {
+		rangeGroups = make(map[rangeGroupKey]map[int64]int64)
+		fileState.Delete(newResumeKey("kept", "h", 0))
+	})
+	finishRange(rangeGroupKey{"g1", "kept", "h"}, 0, 50, 100)
+	finishRange(rangeGroupKey{"g2", "abandoned", "h"}, 0, 50, 100)
+	fileState.Store(newResumeKey("kept", "h", 0), int64(50))
+
+	pruneRangeGroups()
+	if _, ok := rangeGroups[rangeGroupKey{"g1", "kept", "h"}]; !ok {
+		t.Error("dropped the group of a file with resume state")
+	}
+	if _, ok := rangeGroups[rangeGroupKey{"g2", "abandoned", "h"}]; ok {
+		t.Error("kept the group of a file without resume state")
+	}
+}
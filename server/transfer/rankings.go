@@ -0,0 +1,101 @@
+package transfer
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// rankingSize is how many entries each ranking keeps.
+const rankingSize = 3
+
+var (
+	// ipBytes counts bytes received per source IP over the server's
+	// lifetime, restored from ipUsageFile at startup; guarded by mu.
+	ipBytes = make(map[string]int64)
+)
+
+// rankEntry is one row of a ranking: an active transfer or a source IP.
+type rankEntry struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// rankings is recomputed on every dashboard tick and status request.
+type rankings struct {
+	Fastest    []rankEntry `json:"fastest"`     // active transfers, MB/s
+	Slowest    []rankEntry `json:"slowest"`     // active transfers, MB/s
+	TopTalkers []rankEntry `json:"top_talkers"` // source IPs, bytes ever received
+}
+
+// topEntries returns up to n entries ordered by Value, highest first, or
+// lowest first when ascending is set. Ties are broken by name so the output
+// is stable between ticks. entries is sorted in place.
+func topEntries(entries []rankEntry, n int, ascending bool) []rankEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Value != entries[j].Value {
+			if ascending {
+				return entries[i].Value < entries[j].Value
+			}
+			return entries[i].Value > entries[j].Value
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return append([]rankEntry(nil), entries...)
+}
+
+// hostOnly strips the port from a remote address.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func computeRankings() rankings {
+	var speeds []rankEntry
+	clientsMu.Lock()
+	for _, client := range clients {
+		if client.Status == "传输中" {
+			speeds = append(speeds, rankEntry{Name: client.IP + " " + client.FileName, Value: client.Speed()})
+		}
+	}
+	clientsMu.Unlock()
+
+	mu.Lock()
+	talkers := make([]rankEntry, 0, len(ipBytes))
+	for ip, n := range ipBytes {
+		talkers = append(talkers, rankEntry{Name: ip, Value: float64(n)})
+	}
+	mu.Unlock()
+
+	var r rankings
+	r.Fastest = topEntries(speeds, rankingSize, false)
+	r.Slowest = topEntries(speeds, rankingSize, true)
+	r.TopTalkers = topEntries(talkers, rankingSize, false)
+	return r
+}
+
+// rankingLines renders r for the dashboard, skipping empty rankings.
+func rankingLines(r rankings) []string {
+	var lines []string
+	format := func(label string, entries []rankEntry, value func(float64) string) {
+		if len(entries) == 0 {
+			return
+		}
+		parts := make([]string, len(entries))
+		for i, e := range entries {
+			parts[i] = fmt.Sprintf("%s (%s)", e.Name, value(e.Value))
+		}
+		lines = append(lines, label+": "+strings.Join(parts, ", "))
+	}
+	speed := func(v float64) string { return fmt.Sprintf("%.2f MB/s", v) }
+	format("Fastest", r.Fastest, speed)
+	format("Slowest", r.Slowest, speed)
+	format("Top talkers", r.TopTalkers, func(v float64) string { return formatBytes(int64(v)) })
+	return lines
+}
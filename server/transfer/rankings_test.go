@@ -0,0 +1,95 @@
+package transfer
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputeRankings(t *testing.T) {
+	type transfer struct {
+		name   string
+		status string
+		speed  float64 // bytes per second
+	}
+	tests := []struct {
+		name        string
+		transfers   []transfer
+		ipBytes     map[string]int64
+		wantFastest []string
+		wantSlowest []string
+		wantTalkers []rankEntry
+	}{
+		{name: "idle"},
+		{
+			name:        "fewer than the ranking size",
+			transfers:   []transfer{{"a", "传输中", 1 << 20}, {"b", "传输中", 3 << 20}},
+			wantFastest: []string{"b", "a"},
+			wantSlowest: []string{"a", "b"},
+		},
+		{
+			name: "top and bottom three",
+			transfers: []transfer{
+				{"a", "传输中", 5 << 20}, {"b", "传输中", 1 << 20}, {"c", "传输中", 4 << 20},
+				{"d", "传输中", 2 << 20}, {"e", "传输中", 3 << 20},
+				// Only active transfers are ranked.
+				{"done", "传输完成", 9 << 20},
+			},
+			wantFastest: []string{"a", "c", "e"},
+			wantSlowest: []string{"b", "d", "e"},
+		},
+		{
+			// Equal byte counts are ordered by name.
+			name:    "talkers by bytes",
+			ipBytes: map[string]int64{"10.0.0.1": 100, "10.0.0.2": 5000, "10.0.0.3": 700, "10.0.0.4": 700},
+			wantTalkers: []rankEntry{
+				{Name: "10.0.0.2", Value: 5000}, {Name: "10.0.0.3", Value: 700}, {Name: "10.0.0.4", Value: 700},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldClients, oldIPBytes := clients, ipBytes
+			t.Cleanup(func() { clients, ipBytes = oldClients, oldIPBytes })
+			clients, ipBytes = make(map[string]*Client), make(map[string]int64)
+			now := time.Now()
+			for i, tr := range tt.transfers {
+				id := fmt.Sprint(i)
+				clients[id] = &Client{
+					ID: id, IP: "192.0.2.1", FileName: tr.name, Status: tr.status,
+					// A long-settled average of speed, last sampled now.
+					speed: speedMeter{rate: tr.speed, start: now.Add(-time.Hour), last: now},
+				}
+			}
+			for ip, n := range tt.ipBytes {
+				ipBytes[ip] = n
+			}
+
+			r := computeRankings()
+			names := func(entries []rankEntry) []string {
+				var names []string
+				for _, e := range entries {
+					names = append(names, e.Name[len("192.0.2.1 "):])
+				}
+				return names
+			}
+			if got := names(r.Fastest); !reflect.DeepEqual(got, tt.wantFastest) {
+				t.Errorf("fastest %q, want %q", got, tt.wantFastest)
+			}
+			if got := names(r.Slowest); !reflect.DeepEqual(got, tt.wantSlowest) {
+				t.Errorf("slowest %q, want %q", got, tt.wantSlowest)
+			}
+			if len(r.TopTalkers) != 0 || len(tt.wantTalkers) != 0 {
+				if !reflect.DeepEqual(r.TopTalkers, tt.wantTalkers) {
+					t.Errorf("top talkers %v, want %v", r.TopTalkers, tt.wantTalkers)
+				}
+			}
+			for _, e := range r.Fastest {
+				if e.Value < 0.9 || e.Value > 9 {
+					t.Errorf("%s ranked at %.2f, want MB/s", e.Name, e.Value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package transfer
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits throughput to rate bytes per second. A rate <= 0 means
+// unlimited. Wait lets the bucket go into debt for large chunks and sleeps
+// the debt off, so the average rate is respected without splitting reads.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// refill must be called with b.mu held.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	// Burst is capped at one second worth of tokens, but always allows one
+	// whole token so rates below 1/s still let something through.
+	burst := b.rate
+	if burst < 1 {
+		burst = 1
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// Allow takes n tokens if they are available right now, without waiting.
+func (b *tokenBucket) Allow(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Wait blocks until n bytes may pass or done is closed.
+func (b *tokenBucket) Wait(n int, done <-chan struct{}) {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-done:
+		}
+	}
+}
+
+// SetRate changes the limit, keeping any accumulated debt.
+func (b *tokenBucket) SetRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+// Rate returns the current limit in bytes per second.
+func (b *tokenBucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// ipLimiter keeps one token bucket per source IP to limit how fast each IP
+// may open new connections.
+type ipLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	buckets map[string]*ipBucket
+}
+
+type ipBucket struct {
+	bucket   *tokenBucket
+	lastSeen time.Time
+}
+
+func newIPLimiter(rate float64) *ipLimiter {
+	return &ipLimiter{rate: rate, buckets: make(map[string]*ipBucket)}
+}
+
+// Allow reports whether ip may open another connection now.
+func (l *ipLimiter) Allow(ip string) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &ipBucket{bucket: newTokenBucket(l.rate)}
+		l.buckets[ip] = b
+	}
+	b.lastSeen = time.Now()
+	l.mu.Unlock()
+	return b.bucket.Allow(1)
+}
+
+// evictIdle periodically forgets IPs that have been quiet for maxIdle, which
+// bounds memory; a forgotten IP simply starts again with a full bucket. It
+// returns once stop is closed.
+func (l *ipLimiter) evictIdle(maxIdle time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(maxIdle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		for ip, b := range l.buckets {
+			if time.Since(b.lastSeen) > maxIdle {
+				delete(l.buckets, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// fairScheduler splits a global bandwidth budget evenly between active
+// transfers, re-dividing whenever one joins or leaves. A per-transfer limit
+// caps every share on top of that; a transfer capped below its fair share
+// leaves the difference unused.
+type fairScheduler struct {
+	mu          sync.Mutex
+	total       float64
+	perTransfer float64
+	shares      map[string]*tokenBucket
+}
+
+func newFairScheduler(total, perTransfer float64) *fairScheduler {
+	return &fairScheduler{total: total, perTransfer: perTransfer, shares: make(map[string]*tokenBucket)}
+}
+
+// Join registers a transfer and returns the bucket it must draw from.
+func (s *fairScheduler) Join(id string) *tokenBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket := newTokenBucket(0)
+	s.shares[id] = bucket
+	s.rebalance()
+	return bucket
+}
+
+// Leave removes a transfer and hands its share to the remaining ones.
+func (s *fairScheduler) Leave(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.shares, id)
+	s.rebalance()
+}
+
+// rebalance must be called with s.mu held.
+func (s *fairScheduler) rebalance() {
+	if s.total <= 0 && s.perTransfer <= 0 {
+		return
+	}
+	rate := s.perTransfer
+	if s.total > 0 {
+		rate = s.total / float64(len(s.shares))
+		if s.perTransfer > 0 && rate > s.perTransfer {
+			rate = s.perTransfer
+		}
+	}
+	for _, bucket := range s.shares {
+		bucket.SetRate(rate)
+	}
+}
@@ -0,0 +1,114 @@
+package transfer
+
+import (
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFairSchedulerSharesEvenly runs three transfers reading in chunks of
+// different sizes under one global rate, and checks each gets about a
+// third of it, then half once one of them leaves.
+func TestFairSchedulerSharesEvenly(t *testing.T) {
+	const total = 3 << 20 // bytes per second
+	s := newFairScheduler(total, 0)
+	chunks := map[string]int{"small": 8 << 10, "medium": 32 << 10, "large": 128 << 10}
+
+	var mu sync.Mutex
+	received := make(map[string]int)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for id, chunk := range chunks {
+		bucket := s.Join(id)
+		wg.Add(1)
+		go func(id string, chunk int) {
+			defer wg.Done()
+			for {
+				bucket.Wait(chunk, stop)
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				mu.Lock()
+				received[id] += chunk
+				mu.Unlock()
+			}
+		}(id, chunk)
+	}
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+
+	for id := range chunks {
+		share := float64(received[id]) / total
+		if math.Abs(share-1.0/3) > 0.1 {
+			t.Errorf("%s transfer got %.0f%% of the global rate, want about a third (received %v)", id, share*100, received)
+		}
+	}
+
+	s.Leave("large")
+	for _, id := range []string{"small", "medium"} {
+		if got := s.shares[id].Rate(); got != total/2 {
+			t.Errorf("%s rate after one transfer left: %.0f, want %d", id, got, total/2)
+		}
+	}
+}
+
+func TestFairSchedulerCapsShares(t *testing.T) {
+	s := newFairScheduler(1000, 300)
+	a := s.Join("a")
+	if got := a.Rate(); got != 300 {
+		t.Errorf("single transfer rate %.0f, want the per-transfer cap 300", got)
+	}
+	s.Join("b")
+	s.Join("c")
+	s.Join("d")
+	if got := a.Rate(); got != 250 {
+		t.Errorf("rate with four transfers %.0f, want 250", got)
+	}
+}
+
+// TestPerIPConnectionLimit checks that a connection over the per-IP rate
+// is answered with the rejection frame clients retry on, while the first
+// one is served.
+func TestPerIPConnectionLimit(t *testing.T) {
+	useTestStorage(t, "")
+	old := connLimiter
+	t.Cleanup(func() { connLimiter = old })
+	connLimiter = newIPLimiter(1)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go acceptLoop(listener)
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	if got := readTestFrame(t, second); got != "too many connections" {
+		t.Errorf("second connection got %q, want the per-IP rejection", got)
+	}
+
+	// The first connection is served: a status request is answered.
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeFrame(first, []byte(statusRequest)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFrame(t, first); !strings.HasPrefix(got, "{") {
+		t.Errorf("first connection got %q, want the server status", got)
+	}
+}
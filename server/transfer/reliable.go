@@ -0,0 +1,59 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+// In reliable mode (the header's fieldReliable) the client sends the data
+// as chunks, each prefixed with a 4-byte big-endian length and the CRC32
+// (IEEE) of the chunk, and waits for a one-byte reply before the next one:
+// chunkAck once the chunk is written, chunkNack to have it sent again.
+const (
+	chunkAck  = 'A'
+	chunkNack = 'N'
+)
+
+// maxCheckedChunk bounds the chunk length a client may announce, as the
+// whole chunk is buffered before its CRC can be checked.
+const maxCheckedChunk = 64 * 1024 * 1024
+
+// errChunkChecksum reports a chunk whose data does not match its CRC32.
+var errChunkChecksum = errors.New("chunk checksum mismatch")
+
+// readCheckedChunk reads one reliable-mode chunk of at most limit bytes into
+// *buf, growing it if the client's chunks are larger than ours.
+func readCheckedChunk(conn net.Conn, buf *[]byte, limit int64) (int, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, err
+	}
+	n := int64(binary.BigEndian.Uint32(header[:4]))
+	if n == 0 || n > limit || n > maxCheckedChunk {
+		return 0, fmt.Errorf("invalid chunk length %d", n)
+	}
+	if n > int64(len(*buf)) {
+		*buf = make([]byte, n)
+	}
+	data := (*buf)[:n]
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, errChunkChecksum
+	}
+	return int(n), nil
+}
+
+func ackChunk(conn net.Conn, ok bool) error {
+	reply := byte(chunkAck)
+	if !ok {
+		reply = chunkNack
+	}
+	_, err := conn.Write([]byte{reply})
+	return err
+}
@@ -0,0 +1,240 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// resumeStateFile keeps fileState across restarts. It lives in storageDir,
+// so sanitizeFileName refuses uploads under this name.
+const resumeStateFile = ".resume-state.json"
+
+// resumeStateInterval is how often fileState is written out.
+const resumeStateInterval = 5 * time.Second
+
+// resumeReconcileInterval is how often fileState is checked against the
+// part files on disk.
+const resumeReconcileInterval = time.Minute
+
+type resumeRecord struct {
+	Name   string `json:"name"`
+	Hash   string `json:"hash"`
+	Start  int64  `json:"start,omitempty"`
+	Offset int64  `json:"offset"`
+	ID     string `json:"id,omitempty"`    // transfer ID, see transferid.go
+	Shard  string `json:"shard,omitempty"` // -dir directory holding the part file, see shard.go
+	Size   int64  `json:"size,omitempty"`  // whole file's size, see incomplete.go
+}
+
+func resumeStatePath() string {
+	return filepath.Join(storageDir, resumeStateFile)
+}
+
+// loadResumeState fills fileState from the saved state. An offset is never
+// trusted beyond what is actually stored in the file's .part, and entries
+// whose .part is gone are dropped.
+func loadResumeState() error {
+	data, err := os.ReadFile(resumeStatePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []resumeRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if offset, ok := storedOffset(r.Name, r.Start, r.Offset); ok {
+			key := newResumeKey(r.Name, r.Hash, r.Start)
+			fileState.Store(key, offset)
+			if r.ID != "" {
+				transferIDs[r.ID] = resumeTarget{name: key.name, hash: key.hash}
+			}
+			if r.Size > 0 {
+				partialSizes.Store(resumeTarget{name: key.name, hash: key.hash}, r.Size)
+			}
+		} else if r.Shard != "" && !isStorageDir(r.Shard) {
+			logWarn("part file is in a directory no longer given with -dir, its upload will start over", "file", r.Name, "dir", r.Shard)
+		}
+	}
+	return nil
+}
+
+// gappedStorage is implemented by backends whose part files can lack data
+// below their size that is not a hole.
+type gappedStorage interface {
+	// storedRun is how many bytes from start on the part file name holds
+	// without such a gap.
+	storedRun(name string, start int64) (int64, error)
+}
+
+// storedOffset caps offset, counted from start, at what the part file of
+// name actually holds. ok is false if the part file is gone.
+func storedOffset(name string, start, offset int64) (_ int64, ok bool) {
+	info, err := storage.Stat(partName(name))
+	if err != nil {
+		return 0, false
+	}
+	stored := info.Size() - start
+	if g, isGapped := storage.(gappedStorage); isGapped {
+		if stored, err = g.storedRun(partName(name), start); err != nil {
+			return 0, false
+		}
+	}
+	if stored < offset {
+		offset = stored
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return offset, true
+}
+
+// settleResumeOffset records where an interrupted upload of a range can
+// resume. The offsets stored while receiving count bytes handed to the OS,
+// which a crash can still lose, so the part file is synced first and the
+// offset capped at its size. If the data cannot be synced, none of the
+// range is trusted.
+func settleResumeOffset(file StorageFile, name, hash string, start, received int64) (int64, error) {
+	key := newResumeKey(name, hash, start)
+	if err := file.Sync(); err != nil {
+		fileState.Delete(key)
+		return 0, err
+	}
+	offset, ok := storedOffset(name, start, received)
+	if !ok {
+		fileState.Delete(key)
+		return 0, fs.ErrNotExist
+	}
+	fileState.Store(key, offset)
+	return offset, nil
+}
+
+// reconcileResumeState fixes up fileState for part files that changed behind
+// the server's back, e.g. deleted or truncated by an admin, so a resuming
+// client is never told to skip bytes that are no longer there. Entries of a
+// missing part file are dropped, which also clears any left over from a
+// file that was completed. Files being written are left alone.
+func reconcileResumeState() {
+	fileState.Range(func(key, value interface{}) bool {
+		k := key.(resumeKey)
+		if uploadActive(k.name) {
+			return true
+		}
+		recorded := value.(int64)
+		offset, ok := storedOffset(k.name, k.start, recorded)
+		switch {
+		case !ok:
+			// Only if no transfer updated it meanwhile.
+			if fileState.CompareAndDelete(key, value) {
+				logInfo("dropped resume state of missing part file", "file", k.name, "offset", recorded)
+			}
+		case offset != recorded:
+			if fileState.CompareAndSwap(key, value, offset) {
+				logInfo("corrected resume offset to the part file's size", "file", k.name, "offset", recorded, "stored", offset)
+			}
+		}
+		return true
+	})
+	pruneTransferIDs()
+	prunePartialSizes()
+	pruneRangeGroups()
+}
+
+// reconcileResumeStateEvery runs reconcileResumeState every interval until
+// stop is closed.
+func reconcileResumeStateEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reconcileResumeState()
+		}
+	}
+}
+
+// encodeResumeState serializes fileState in a stable order.
+func encodeResumeState() ([]byte, error) {
+	records := []resumeRecord{}
+	ids := transferIDsByTarget()
+	fileState.Range(func(key, value interface{}) bool {
+		k := key.(resumeKey)
+		target := resumeTarget{name: k.name, hash: k.hash}
+		record := resumeRecord{Name: k.name, Hash: k.hash, Start: k.start, Offset: value.(int64), ID: ids[target], Shard: shardOf(k.name)}
+		if size, ok := partialSizes.Load(target); ok {
+			record.Size = size.(int64)
+		}
+		records = append(records, record)
+		return true
+	})
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		if records[i].Hash != records[j].Hash {
+			return records[i].Hash < records[j].Hash
+		}
+		return records[i].Start < records[j].Start
+	})
+	return json.MarshalIndent(records, "", "  ")
+}
+
+// persistResumeState writes fileState out every interval when it changed,
+// until stop is closed.
+func persistResumeState(interval time.Duration, stop <-chan struct{}) {
+	var last []byte
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		data, err := encodeResumeState()
+		if err != nil {
+			logError("failed to encode resume state", "err", err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		if err := writeStateFile(resumeStatePath(), data); err != nil {
+			logError("failed to save resume state", "err", err)
+			continue
+		}
+		last = data
+	}
+}
+
+// saveResumeState writes fileState out once, on shutdown.
+func saveResumeState() {
+	data, err := encodeResumeState()
+	if err == nil {
+		err = writeStateFile(resumeStatePath(), data)
+	}
+	if err != nil {
+		logError("failed to save resume state", "err", err)
+	}
+}
+
+// writeStateFile replaces path with data through a temporary file, so a
+// crash never leaves a half-written state.
+func writeStateFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
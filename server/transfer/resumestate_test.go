@@ -0,0 +1,68 @@
+package transfer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReconcileResumeState(t *testing.T) {
+	tests := []struct {
+		name     string
+		partSize int64 // -1 for no part file
+		recorded int64
+		want     int64 // -1 for dropped
+	}{
+		{"part file as recorded", 100, 100, 100},
+		{"part file gone", -1, 100, -1},
+		{"part file truncated", 40, 100, 40},
+		{"part file longer than recorded", 150, 100, 100},
+		{"range past the end of the part file", 0, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestStorage(t, "")
+			if tt.partSize >= 0 {
+				storeTestFile(t, partName("f"), testData(int(tt.partSize)))
+			}
+			key := newResumeKey("f", "h", 0)
+			fileState.Store(key, tt.recorded)
+
+			reconcileResumeState()
+			got, ok := fileState.Load(key)
+			switch {
+			case tt.want < 0 && ok:
+				t.Errorf("kept offset %d, want the entry dropped", got)
+			case tt.want >= 0 && !ok:
+				t.Errorf("dropped the entry, want offset %d", tt.want)
+			case ok && got.(int64) != tt.want:
+				t.Errorf("offset %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadResumeStateCapsOffsets(t *testing.T) {
+	useTestStorage(t, "")
+	oldDir := storageDir
+	storageDir = t.TempDir()
+	t.Cleanup(func() { storageDir = oldDir; forgetResume("short", "h"); forgetResume("gone", "h") })
+
+	storeTestFile(t, partName("short"), testData(30))
+	state := `[{"name":"short","hash":"H","offset":50,"size":80},{"name":"gone","hash":"h","offset":10}]`
+	if err := os.WriteFile(filepath.Join(storageDir, resumeStateFile), []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadResumeState(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := fileState.Load(newResumeKey("short", "h", 0)); !ok || got.(int64) != 30 {
+		t.Errorf("offset of short = %v, %v; want 30, the part file's size", got, ok)
+	}
+	if got := partialSize("short", "h"); got != 80 {
+		t.Errorf("size of short = %d, want 80", got)
+	}
+	if _, ok := fileState.Load(newResumeKey("gone", "h", 0)); ok {
+		t.Error("loaded the offset of a missing part file")
+	}
+}
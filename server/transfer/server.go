@@ -0,0 +1,1217 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// 使用 sync.Map 来安全地在多个 goroutine 中存储和访问文件的偏移量
+	// (键为 resumeKey)
+	fileState             sync.Map
+	storageDir            = DefaultDir
+	activeConnections     int64
+	totalBytesTransferred int64
+	serverStartTime       time.Time
+	mu                    sync.Mutex
+	clients               = make(map[string]*Client)
+	clientsMu             sync.Mutex
+	completedClients      []*Client
+	completedClientsMu    sync.Mutex
+	// maxCompletedClients (-history) bounds completedClients; older
+	// transfers are only in server.log and the manifest. droppedClients
+	// counts them.
+	maxCompletedClients = DefaultHistory
+	droppedClients      int64
+	scheduler           = newFairScheduler(0, 0)
+	connLimiter         = newIPLimiter(0)
+	// connSlots holds one token per open connection when -maxconn is set.
+	connSlots chan struct{}
+	// console receives the messages consolef prints, see Options.Console.
+	console io.Writer
+	// chunkSize is the per-connection receive buffer size. It is independent
+	// of the client's chunk size since reads just fill whatever arrives.
+	chunkSize = DefaultChunkSize
+)
+
+// resumeKey identifies a partial upload. Including the client's hash keeps
+// different files that share a base name from resuming at each other's
+// offsets; start tells apart the ranges of a parallel transfer. The stored
+// offset counts from start.
+type resumeKey struct {
+	name  string
+	hash  string
+	start int64
+}
+
+func newResumeKey(name, hash string, start int64) resumeKey {
+	return resumeKey{name: name, hash: strings.ToLower(hash), start: start}
+}
+
+// forgetResume drops the resume state of every range of a file, its
+// recorded size and the transfer IDs pointing at it.
+func forgetResume(name, hash string) {
+	hash = strings.ToLower(hash)
+	fileState.Range(func(key, _ interface{}) bool {
+		if k := key.(resumeKey); k.name == name && k.hash == hash {
+			fileState.Delete(key)
+		}
+		return true
+	})
+	partialSizes.Delete(resumeTarget{name: name, hash: hash})
+	forgetTransferIDs(name, hash)
+}
+
+// Client struct to track each client's transfer status
+type Client struct {
+	ID             string
+	IP             string
+	FileName       string
+	FileSize       int64
+	Received       int64
+	Status         string
+	StartTime      time.Time
+	CalculatedHash string
+	ExpectedHash   string
+	HashAlgorithm  string
+	Signer         string
+
+	limiter    *tokenBucket
+	speed      speedMeter
+	conn       net.Conn
+	cancel     chan struct{} // closed by cancelTransfer
+	cancelOnce sync.Once
+}
+
+// Speed returns the client's receive speed in MB/s, averaged over
+// speedWindow.
+func (c *Client) Speed() float64 {
+	return c.speed.Rate() / (1024 * 1024)
+}
+
+func acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logError("error accepting connection", "err", err)
+			continue
+		}
+		setKeepAlive(conn)
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !connLimiter.Allow(host) {
+			logWarn("too many connections, rejected", "client_ip", conn.RemoteAddr())
+			rejectConnection(conn, "too many connections")
+			continue
+		}
+		if !acquireConnSlot() {
+			logWarn("server busy, rejected", "client_ip", conn.RemoteAddr(), "maxconn", cap(connSlots))
+			rejectConnection(conn, "server busy")
+			continue
+		}
+		go func() {
+			defer releaseConnSlot()
+			handleConnection(conn)
+		}()
+	}
+}
+
+// acquireConnSlot takes a -maxconn slot without waiting. Slots are counted
+// per connection rather than per transfer (activeConnections), since a
+// connection holds its buffer and descriptor between the files of a batch.
+func acquireConnSlot() bool {
+	if connSlots == nil {
+		return true
+	}
+	select {
+	case connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseConnSlot() {
+	if connSlots != nil {
+		<-connSlots
+	}
+}
+
+// versionConflict rejects an upload whose If-Match hash no longer matches the
+// stored file.
+const versionConflict = "版本冲突"
+
+// matchesIfMatch reports whether the stored file name has the hash ifMatch,
+// and returns the hash it has, empty if it cannot be read.
+func matchesIfMatch(name, ifMatch string, newHash func() hash.Hash) (current string, ok bool) {
+	current, err := calculateFileHash(name, newHash)
+	return current, err == nil && strings.EqualFold(current, ifMatch)
+}
+
+// rejectConnection sends a short reason in place of the offset reply and
+// closes conn.
+func rejectConnection(conn net.Conn, reason string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	writeFrame(conn, []byte(reason))
+	conn.Close()
+}
+
+func handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	clientIP := conn.RemoteAddr().String()
+	logDebug("client connected", "client_ip", clientIP)
+	consolef("Client %s connected.\n", clientIP)
+
+	// A client may send several files over one connection, one header after
+	// the other, until it closes the connection.
+	for handleTransfer(conn, clientIP) {
+	}
+
+	logDebug("connection closed", "client_ip", clientIP)
+	consolef("Client %s: Connection closed.\n", clientIP)
+}
+
+// handleTransfer receives one file, sends one, or answers one STATUS request, and
+// reports whether the connection is still in step for another header.
+func handleTransfer(conn net.Conn, clientIP string) bool {
+	// Read file info length
+	refreshIdleDeadline(conn)
+	lengthBuf := make([]byte, 4)
+	_, err := io.ReadFull(conn, lengthBuf)
+	if err != nil {
+		// EOF here is the client closing after its last file.
+		if isTimeout(err) {
+			logInfo("closing idle connection", "client_ip", clientIP, "timeout", idleTimeout)
+		} else if err != io.EOF {
+			logWarn("error reading info length", "client_ip", clientIP, "err", err)
+		}
+		return false
+	}
+	infoLength := binary.BigEndian.Uint32(lengthBuf)
+
+	clientID := fmt.Sprintf("%d", time.Now().UnixNano())
+	tlog := openTransferLog(clientID)
+	defer tlog.Close()
+	tlog.Debug("request started", "client_ip", clientIP, "transfer", clientID)
+
+	// The header is not authenticated yet, so its length must not decide
+	// how much memory is allocated.
+	if infoLength > maxInfoLen {
+		tlog.Warn("rejected oversized file info", "client_ip", clientIP, "length", infoLength, "limit", maxInfoLen)
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+
+	// Read file info
+	infoBuf := make([]byte, infoLength)
+	_, err = io.ReadFull(conn, infoBuf)
+	if err != nil {
+		tlog.Warn("error reading file info", "client_ip", clientIP, "err", err)
+		return false
+	}
+
+	info := strings.Split(string(infoBuf), "|")
+	if info[0] == statusRequest && len(info) <= 2 {
+		mac := ""
+		if len(info) == 2 {
+			mac = info[1]
+		}
+		if !authenticate(statusRequest, mac) {
+			tlog.Warn("rejected unauthenticated status request", "client_ip", clientIP)
+			rejectConnection(conn, authFailed)
+			return false
+		}
+		if err := sendStatus(conn); err != nil {
+			tlog.Warn("error sending status", "client_ip", clientIP, "err", err)
+			return false
+		}
+		tlog.Debug("sent server status", "client_ip", clientIP)
+		return true
+	}
+	if info[0] == downloadRequest {
+		return handleDownload(conn, clientIP, clientID, info, tlog)
+	}
+	if info[0] == verifyRequest {
+		return handleVerify(conn, clientIP, info, tlog)
+	}
+	if info[0] == listRequest {
+		return handleList(conn, clientIP, info, tlog)
+	}
+	if info[0] == blocksRequest {
+		return handleBlocks(conn, clientIP, info, tlog)
+	}
+
+	if version, err := strconv.Atoi(info[fieldVersion]); err != nil || version != ProtocolVersion {
+		tlog.Warn("unsupported protocol version", "client_ip", clientIP, "version", info[fieldVersion])
+		rejectConnection(conn, fmt.Sprintf("%s %s, server speaks %d", protocolMismatch, info[fieldVersion], ProtocolVersion))
+		return false
+	}
+	if len(info) != headerFields {
+		tlog.Warn("malformed file info", "client_ip", clientIP, "fields", len(info))
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+	if !authenticate(strings.Join(info[:fieldAuth], "|"), info[fieldAuth]) {
+		tlog.Warn("rejected transfer with invalid token HMAC", "client_ip", clientIP)
+		rejectConnection(conn, authFailed)
+		return false
+	}
+	fileName, err := sanitizeFileName(info[fieldName])
+	if err != nil {
+		tlog.Warn("rejected file name", "client_ip", clientIP, "err", err)
+		rejectConnection(conn, "invalid file name")
+		return false
+	}
+	dest, err := sanitizeDestDir(info[fieldDest])
+	if err != nil {
+		tlog.Warn("rejected destination directory", "client_ip", clientIP, "err", err)
+		rejectConnection(conn, "invalid destination")
+		return false
+	}
+	if dest != "" {
+		fileName = path.Join(dest, fileName)
+	}
+	if canonical := canonicalFileName(fileName); canonical != fileName {
+		tlog.Info("file name collides on case-insensitive storage, using the existing name", "client_ip", clientIP, "file", fileName, "existing", canonical)
+		fileName = canonical
+	}
+	// storedAs tells the client when -overwrite rename picked another name.
+	storedAs := ""
+	if name, err := resolveOverwrite(fileName); err != nil {
+		tlog.Warn("rejected existing file", "client_ip", clientIP, "file", fileName, "overwrite", overwritePolicy, "err", err)
+		rejectConnection(conn, fileExists)
+		return false
+	} else if name != fileName {
+		tlog.Info("file exists, storing the upload under another name", "client_ip", clientIP, "file", fileName, "stored_as", name)
+		fileName, storedAs = name, name
+	}
+	// A negative size would slip past -maxsize and the quota.
+	fileSize, err := strconv.ParseInt(info[fieldSize], 10, 64)
+	if err != nil || fileSize < 0 && fileSize != streamSize {
+		tlog.Warn("invalid file size", "client_ip", clientIP, "size", info[fieldSize])
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+	// A stream's size grows as its data arrives, see stream.go.
+	streamed := fileSize == streamSize
+	if streamed {
+		fileSize = 0
+	}
+	// The client's hash keys the resume state, tells us how long the trailing
+	// hash after the data is, and is checked against the received file.
+	expectedHash := info[fieldHash]
+	resume := info[fieldResume] == "true"
+	signed := info[fieldSigned] == "true"
+	ifMatch := info[fieldIfMatch]
+	reliable := info[fieldReliable] == "true"
+	if streamed && (reliable || info[fieldGroup] != "") {
+		tlog.Warn("stream cannot be reliable or split into ranges", "client_ip", clientIP, "file", fileName)
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+	var inflater *chunkInflater
+	switch info[fieldCompress] {
+	case "":
+	case compressDeflate:
+		if streamed || reliable {
+			tlog.Warn("stream or reliable transfer cannot be compressed", "client_ip", clientIP, "file", fileName)
+			rejectConnection(conn, "malformed file info")
+			return false
+		}
+		inflater = &chunkInflater{}
+	default:
+		tlog.Warn("unsupported compression", "client_ip", clientIP, "compression", info[fieldCompress])
+		rejectConnection(conn, unsupportedCompression)
+		return false
+	}
+	sparse := info[fieldSparse] == "true"
+	if sparse && (streamed || reliable || inflater != nil) {
+		tlog.Warn("stream, reliable or compressed transfer cannot be sparse", "client_ip", clientIP, "file", fileName)
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+	// A hard link is recreated from the stored file it links to, or
+	// received in full; it is never resumed.
+	linkTarget := ""
+	if info[fieldLinkTo] != "" {
+		if streamed || signed || info[fieldGroup] != "" {
+			tlog.Warn("stream, signed or parallel transfer cannot be a link", "client_ip", clientIP, "file", fileName)
+			rejectConnection(conn, "malformed file info")
+			return false
+		}
+		if linkTarget, err = sanitizeStoredPath(info[fieldLinkTo]); err != nil {
+			tlog.Warn("rejected link target", "client_ip", clientIP, "file", fileName, "err", err)
+			rejectConnection(conn, "invalid link target")
+			return false
+		}
+		if linkTarget = canonicalFileName(linkTarget); linkTarget == fileName || fileSize == 0 {
+			linkTarget = ""
+		}
+		resume = false
+	}
+	resume = resume && !streamed
+	transferID := info[fieldTransferID]
+	if !validTransferID(transferID) {
+		tlog.Warn("invalid transfer ID", "client_ip", clientIP, "transfer_id", transferID)
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+	if transferID != "" {
+		tlog.attach(transferID)
+	}
+	hashName := info[fieldHashAlgo]
+	newHash, ok := hashAlgorithms[hashName]
+	if !ok {
+		tlog.Warn("unsupported hash algorithm", "client_ip", clientIP, "hash_algorithm", hashName)
+		rejectConnection(conn, unsupportedHash)
+		return false
+	}
+	// With -smart-resume the client may ask to resume no further than
+	// where its copy and the part file start to differ.
+	resumeLimit := int64(-1)
+	if info[fieldResumeLimit] != "" {
+		limit, err := strconv.ParseInt(info[fieldResumeLimit], 10, 64)
+		if err != nil || limit < 0 {
+			tlog.Warn("invalid resume limit", "client_ip", clientIP, "resume_limit", info[fieldResumeLimit])
+			rejectConnection(conn, "malformed file info")
+			return false
+		}
+		resumeLimit = limit
+	}
+	var modTime time.Time
+	if info[fieldModTime] != "" {
+		nanos, err := strconv.ParseInt(info[fieldModTime], 10, 64)
+		if err != nil {
+			tlog.Warn("invalid modification time", "client_ip", clientIP, "mtime", info[fieldModTime])
+			rejectConnection(conn, "malformed file info")
+			return false
+		}
+		modTime = time.Unix(0, nanos)
+	}
+
+	tlog.Info("file info", "client_ip", clientIP, "file", fileName, "size", fileSize, "hash_algorithm", hashName, "streamed", streamed, "resume", resume, "signed", signed, "transfer_id", transferID)
+
+	if maxFileSize > 0 && fileSize > maxFileSize {
+		tlog.Warn("rejected file over -maxsize", "client_ip", clientIP, "file", fileName, "size", fileSize, "maxsize", maxFileSize)
+		rejectConnection(conn, "file too large")
+		return false
+	}
+
+	// A parallel transfer sends one range of the file per connection.
+	group := info[fieldGroup]
+	rangeStart, rangeEnd := int64(0), fileSize
+	if group != "" {
+		start, errStart := strconv.ParseInt(info[fieldRangeStart], 10, 64)
+		end, errEnd := strconv.ParseInt(info[fieldRangeEnd], 10, 64)
+		if errStart != nil || errEnd != nil || start < 0 || start >= end || end > fileSize {
+			tlog.Warn("rejected invalid range", "client_ip", clientIP, "file", fileName, "start", info[fieldRangeStart], "end", info[fieldRangeEnd])
+			rejectConnection(conn, "invalid range")
+			return false
+		}
+		rangeStart, rangeEnd = start, end
+		tlog.Debug("range transfer", "client_ip", clientIP, "start", rangeStart, "end", rangeEnd, "group", group)
+	}
+
+	if requireSignature && !signed {
+		tlog.Warn("rejected unsigned transfer", "client_ip", clientIP, "file", fileName)
+		rejectConnection(conn, "signature required")
+		return false
+	}
+
+	if ifMatch != "" {
+		if current, ok := matchesIfMatch(fileName, ifMatch, newHash); !ok {
+			tlog.Warn("rejected: stored hash does not match If-Match", "client_ip", clientIP, "file", fileName, "hash", current, "if_match", ifMatch)
+			rejectConnection(conn, versionConflict)
+			return false
+		}
+		// The upload replaces the version that matched, so any saved offset
+		// belongs to that old content and must not be resumed from.
+		resume = false
+	}
+
+	if transferID != "" && !streamed {
+		adoptTransfer(transferID, fileName, expectedHash, resume, tlog)
+	}
+
+	// Only one upload at a time may write a file's part file.
+	releaseClaim, err := claimUpload(fileName, expectedHash, group, clientID)
+	if err != nil {
+		tlog.Warn("rejected busy file", "client_ip", clientIP, "file", fileName, "err", err)
+		rejectConnection(conn, fileBusy)
+		return false
+	}
+	defer releaseClaim()
+
+	// offset counts from rangeStart; the client gets the absolute position.
+	var offset int64 = 0
+	var hasher hash.Hash
+	prefixHash := ""
+	if linkTarget != "" {
+		linkHasher, copied, err := linkStoredFile(linkTarget, fileName, fileSize, expectedHash, newHash)
+		switch {
+		case errors.Is(err, errPartLinked):
+			tlog.Error("cannot unlink part file from the stored file", "client_ip", clientIP, "file", fileName, "link_to", linkTarget, "err", err)
+			rejectConnection(conn, storageFailure(err))
+			return false
+		case err != nil:
+			tlog.Info("cannot recreate hard link, receiving the data", "client_ip", clientIP, "file", fileName, "link_to", linkTarget, "err", err)
+		default:
+			offset, hasher, prefixHash = fileSize, linkHasher, hex.EncodeToString(linkHasher.Sum(nil))
+			tlog.Info("recreated hard link", "client_ip", clientIP, "file", fileName, "link_to", linkTarget, "copied", copied)
+		}
+	}
+	if resume {
+		if val, ok := fileState.Load(newResumeKey(fileName, expectedHash, rangeStart)); ok {
+			offset = val.(int64)
+			if offset > rangeEnd-rangeStart {
+				offset = 0 // Prevent offset from exceeding the range
+			}
+		}
+		if resumeLimit >= 0 && offset > resumeLimit-rangeStart {
+			offset = resumeLimit - rangeStart
+			if offset < 0 {
+				offset = 0
+			}
+			tlog.Info("resuming before the end of the stored data, where the client's copy differs", "client_ip", clientIP, "file", fileName, "offset", rangeStart+offset)
+		}
+	}
+	if !streamed {
+		recordPartialSize(fileName, expectedHash, fileSize)
+	}
+	// Let the client check the bytes we already have before it resumes. A
+	// whole-file transfer keeps hashing from there as data arrives.
+	if offset > 0 && hasher == nil {
+		if hasher, err = hashSection(partName(fileName), rangeStart, offset, newHash); err != nil {
+			tlog.Warn("cannot read the bytes to resume from, starting over", "client_ip", clientIP, "file", fileName, "offset", offset, "err", err)
+			offset = 0
+		} else {
+			prefixHash = hex.EncodeToString(hasher.Sum(nil))
+		}
+	}
+	if offset == 0 {
+		hasher = newHash()
+	}
+	// An unsigned whole file that is already stored in full needs nothing
+	// more from the client: the prefix hash covers the whole file, and when
+	// it matches the client goes straight to reading the result.
+	alreadyStored := group == "" && offset > 0 && offset == fileSize && !signed && strings.EqualFold(prefixHash, expectedHash)
+	// Parallel ranges arrive out of order, so their file is hashed once
+	// complete instead.
+	if group != "" {
+		hasher = nil
+	}
+
+	// The read loop below never takes more than the advertised size, so
+	// reserving it up front is enough to hold the quota.
+	release, err := reserveWrite(fileName, rangeStart+offset, rangeEnd)
+	if err != nil {
+		tlog.Warn("rejected: quota exceeded", "client_ip", clientIP, "file", fileName, "err", err)
+		rejectConnection(conn, "quota exceeded")
+		return false
+	}
+	defer release()
+	var streamReservation spaceReservation
+	defer streamReservation.release()
+
+	// A whole-file upload from the start must not keep the tail of a longer
+	// part file left behind by an earlier upload. Ranges cannot do that
+	// while other ranges are writing; the last one trims the file below.
+	// The file is opened before the offset is sent, so a failure can still
+	// be told to the client instead of dropping it mid-upload.
+	file, err := storage.Create(partName(fileName), fileSize, group == "" && offset == 0)
+	if err != nil {
+		tlog.Error("error creating/opening file", "client_ip", clientIP, "file", fileName, "err", err)
+		rejectConnection(conn, storageFailure(err))
+		return false
+	}
+	defer file.Close()
+	var sparseChunks *sparseReceiver
+	if sparse {
+		sparseChunks = newSparseReceiver(partName(fileName), group == "")
+	}
+
+	reply := strings.Join([]string{strconv.FormatInt(rangeStart+offset, 10), prefixHash, storedAs}, "|")
+	err = writeFrame(conn, []byte(reply))
+	if err != nil {
+		tlog.Warn("error sending resume offset", "client_ip", clientIP, "err", err)
+		return false
+	}
+	tlog.Debug("sent resume offset", "client_ip", clientIP, "offset", rangeStart+offset)
+
+	// Initialize client status
+	client := &Client{
+		ID:             clientID,
+		IP:             clientIP,
+		FileName:       fileName,
+		FileSize:       rangeEnd - rangeStart,
+		Received:       offset,
+		Status:         "传输中",
+		StartTime:      time.Now(),
+		CalculatedHash: "",
+		HashAlgorithm:  hashName,
+		conn:           conn,
+		cancel:         make(chan struct{}),
+	}
+
+	client.limiter = scheduler.Join(clientID)
+	defer scheduler.Leave(clientID)
+
+	// Add client to clients map
+	clientsMu.Lock()
+	clients[clientID] = client
+	activeConnections++
+	clientsMu.Unlock()
+
+	publishClientEvent(EventStart, client)
+
+	tlog.Info("transfer started", "client_ip", clientIP, "file", fileName, "size", fileSize)
+	consolef("Client %s: Started transferring file %s (%d bytes)\n", clientIP, fileName, fileSize)
+
+	buf := make([]byte, chunkSize)
+	progress := newProgressReporter(client)
+
+	for streamed || client.Received < client.FileSize {
+		// Never read past the file data; the trailing hash follows it.
+		chunk := buf
+		if remaining := client.FileSize - client.Received; !streamed && remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		var n int
+		var hole int64
+		client.refreshDeadline()
+		if streamed {
+			if n, err = readStreamChunk(conn, &buf); err == errStreamEnd {
+				break
+			}
+		} else if reliable {
+			n, err = readCheckedChunk(conn, &buf, client.FileSize-client.Received)
+			if errors.Is(err, errChunkChecksum) {
+				tlog.Warn("chunk failed its CRC32, asking for it again", "client_ip", clientIP, "offset", rangeStart+client.Received)
+				if err = ackChunk(conn, false); err == nil {
+					continue
+				}
+			}
+		} else if inflater != nil {
+			n, err = inflater.read(conn, &buf, client.FileSize-client.Received)
+		} else if sparseChunks != nil {
+			n, hole, err = sparseChunks.read(conn, &buf, client.FileSize-client.Received)
+		} else {
+			n, err = conn.Read(chunk)
+		}
+		if client.cancelled() {
+			tlog.Info("transfer cancelled", "client_ip", clientIP, "bytes", client.Received, "size", client.FileSize)
+			client.Status = "已取消"
+			break
+		}
+		if err != nil {
+			if err == io.EOF {
+				tlog.Warn("connection closed mid-transfer", "client_ip", clientIP, "bytes", client.Received, "size", client.FileSize)
+				client.Status = "传输中断"
+				break
+			}
+			if isTimeout(err) {
+				tlog.Warn("client idle, disconnecting", "client_ip", clientIP, "bytes", client.Received, "size", client.FileSize, "timeout", idleTimeout)
+				client.Status = statusTimedOut
+				break
+			}
+			tlog.Warn("error reading file chunk", "client_ip", clientIP, "bytes", client.Received, "err", err)
+			client.Status = "传输中断"
+			break
+		}
+
+		if streamed {
+			if maxFileSize > 0 && client.Received+int64(n) > maxFileSize {
+				tlog.Warn("stream exceeds -maxsize", "client_ip", clientIP, "file", fileName, "bytes", client.Received+int64(n), "maxsize", maxFileSize)
+				client.Status = statusTooLarge
+				break
+			}
+			if err := streamReservation.grow(client.Received + int64(n)); err != nil {
+				tlog.Warn("stream exceeds the quota", "client_ip", clientIP, "file", fileName, "bytes", client.Received+int64(n), "err", err)
+				client.Status = statusQuotaExceeded
+				break
+			}
+		}
+
+		// A hole is not written and, having crossed the network as a
+		// length only, not counted as received traffic either.
+		if hole > 0 {
+			if err := sparseChunks.fillHole(file, rangeStart+client.Received, hole); err != nil {
+				tlog.Error("error writing to file", "client_ip", clientIP, "file", fileName, "err", err)
+				client.Status = "写入错误"
+				break
+			}
+			if hasher != nil {
+				hashZeros(hasher, hole)
+			}
+			client.Received += hole
+			fileState.Store(newResumeKey(fileName, expectedHash, rangeStart), client.Received)
+			progress.report()
+			continue
+		}
+
+		// Write to file
+		err = writeAtFull(file, buf[:n], rangeStart+client.Received)
+		if err != nil {
+			tlog.Error("error writing to file", "client_ip", clientIP, "file", fileName, "err", err)
+			client.Status = "写入错误"
+			break
+		}
+		if reliable {
+			if err := ackChunk(conn, true); err != nil {
+				tlog.Warn("error acknowledging chunk", "client_ip", clientIP, "err", err)
+				client.Status = "传输中断"
+				break
+			}
+		}
+
+		if hasher != nil {
+			hasher.Write(buf[:n])
+		}
+		client.Received += int64(n)
+		client.speed.Add(n)
+		receiveSpeed.Add(n)
+		mu.Lock()
+		totalBytesTransferred += int64(n)
+		ipBytes[hostOnly(clientIP)] += int64(n)
+		mu.Unlock()
+		if !streamed {
+			fileState.Store(newResumeKey(fileName, expectedHash, rangeStart), client.Received)
+		}
+		client.limiter.Wait(n, client.cancel)
+
+		progress.report()
+	}
+
+	// The client will resume an interrupted upload from what is saved here.
+	if !streamed && client.Status != "传输中" {
+		if offset, err := settleResumeOffset(file, fileName, expectedHash, rangeStart, client.Received); err != nil {
+			tlog.Warn("cannot sync the received data, the upload will start over", "client_ip", clientIP, "file", fileName, "err", err)
+		} else if offset < client.Received {
+			tlog.Warn("part file is shorter than the data received, resuming earlier", "client_ip", clientIP, "file", fileName, "received", client.Received, "offset", offset)
+		}
+	}
+
+	// After the data the client sends its hash and, for signed transfers, a
+	// length-prefixed detached signature.
+	var signature []byte
+	inStep := false
+	client.ExpectedHash = expectedHash
+	trailerLen := len(expectedHash)
+	if streamed {
+		fileSize, client.FileSize = client.Received, client.Received
+		trailerLen = hex.EncodedLen(newHash().Size())
+	}
+	if client.Status == "传输中" && alreadyStored {
+		tlog.Info("file already stored in full, verified without resending", "client_ip", clientIP, "file", fileName)
+		inStep = true
+	} else if client.Status == "传输中" {
+		trailer := make([]byte, trailerLen)
+		client.refreshDeadline()
+		if _, err := io.ReadFull(conn, trailer); err != nil {
+			tlog.Warn("error reading trailing hash", "client_ip", clientIP, "err", err)
+			if isTimeout(err) {
+				client.Status = statusTimedOut
+			}
+		} else if client.ExpectedHash = string(trailer); signed {
+			signature, err = readSignature(conn)
+			if err != nil {
+				tlog.Warn("error reading signature", "client_ip", clientIP, "err", err)
+			} else {
+				inStep = true
+			}
+		} else {
+			inStep = true
+		}
+	}
+
+	// The connection that completes a parallel transfer checks the whole
+	// file; the others only report their range as done.
+	waiting := false
+	if client.Status == "传输中" && group != "" {
+		waiting = !finishRange(rangeGroupKey{group, fileName, strings.ToLower(expectedHash)}, rangeStart, rangeEnd, fileSize)
+		if !waiting {
+			if err := file.Truncate(fileSize); err != nil {
+				tlog.Error("error trimming file", "client_ip", clientIP, "file", fileName, "size", fileSize, "err", err)
+				client.Status = "写入错误"
+			}
+		}
+	}
+
+	// A success reported to the client must survive a power loss, so the
+	// data is on disk before the file is hashed and the result sent.
+	if client.Status == "传输中" && !waiting {
+		if err := file.Sync(); err != nil {
+			tlog.Error("error syncing file", "client_ip", clientIP, "file", fileName, "err", err)
+			client.Status = "写入错误"
+		}
+	}
+
+	// Close the file to ensure all data is written
+	if err := file.Close(); err != nil {
+		tlog.Error("error closing file", "client_ip", clientIP, "file", fileName, "err", err)
+		client.Status = "写入错误"
+	}
+
+	// Compute hash of received file and compare it with the client's
+	var calculatedHash string
+	if client.Status != "传输中" {
+		// Interrupted or failed to write; keep that status.
+	} else if waiting {
+		client.Status = "分段完成"
+		tlog.Info("range received, waiting for the other ranges", "client_ip", clientIP, "file", fileName, "start", rangeStart, "end", rangeEnd)
+	} else if calculatedHash, err = receivedFileHash(partName(fileName), fileSize, hasher, newHash); err != nil {
+		tlog.Error("error calculating file hash", "client_ip", clientIP, "file", fileName, "err", err)
+		client.Status = "哈希计算错误"
+	} else if client.CalculatedHash = calculatedHash; !strings.EqualFold(calculatedHash, client.ExpectedHash) {
+		client.Status = "哈希校验失败"
+		tlog.Error("hash mismatch", "client_ip", clientIP, "file", fileName, "expected", client.ExpectedHash, "hash", calculatedHash)
+		consolef("Client %s: Hash mismatch for %s\n", clientIP, fileName)
+	} else {
+		client.Status = "传输完成"
+		tlog.Info("file received", "client_ip", clientIP, "file", fileName, "bytes", fileSize, "hash", calculatedHash)
+		consolef("Client %s: File %s received successfully (%d bytes). Hash: %s\n", clientIP, fileName, fileSize, calculatedHash)
+	}
+
+	if client.Status == "传输完成" && verifyKey != nil && (signed || requireSignature) {
+		if err := verifySignature(calculatedHash, signature); err != nil {
+			tlog.Warn("signature check failed", "client_ip", clientIP, "file", fileName, "err", err)
+			client.Status = "签名校验失败"
+		} else {
+			client.Signer = keyFingerprint(verifyKey)
+			tlog.Info("file signed", "client_ip", clientIP, "file", fileName, "signer", client.Signer)
+		}
+	}
+
+	// Another upload may have replaced the file between the If-Match check
+	// and our claim on it. The claim keeps the file from changing again
+	// until the rename below, so checking once more here is enough.
+	if client.Status == "传输完成" && ifMatch != "" {
+		if current, ok := matchesIfMatch(fileName, ifMatch, newHash); !ok {
+			tlog.Warn("rejected: stored hash changed during the upload and no longer matches If-Match", "client_ip", clientIP, "file", fileName, "hash", current, "if_match", ifMatch)
+			client.Status = versionConflict
+		}
+	}
+
+	// Only a verified file reaches its final name. Either way there is
+	// nothing left to resume once the whole file has been checked.
+	switch client.Status {
+	case "传输完成":
+		if err := storage.Rename(partName(fileName), fileName); err != nil {
+			tlog.Error("error moving file into place", "client_ip", clientIP, "file", fileName, "err", err)
+			client.Status = "写入错误"
+		} else {
+			if !modTime.IsZero() {
+				if err := setModTime(fileName, modTime); err != nil {
+					tlog.Warn("could not restore modification time", "client_ip", clientIP, "file", fileName, "err", err)
+				}
+			}
+			if err := syncStoredDir(fileName); err != nil {
+				tlog.Warn("could not sync the storage directory, the file's final name may not survive a crash", "client_ip", clientIP, "file", fileName, "err", err)
+			}
+			// Downloads are hashed with SHA-256, so they can use this one.
+			// Another hash cannot, and -preserve-times may have given the
+			// new file the size and time of the one cached before.
+			storedSHA256.Delete(fileName)
+			if hashName == "sha256" {
+				if info, err := storage.Stat(fileName); err == nil {
+					rememberSHA256(fileName, info, calculatedHash)
+				}
+			}
+		}
+		forgetResume(fileName, expectedHash)
+	case "哈希校验失败", versionConflict:
+		forgetResume(fileName, expectedHash)
+	}
+
+	// Record the outcome only once the file is in its final place, or
+	// known not to be.
+	if client.Status != "分段完成" {
+		if err := recordManifest(client, fileSize); err != nil {
+			tlog.Error("failed to write manifest record", "client_ip", clientIP, "file", fileName, "err", err)
+		}
+	}
+	countTransfer(client.Status)
+
+	switch client.Status {
+	case "传输完成":
+		publishClientEvent(EventComplete, client)
+		notifyWebhook(client, fileSize)
+	case "分段完成":
+		publishClientEvent(EventProgress, client)
+	default:
+		publishClientEvent(EventError, client)
+		notifyWebhook(client, fileSize)
+	}
+
+	// Move client to completedClients if transfer is completed or encountered an error
+	if client.Status == "传输完成" || client.Status != "传输中" {
+		addCompletedClient(client)
+
+		// Remove from active clients map
+		clientsMu.Lock()
+		delete(clients, clientID)
+		activeConnections--
+		clientsMu.Unlock()
+	}
+
+	// Report the outcome so the client can check our hash (-verify).
+	if inStep {
+		if err := writeFrame(conn, []byte(client.Status+"|"+calculatedHash)); err != nil {
+			tlog.Warn("error sending transfer result", "client_ip", clientIP, "err", err)
+			inStep = false
+		}
+	}
+
+	tlog.Info("transfer finished", "client_ip", clientIP, "transfer", clientID, "file", fileName, "status", client.Status)
+	return inStep
+}
+
+// readSignature reads a 4-byte big-endian length followed by the signature.
+func readSignature(conn net.Conn) ([]byte, error) {
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf)
+	if length > maxSignatureLen {
+		return nil, fmt.Errorf("signature too long (%d bytes)", length)
+	}
+	sig := make([]byte, length)
+	if _, err := io.ReadFull(conn, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// consolef prints to Options.Console, if set.
+func consolef(format string, a ...interface{}) {
+	if console != nil {
+		fmt.Fprintf(console, format, a...)
+	}
+}
+
+// calculateFileHash returns the hex hash of fileName using newHash.
+func calculateFileHash(fileName string, newHash func() hash.Hash) (string, error) {
+	file, err := storage.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := newHash()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// hashSection returns a hasher from newHash that has consumed the n bytes of
+// fileName starting at start.
+func hashSection(fileName string, start, n int64, newHash func() hash.Hash) (hash.Hash, error) {
+	file, err := openSection(fileName, start)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hasher := newHash()
+	if _, err := io.CopyN(hasher, file, n); err != nil {
+		return nil, err
+	}
+	return hasher, nil
+}
+
+// openSection opens fileName for reading from start.
+func openSection(fileName string, start int64) (io.ReadCloser, error) {
+	file, err := storage.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err = seeker.Seek(start, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, file, start)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// receivedFileHash finishes the streamed hash of fileName, falling back to
+// reading the file when there is none. A file left longer than size by an
+// earlier upload is read in full so the stale tail shows up as a mismatch.
+func receivedFileHash(fileName string, size int64, hasher hash.Hash, newHash func() hash.Hash) (string, error) {
+	if hasher != nil {
+		if info, err := storage.Stat(fileName); err == nil && info.Size() == size {
+			return hex.EncodeToString(hasher.Sum(nil)), nil
+		}
+	}
+	return calculateFileHash(fileName, newHash)
+}
+
+// reservedName reports whether name, at the root of storageDir, belongs to
+// the server's own state files.
+func reservedName(name string) bool {
+	return strings.HasPrefix(name, resumeStateFile) || strings.HasPrefix(name, ipUsageFile)
+}
+
+// sanitizeDestDir checks a client's -dest and returns it as a clean,
+// slash-separated path relative to storageDir. Empty and "." components are
+// dropped; anything that could leave storageDir is refused rather than
+// rewritten, like in sanitizeFileName.
+func sanitizeDestDir(dest string) (string, error) {
+	if err := checkNameChars("destination", dest); err != nil {
+		return "", err
+	}
+	var elems []string
+	for _, elem := range strings.Split(strings.ReplaceAll(dest, "\\", "/"), "/") {
+		switch {
+		case elem == "" || elem == ".":
+			continue
+		case elem == "..":
+			return "", fmt.Errorf("destination %q contains \"..\"", dest)
+		case strings.ContainsRune(elem, ':'):
+			// A Windows volume or alternate data stream.
+			return "", fmt.Errorf("destination %q contains \":\"", dest)
+		}
+		if err := checkNameLength("destination directory", elem); err != nil {
+			return "", err
+		}
+		elems = append(elems, elem)
+	}
+	if len(elems) == 0 {
+		return "", nil
+	}
+	if reservedName(elems[0]) {
+		return "", fmt.Errorf("destination %q is reserved", dest)
+	}
+	dir := strings.Join(elems, "/")
+	if rel, err := filepath.Rel(storageDir, filepath.Join(storageDir, dir)); err != nil || filepath.ToSlash(rel) != dir {
+		return "", fmt.Errorf("destination %q resolves outside the storage directory", dest)
+	}
+	return dir, nil
+}
+
+// sanitizeStoredPath checks the path of a stored file given by a client, a
+// file name optionally below a -dest subdirectory, and returns it clean and
+// slash-separated like sanitizeDestDir.
+func sanitizeStoredPath(p string) (string, error) {
+	p = strings.ReplaceAll(p, "\\", "/")
+	i := strings.LastIndex(p, "/")
+	dir, err := sanitizeDestDir(p[:i+1])
+	if err != nil {
+		return "", err
+	}
+	name, err := sanitizeFileName(p[i+1:])
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, name), nil
+}
+
+// sanitizeFileName reduces a client-supplied name to a single file name
+// inside storageDir. Both '/' and '\\' count as separators whatever the
+// server's OS, and names that try to climb out with "..", or that
+// checkNameChars or checkNameLength refuse, are refused rather than
+// rewritten.
+func sanitizeFileName(fileName string) (string, error) {
+	if err := checkNameChars("file name", fileName); err != nil {
+		return "", err
+	}
+	name := strings.ReplaceAll(fileName, "\\", "/")
+	// Drop a Windows volume name such as "C:".
+	if len(name) >= 2 && name[1] == ':' {
+		name = name[2:]
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("file name %q contains \"..\"", fileName)
+		}
+	}
+	// Remove path, keep base file name
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		return "", fmt.Errorf("file name %q is empty", fileName)
+	}
+	if reservedName(name) {
+		return "", fmt.Errorf("file name %q is reserved", fileName)
+	}
+	if err := checkNameLength("file name", name); err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(storageDir, filepath.Join(storageDir, name)); err != nil || rel != name {
+		return "", fmt.Errorf("file name %q resolves outside the storage directory", fileName)
+	}
+	return name, nil
+}
+
+// statusLines builds the dashboard below the banner, one entry per row.
+func statusLines() []string {
+	// Collect status information
+	mu.Lock()
+	conn := activeConnections
+	bytesTransferred := totalBytesTransferred
+	mu.Unlock()
+
+	// Average over the server's uptime, next to the current speed.
+	elapsed := time.Since(serverStartTime).Seconds()
+	var average float64
+	if elapsed > 0 {
+		average = float64(bytesTransferred) / elapsed / (1024 * 1024) // MB/s
+	}
+
+	// Build main status string
+	mainStatus := fmt.Sprintf("Active Connections: %d | Total Bytes Transferred: %.2f MB | Current Speed: %.2f MB/s | Average: %.2f MB/s",
+		conn, float64(bytesTransferred)/(1024*1024), receiveSpeed.Rate()/(1024*1024), average)
+
+	lines := []string{mainStatus, overallProgressLine()}
+	lines = append(lines, rankingLines(computeRankings())...)
+	lines = append(lines, "------------------------------------------------------------")
+
+	// Build client status strings
+	clientsMu.Lock()
+	completedClientsMu.Lock()
+	defer completedClientsMu.Unlock()
+	defer clientsMu.Unlock()
+
+	if len(clients) == 0 && len(completedClients) == 0 && droppedClients == 0 {
+		return append(lines, "No active clients.")
+	}
+
+	// Display active clients
+	for _, client := range clients {
+		if client.Status == "传输中" {
+			status := fmt.Sprintf("Client %s: %s | ID: %s | File: %s | Size: %s | Received: %s | Speed: %.2f MB/s",
+				client.IP, client.Status, client.ID, client.FileName, formatBytes(client.FileSize), formatBytes(client.Received), client.Speed())
+			if limit := client.limiter.Rate(); limit > 0 {
+				status += fmt.Sprintf(" | Allotted: %.2f MB/s", limit/(1024*1024))
+			}
+			lines = append(lines, status)
+		}
+	}
+
+	// Display completed clients
+	if droppedClients > 0 {
+		lines = append(lines, fmt.Sprintf("(%d earlier transfers not shown, see server.log or -manifest)", droppedClients))
+	}
+	for _, client := range completedClients {
+		status := fmt.Sprintf("Client %s: %s | File: %s | Size: %s | Hash: %s",
+			client.IP, client.Status, client.FileName, formatBytes(client.FileSize), client.CalculatedHash)
+		if client.Status == "哈希校验失败" {
+			status += " | Expected: " + client.ExpectedHash
+		}
+		if client.Signer != "" {
+			status += " | Signer: " + client.Signer
+		}
+		lines = append(lines, status)
+	}
+	return lines
+}
+
+// overallProgressLine sums the active transfers into one progress and ETA
+// estimate: the bytes still to come divided by the transfers' combined
+// current speed. Streams do not know their size yet and are only counted.
+func overallProgressLine() string {
+	var total, received int64
+	var speed float64 // MB/s
+	streams := 0
+	clientsMu.Lock()
+	for _, client := range clients {
+		if client.Status != "传输中" {
+			continue
+		}
+		speed += client.Speed()
+		if client.FileSize == 0 && client.Received > 0 {
+			streams++
+			continue
+		}
+		total += client.FileSize
+		received += client.Received
+	}
+	clientsMu.Unlock()
+
+	percent := 100.0
+	if total > 0 {
+		percent = float64(received) / float64(total) * 100
+	}
+	eta := "--"
+	if remaining := total - received; remaining == 0 && streams == 0 {
+		eta = "idle"
+	} else if remaining > 0 && speed > 0 {
+		eta = (time.Duration(float64(remaining) / (speed * 1024 * 1024) * float64(time.Second))).Round(time.Second).String()
+	}
+	line := fmt.Sprintf("Overall: %.1f%% | Remaining: %s | Aggregate Speed: %.2f MB/s | ETA: %s",
+		percent, formatBytes(total-received), speed, eta)
+	if streams > 0 {
+		line += fmt.Sprintf(" (+%d streams of unknown size)", streams)
+	}
+	return line
+}
+
+// addCompletedClient appends client to completedClients, dropping the
+// oldest entries beyond maxCompletedClients.
+func addCompletedClient(client *Client) {
+	completedClientsMu.Lock()
+	defer completedClientsMu.Unlock()
+	completedClients = append(completedClients, client)
+	if over := len(completedClients) - maxCompletedClients; over > 0 {
+		// Shift rather than reslice, so the dropped clients can be freed
+		// and the backing array does not keep growing.
+		n := copy(completedClients, completedClients[over:])
+		for i := n; i < len(completedClients); i++ {
+			completedClients[i] = nil
+		}
+		completedClients = completedClients[:n]
+		droppedClients += int64(over)
+	}
+}
+
+// formatBytes formats bytes as human-readable strings
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseSize parses human-readable sizes such as "512KB", "4MB" or "1g" into
+// bytes. A bare number is taken as bytes.
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+	multiplier := int64(1)
+	if n := len(str); n > 0 {
+		if i := strings.IndexByte("KMGT", str[n-1]); i >= 0 {
+			for ; i >= 0; i-- {
+				multiplier *= 1024
+			}
+			str = str[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
@@ -0,0 +1,245 @@
+package transfer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"x.bin", "x.bin", false},
+		{"dir/x.bin", "x.bin", false},
+		{`C:\Users\me\x.bin`, "x.bin", false},
+		{"/etc/passwd", "passwd", false},
+		{"../x.bin", "", true},
+		{`a\..\x.bin`, "", true},
+		{"", "", true},
+		{"/", "", true},
+		{"./.", "", true},
+		{"x\n.bin", "", true},
+		{"x\u202e.bin", "", true},
+		{"\xff.bin", "", true},
+		{strings.Repeat("a", DefaultMaxNameLength+1), "", true},
+		{resumeStateFile, "", true},
+		{ipUsageFile + ".tmp", "", true},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeFileName(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("sanitizeFileName(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// uploadHeader returns the info header fields of a plain upload of data.
+func uploadHeader(name string, data []byte) []string {
+	fields := make([]string, headerFields)
+	fields[fieldVersion] = strconv.Itoa(ProtocolVersion)
+	fields[fieldName] = name
+	fields[fieldSize] = strconv.Itoa(len(data))
+	fields[fieldHash] = sha256Hex(data)
+	fields[fieldResume] = "true"
+	fields[fieldSigned] = "false"
+	fields[fieldHashAlgo] = "sha256"
+	return fields
+}
+
+// signHeader sets the HMAC field of fields, keyed with key.
+func signHeader(fields []string, key string) {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(strings.Join(fields[:fieldAuth], "|")))
+	fields[fieldAuth] = hex.EncodeToString(h.Sum(nil))
+}
+
+// readTestFrame reads one length-prefixed frame from conn.
+func readTestFrame(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	return string(frame)
+}
+
+// upload sends header to handleTransfer over a pipe, then data from the
+// offset the server replies with and the header's hash. It returns the
+// offset reply, or the rejection, and the result.
+func upload(t *testing.T, fields []string, data []byte) (reply, result string) {
+	t.Helper()
+	return uploadWithTrailer(t, fields, data, nil)
+}
+
+// uploadWithTrailer is upload that sends trailer, such as a signature
+// frame, after the hash.
+func uploadWithTrailer(t *testing.T, fields []string, data, trailer []byte) (reply, result string) {
+	t.Helper()
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		defer server.Close()
+		done <- handleTransfer(server, "test")
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeFrame(client, []byte(strings.Join(fields, "|"))); err != nil {
+		t.Fatal(err)
+	}
+	reply = readTestFrame(t, client)
+	parts := strings.Split(reply, "|")
+	if len(parts) != 3 {
+		<-done
+		return reply, ""
+	}
+	offset, err := strconv.Atoi(parts[0])
+	if err != nil {
+		t.Fatalf("offset reply %q", reply)
+	}
+	if offset < len(data) || parts[1] != fields[fieldHash] {
+		sent := append(append(data[offset:len(data):len(data)], fields[fieldHash]...), trailer...)
+		if _, err := client.Write(sent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	result = readTestFrame(t, client)
+	<-done
+	return reply, result
+}
+
+// useTestStorage stores files in a temporary directory and requires token,
+// with no resume state left over from other tests.
+func useTestStorage(t *testing.T, token string) {
+	t.Helper()
+	oldStorage, oldToken := storage, authToken
+	t.Cleanup(func() {
+		storage, authToken = oldStorage, oldToken
+		fileState.Range(func(key, _ interface{}) bool {
+			fileState.Delete(key)
+			return true
+		})
+	})
+	storage, authToken = localStorage{root: t.TempDir()}, []byte(token)
+}
+
+func TestHandleTransfer(t *testing.T) {
+	data := testData(100000)
+	old := testData(500)
+
+	tests := []struct {
+		name       string
+		stored     []byte // stored as x.bin beforehand
+		header     func(fields []string)
+		key        string
+		data       []byte
+		wantReply  string // offset reply or rejection
+		wantResult string // status, empty for a rejection
+	}{
+		{name: "upload", key: "secret", wantReply: "0||", wantResult: "传输完成"},
+		{name: "path in the name is dropped", header: func(f []string) { f[fieldName] = "dir/x.bin" }, key: "secret", wantReply: "0||", wantResult: "传输完成"},
+		{name: "other protocol version", header: func(f []string) { f[fieldVersion] = "1" }, key: "secret", wantReply: protocolMismatch + " 1, server speaks " + strconv.Itoa(ProtocolVersion)},
+		{name: "extra field", header: func(f []string) { f[fieldLinkTo] = "a|b" }, key: "secret", wantReply: "malformed file info"},
+		{name: "negative size", header: func(f []string) { f[fieldSize] = "-5" }, key: "secret", wantReply: "malformed file info"},
+		{name: "wrong token", key: "other", wantReply: authFailed},
+		{name: "invalid name", header: func(f []string) { f[fieldName] = "../x.bin" }, key: "secret", wantReply: "invalid file name"},
+		{name: "unknown hash algorithm", header: func(f []string) { f[fieldHashAlgo] = "md5" }, key: "secret", wantReply: unsupportedHash},
+		{name: "corrupted data", key: "secret", data: testData(len(data) + 1)[1:], wantReply: "0||", wantResult: "哈希校验失败"},
+		{name: "If-Match of the stored file", stored: old, header: func(f []string) { f[fieldIfMatch] = sha256Hex(old) }, key: "secret", wantReply: "0||", wantResult: "传输完成"},
+		{name: "If-Match of another version", stored: old, header: func(f []string) { f[fieldIfMatch] = sha256Hex(data) }, key: "secret", wantReply: versionConflict},
+		{name: "If-Match without a stored file", header: func(f []string) { f[fieldIfMatch] = sha256Hex(old) }, key: "secret", wantReply: versionConflict},
+		{name: "replaces the stored file", stored: old, key: "secret", wantReply: "0||", wantResult: "传输完成"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestStorage(t, "secret")
+			if tt.stored != nil {
+				storeTestFile(t, "x.bin", tt.stored)
+			}
+			fields := uploadHeader("x.bin", data)
+			signHeader(fields, tt.key)
+			if tt.header != nil {
+				tt.header(fields)
+				if tt.key == "secret" {
+					signHeader(fields, tt.key)
+				}
+			}
+			sent := data
+			if tt.data != nil {
+				sent = tt.data
+			}
+			reply, result := upload(t, fields, sent)
+			if reply != tt.wantReply {
+				t.Fatalf("reply %q, want %q", reply, tt.wantReply)
+			}
+			if status, _, _ := strings.Cut(result, "|"); status != tt.wantResult {
+				t.Fatalf("result %q, want status %q", result, tt.wantResult)
+			}
+			if tt.wantResult == "传输完成" {
+				if got := readStored(t, "x.bin"); sha256Hex(got) != sha256Hex(data) {
+					t.Errorf("stored %d bytes that differ from the upload", len(got))
+				}
+			}
+		})
+	}
+}
+
+func TestHandleTransferResumes(t *testing.T) {
+	useTestStorage(t, "")
+	data := testData(10000)
+	file, err := storage.Create(partName("x.bin"), int64(len(data)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAtFull(file, data[:4000], 0)
+	file.Close()
+	fileState.Store(newResumeKey("x.bin", sha256Hex(data), 0), int64(4000))
+
+	fields := uploadHeader("x.bin", data)
+	reply, result := upload(t, fields, data)
+	if want := "4000|" + sha256Hex(data[:4000]) + "|"; reply != want {
+		t.Fatalf("reply %q, want %q", reply, want)
+	}
+	if !strings.HasPrefix(result, "传输完成|") {
+		t.Fatalf("result %q, want the upload completed", result)
+	}
+	if got := readStored(t, "x.bin"); sha256Hex(got) != sha256Hex(data) {
+		t.Errorf("stored %d bytes that differ from the upload", len(got))
+	}
+}
+
+// TestHandleTransferRejectsOversizedHeader announces a header far beyond
+// maxInfoLen and checks it is refused before any of it is read.
+func TestHandleTransferRejectsOversizedHeader(t *testing.T) {
+	useTestStorage(t, "secret")
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		defer server.Close()
+		done <- handleTransfer(server, "test")
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := binary.Write(client, binary.BigEndian, uint32(1<<31)); err != nil {
+		t.Fatal(err)
+	}
+	if reply := readTestFrame(t, client); reply != "malformed file info" {
+		t.Errorf("reply %q, want the header refused", reply)
+	}
+	if <-done {
+		t.Error("connection kept in step after an oversized header")
+	}
+}
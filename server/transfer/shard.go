@@ -0,0 +1,219 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Policies for placing new files over the -dir shards (-shard-policy).
+const (
+	shardLeastFull  = "least-full"
+	shardRoundRobin = "round-robin"
+)
+
+var (
+	// storageDirs are all directories given with -dir. The first is
+	// storageDir, which also keeps the server's own state files.
+	storageDirs []string
+	// shardPolicy picks the shard for a file that is not stored yet.
+	shardPolicy = shardLeastFull
+)
+
+// parseStorageDirs splits a comma-separated -dir value. A directory may not
+// be given twice or lie inside another, as their files would be listed and
+// counted twice.
+func parseStorageDirs(value string) ([]string, error) {
+	var dirs, abs []string
+	for _, dir := range strings.Split(value, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		a, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		for i, other := range abs {
+			switch {
+			case a == other:
+				return nil, fmt.Errorf("%s is given twice", dir)
+			case isWithin(other, a):
+				return nil, fmt.Errorf("%s is inside %s", dir, dirs[i])
+			case isWithin(a, other):
+				return nil, fmt.Errorf("%s is inside %s", dirs[i], dir)
+			}
+		}
+		dirs = append(dirs, dir)
+		abs = append(abs, a)
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("no directory given")
+	}
+	return dirs, nil
+}
+
+// isWithin reports whether the absolute path child lies inside parent.
+func isWithin(parent, child string) bool {
+	rel, err := filepath.Rel(parent, child)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// shardedStorage spreads files over several local directories, such as
+// different disks (-dir a,b,c). A file that is not stored anywhere yet goes
+// to the shard chosen by shardPolicy. Once its part file or final name
+// exists in a shard, resumes and overwrites of it stay there, and lookups
+// by name search the shards, so resume, verify and download find it again.
+type shardedStorage struct {
+	shards []localStorage
+
+	// mu makes finding or placing a file and creating it one step, so the
+	// connections of a parallel upload all end up in the same shard.
+	mu sync.Mutex
+	// next is where the round-robin policy continues.
+	next int
+}
+
+func newShardedStorage(dirs []string) *shardedStorage {
+	s := &shardedStorage{}
+	for _, dir := range dirs {
+		s.shards = append(s.shards, localStorage{root: dir})
+	}
+	return s
+}
+
+// locate returns the index of the shard holding name, or -1. The caller
+// holds s.mu.
+func (s *shardedStorage) locate(name string) int {
+	for i, shard := range s.shards {
+		if _, err := os.Stat(shard.path(name)); err == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// pick chooses the shard for a new file of size bytes. Shards known to have
+// less free space than that are passed over; if that is all of them, the
+// file is refused as if the disk were full. The caller holds s.mu.
+func (s *shardedStorage) pick(name string, size int64) (int, error) {
+	best, bestFree := -1, int64(-1)
+	for k := range s.shards {
+		i := k
+		if shardPolicy == shardRoundRobin {
+			i = (s.next + k) % len(s.shards)
+		}
+		free, ok := freeSpace(s.shards[i].root)
+		if ok && free < size {
+			continue
+		}
+		if shardPolicy == shardRoundRobin {
+			s.next = i + 1
+			return i, nil
+		}
+		if best < 0 || free > bestFree {
+			best, bestFree = i, free
+		}
+	}
+	if best < 0 {
+		return -1, &fs.PathError{Op: "create", Path: name, Err: syscall.ENOSPC}
+	}
+	return best, nil
+}
+
+func (s *shardedStorage) Create(name string, size int64, fresh bool) (StorageFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.locate(name)
+	if i < 0 {
+		// A new upload of a stored file goes next to it.
+		i = s.locate(strings.TrimSuffix(name, partSuffix))
+	}
+	if i < 0 {
+		var err error
+		if i, err = s.pick(name, size); err != nil {
+			return nil, err
+		}
+	}
+	return s.shards[i].Create(name, size, fresh)
+}
+
+// Rename renames within the shard holding oldName. A copy of newName in
+// another shard, left from an upload that started there under another
+// name, is removed so that lookups cannot find the stale one.
+func (s *shardedStorage) Rename(oldName, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.locate(oldName)
+	if i < 0 {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	if err := s.shards[i].Rename(oldName, newName); err != nil {
+		return err
+	}
+	for j, shard := range s.shards {
+		if j == i {
+			continue
+		}
+		if err := os.Remove(shard.path(newName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStorage) Stat(name string) (fs.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.locate(name)
+	if i < 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return s.shards[i].Stat(name)
+}
+
+func (s *shardedStorage) Open(name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.locate(name)
+	if i < 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return s.shards[i].Open(name)
+}
+
+// shardOf returns the directory of the shard holding name, or of its part
+// file while it is being received, for the manifest and the resume state.
+// It is empty unless files are sharded.
+func shardOf(name string) string {
+	s, ok := storage.(*shardedStorage)
+	if !ok {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.locate(name)
+	if i < 0 {
+		i = s.locate(partName(name))
+	}
+	if i < 0 {
+		return ""
+	}
+	return s.shards[i].root
+}
+
+// isStorageDir reports whether dir is one of the -dir directories.
+func isStorageDir(dir string) bool {
+	for _, d := range storageDirs {
+		if d == dir {
+			return true
+		}
+	}
+	return false
+}
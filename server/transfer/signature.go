@@ -0,0 +1,60 @@
+package transfer
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// maxSignatureLen bounds the signature frame a client may send.
+const maxSignatureLen = 1024
+
+var (
+	// verifyKey checks detached signatures when -pubkey is set.
+	verifyKey        ed25519.PublicKey
+	requireSignature bool
+)
+
+// LoadPublicKey reads a PEM "PUBLIC KEY" (PKIX) ed25519 key, as written by
+// `openssl pkey -pubout`.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T, want ed25519", key)
+	}
+	return pub, nil
+}
+
+// keyFingerprint identifies a signer in logs and status output.
+func keyFingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "ed25519:" + hex.EncodeToString(sum[:8])
+}
+
+// verifySignature checks sig over the hex content hash of the received file.
+func verifySignature(hash string, sig []byte) error {
+	if len(sig) == 0 {
+		return errors.New("missing signature")
+	}
+	if !ed25519.Verify(verifyKey, []byte(hash), sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package transfer
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// signatureFrame is what the client sends after the hash of a signed
+// upload: a 4-byte big-endian length and the signature over the hex hash.
+func signatureFrame(key ed25519.PrivateKey, hash string) []byte {
+	sig := ed25519.Sign(key, []byte(hash))
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(sig)))
+	return append(frame, sig...)
+}
+
+// useVerifyKey checks signatures with pub, as -pubkey does, requiring them
+// if require is set.
+func useVerifyKey(t *testing.T, pub ed25519.PublicKey, require bool) {
+	t.Helper()
+	oldKey, oldRequire := verifyKey, requireSignature
+	t.Cleanup(func() { verifyKey, requireSignature = oldKey, oldRequire })
+	verifyKey, requireSignature = pub, require
+}
+
+func TestLoadPublicKey(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadPublicKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(pub) {
+		t.Error("loaded key differs from the one written")
+	}
+
+	garbage := filepath.Join(dir, "garbage.pub")
+	os.WriteFile(garbage, []byte("not a key"), 0644)
+	if _, err := LoadPublicKey(garbage); err == nil {
+		t.Error("LoadPublicKey accepted a file without PEM data")
+	}
+}
+
+func TestHandleTransferSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := testData(50000)
+	hash := sha256Hex(data)
+	tampered := signatureFrame(priv, hash)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name       string
+		require    bool
+		signed     bool
+		trailer    []byte
+		wantReply  string
+		wantResult string
+	}{
+		{name: "valid signature", signed: true, trailer: signatureFrame(priv, hash), wantReply: "0||", wantResult: "传输完成"},
+		{name: "tampered signature", signed: true, trailer: tampered, wantReply: "0||", wantResult: "签名校验失败"},
+		{name: "signed with another key", signed: true, trailer: signatureFrame(otherPriv, hash), wantReply: "0||", wantResult: "签名校验失败"},
+		{name: "unsigned without -require-signature", wantReply: "0||", wantResult: "传输完成"},
+		{name: "unsigned with -require-signature", require: true, wantReply: "signature required"},
+		{name: "signed with -require-signature", require: true, signed: true, trailer: signatureFrame(priv, hash), wantReply: "0||", wantResult: "传输完成"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestStorage(t, "")
+			useVerifyKey(t, pub, tt.require)
+			fields := uploadHeader("x.bin", data)
+			if tt.signed {
+				fields[fieldSigned] = "true"
+			}
+			reply, result := uploadWithTrailer(t, fields, data, tt.trailer)
+			if reply != tt.wantReply {
+				t.Fatalf("reply %q, want %q", reply, tt.wantReply)
+			}
+			if status, _, _ := strings.Cut(result, "|"); status != tt.wantResult {
+				t.Fatalf("result %q, want status %q", result, tt.wantResult)
+			}
+			if _, err := storage.Stat("x.bin"); (err == nil) != (tt.wantResult == "传输完成") {
+				t.Errorf("x.bin stored: %v, want stored only on success", err == nil)
+			}
+		})
+	}
+}
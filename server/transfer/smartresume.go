@@ -0,0 +1,141 @@
+package transfer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// blocksRequest starts a header asking for the hashes of the blocks of a
+// part file, so a client whose prefix check failed (-smart-resume) can find
+// the first block that differs and resume from there instead of from the
+// start.
+const blocksRequest = "BLOCKS"
+
+// Blocks header fields, in wire order.
+const (
+	bkFieldType    = iota // blocksRequest
+	bkFieldVersion        // ProtocolVersion
+	bkFieldName
+	bkFieldDest     // as fieldDest
+	bkFieldHashAlgo // as fieldHashAlgo, used for the block hashes
+	bkFieldHash     // the client's hash of the whole file, keying the resume state
+	bkFieldStart    // first byte of the range, 0 for a whole file
+	bkFieldBlock    // block size in bytes
+	bkFieldAuth     // HMAC of the fields before it, see -token
+	blocksFields
+)
+
+// minResumeBlock keeps a block request from asking for a hash per few
+// bytes; the largest block is maxCheckedChunk.
+const minResumeBlock = 64 * 1024
+
+// handleBlocks answers a blocks request with the absolute offset up to
+// which the part file can be resumed, then one frame per block with the
+// hex hash of that block, the last one possibly short, then an empty frame.
+// It reports whether the connection is still in step.
+func handleBlocks(conn net.Conn, clientIP string, info []string, tlog *transferLog) bool {
+	if len(info) != blocksFields {
+		tlog.Warn("malformed blocks request", "client_ip", clientIP, "fields", len(info))
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+	if version, err := strconv.Atoi(info[bkFieldVersion]); err != nil || version != ProtocolVersion {
+		tlog.Warn("unsupported protocol version", "client_ip", clientIP, "version", info[bkFieldVersion])
+		rejectConnection(conn, fmt.Sprintf("%s %s, server speaks %d", protocolMismatch, info[bkFieldVersion], ProtocolVersion))
+		return false
+	}
+	if !authenticate(strings.Join(info[:bkFieldAuth], "|"), info[bkFieldAuth]) {
+		tlog.Warn("rejected blocks request with invalid token HMAC", "client_ip", clientIP)
+		rejectConnection(conn, authFailed)
+		return false
+	}
+	fileName, err := sanitizeFileName(info[bkFieldName])
+	if err != nil {
+		tlog.Warn("rejected file name", "client_ip", clientIP, "err", err)
+		rejectConnection(conn, "invalid file name")
+		return false
+	}
+	dest, err := sanitizeDestDir(info[bkFieldDest])
+	if err != nil {
+		tlog.Warn("rejected destination directory", "client_ip", clientIP, "err", err)
+		rejectConnection(conn, "invalid destination")
+		return false
+	}
+	if dest != "" {
+		fileName = path.Join(dest, fileName)
+	}
+	fileName = canonicalFileName(fileName)
+	newHash, ok := hashAlgorithms[info[bkFieldHashAlgo]]
+	if !ok {
+		tlog.Warn("unsupported hash algorithm", "client_ip", clientIP, "hash_algorithm", info[bkFieldHashAlgo])
+		rejectConnection(conn, unsupportedHash)
+		return false
+	}
+	start, errStart := strconv.ParseInt(info[bkFieldStart], 10, 64)
+	block, errBlock := strconv.ParseInt(info[bkFieldBlock], 10, 64)
+	if errStart != nil || errBlock != nil || start < 0 || block < minResumeBlock || block > maxCheckedChunk {
+		tlog.Warn("malformed blocks request", "client_ip", clientIP, "start", info[bkFieldStart], "block", info[bkFieldBlock])
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+
+	// The same offset an upload of this file and range would resume from.
+	var offset int64
+	if val, ok := fileState.Load(newResumeKey(fileName, info[bkFieldHash], start)); ok {
+		if stored, ok := storedOffset(fileName, start, val.(int64)); ok {
+			offset = stored
+		}
+	}
+	if err := writeFrame(conn, []byte(strconv.FormatInt(start+offset, 10))); err != nil {
+		tlog.Warn("error sending block hashes", "client_ip", clientIP, "err", err)
+		return false
+	}
+
+	blocks := 0
+	if offset > 0 {
+		err = sendBlockHashes(conn, partName(fileName), start, offset, block, newHash)
+		blocks = int((offset + block - 1) / block)
+	}
+	if err == nil {
+		err = writeFrame(conn, nil)
+	}
+	if err != nil {
+		tlog.Warn("error sending block hashes", "client_ip", clientIP, "file", fileName, "err", err)
+		return false
+	}
+	tlog.Info("sent block hashes", "client_ip", clientIP, "file", fileName, "start", start, "offset", start+offset, "blocks", blocks)
+	return true
+}
+
+// sendBlockHashes hashes n bytes of fileName from start in blocks of size
+// block and sends each hash as a frame. Once the header is answered the
+// client expects exactly the blocks up to the offset, so a file that
+// cannot be read fails the connection rather than sending fewer.
+func sendBlockHashes(conn net.Conn, fileName string, start, n, block int64, newHash func() hash.Hash) error {
+	file, err := openSection(fileName, start)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for n > 0 {
+		size := block
+		if n < size {
+			size = n
+		}
+		hasher := newHash()
+		if _, err := io.CopyN(hasher, file, size); err != nil {
+			return err
+		}
+		if err := writeFrame(conn, []byte(hex.EncodeToString(hasher.Sum(nil)))); err != nil {
+			return err
+		}
+		n -= size
+	}
+	return nil
+}
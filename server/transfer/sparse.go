@@ -0,0 +1,99 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net"
+)
+
+// In sparse mode (the header's fieldSparse) the client sends the data as
+// chunks, each prefixed with a 4-byte big-endian length. A length with
+// sparseHoleFlag set carries no data: the low 31 bits count zero bytes the
+// client skipped, which are left as a hole in the part file. The hash still
+// covers the zeros.
+const sparseHoleFlag = 1 << 31
+
+// sparseZeros is hashed in place of the bytes of a hole.
+var sparseZeros = make([]byte, 64*1024)
+
+// sparseReceiver reads sparse-mode chunks into one part file.
+type sparseReceiver struct {
+	// existing is the size of the part file before this upload wrote to
+	// it. Holes below it may cover stale data and are filled with zeros.
+	existing int64
+	// extend grows the file over a hole at its end, so the part file's size
+	// keeps up with the resume offset. Only a whole-file upload writes in
+	// order; a range leaves that to the connection that completes the file.
+	extend bool
+}
+
+// newSparseReceiver looks up how much of name is already on disk. If that
+// is unknown, every hole is written out as zeros.
+func newSparseReceiver(name string, extend bool) *sparseReceiver {
+	s := &sparseReceiver{existing: math.MaxInt64, extend: extend}
+	if info, err := storage.Stat(name); err == nil {
+		s.existing = info.Size()
+	}
+	return s
+}
+
+// read reads one chunk of at most limit bytes. It returns either the length
+// of the data read into *buf, growing it if needed, or the length of a hole.
+func (s *sparseReceiver) read(conn net.Conn, buf *[]byte, limit int64) (int, int64, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	n := int64(length &^ sparseHoleFlag)
+	if n == 0 || n > limit {
+		return 0, 0, fmt.Errorf("invalid sparse chunk length %d", n)
+	}
+	if length&sparseHoleFlag != 0 {
+		return 0, n, nil
+	}
+	if n > maxCheckedChunk {
+		return 0, 0, fmt.Errorf("invalid sparse chunk length %d", n)
+	}
+	if n > int64(len(*buf)) {
+		*buf = make([]byte, n)
+	}
+	if _, err := io.ReadFull(conn, (*buf)[:n]); err != nil {
+		return 0, 0, err
+	}
+	return int(n), 0, nil
+}
+
+// fillHole makes the n bytes at off read as zeros. Past the end of the
+// part file as it was when the upload started nothing needs writing.
+func (s *sparseReceiver) fillHole(file StorageFile, off, n int64) error {
+	for pos := off; pos < off+n && pos < s.existing; {
+		size := int64(len(sparseZeros))
+		if end := off + n; pos+size > end {
+			size = end - pos
+		}
+		if err := writeAtFull(file, sparseZeros[:size], pos); err != nil {
+			return err
+		}
+		pos += size
+	}
+	if s.extend && off+n > s.existing {
+		return file.Truncate(off + n)
+	}
+	return nil
+}
+
+// hashZeros feeds n zero bytes to h.
+func hashZeros(h hash.Hash, n int64) {
+	for n > 0 {
+		size := int64(len(sparseZeros))
+		if size > n {
+			size = n
+		}
+		h.Write(sparseZeros[:size])
+		n -= size
+	}
+}
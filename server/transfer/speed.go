@@ -0,0 +1,74 @@
+package transfer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// speedWindow is the time constant of the speed averages (-speed-window).
+// A lasting change in throughput is mostly reflected after one window,
+// while bursts and stalls shorter than it are smoothed out.
+var speedWindow = DefaultSpeedWindow
+
+// receiveSpeed averages the bytes received by all uploads together.
+var receiveSpeed speedMeter
+
+// speedMeter is an exponentially weighted moving average of a byte rate.
+// Bytes are folded in at most every speedSampleInterval, so short reads
+// do not make each sample a tiny, noisy one.
+type speedMeter struct {
+	mu      sync.Mutex
+	rate    float64 // bytes per second, as of last
+	start   time.Time
+	last    time.Time
+	pending int64 // bytes added since last
+}
+
+const speedSampleInterval = 100 * time.Millisecond
+
+// Add counts n bytes received now.
+func (m *speedMeter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.last.IsZero() {
+		m.start, m.last = now, now
+	}
+	m.pending += int64(n)
+	if now.Sub(m.last) < speedSampleInterval {
+		return
+	}
+	m.rate = m.rateAt(now)
+	m.last, m.pending = now, 0
+}
+
+// Rate returns the average in bytes per second. It keeps falling while no
+// bytes arrive, so a stalled transfer shows its stall.
+func (m *speedMeter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last.IsZero() {
+		return 0
+	}
+	now := time.Now()
+	// The average starts from zero; during the first windows, scale it by
+	// the weight the samples have gathered so far so it does not lag
+	// behind the real rate.
+	weight := 1 - math.Exp(-now.Sub(m.start).Seconds()/speedWindow.Seconds())
+	if weight <= 0 {
+		return 0
+	}
+	return m.rateAt(now) / weight
+}
+
+// rateAt folds the bytes pending since last into the average as one
+// sample at now. m.mu must be held.
+func (m *speedMeter) rateAt(now time.Time) float64 {
+	dt := now.Sub(m.last).Seconds()
+	if dt <= 0 {
+		return m.rate
+	}
+	alpha := 1 - math.Exp(-dt/speedWindow.Seconds())
+	return m.rate + alpha*(float64(m.pending)/dt-m.rate)
+}
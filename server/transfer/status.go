@@ -0,0 +1,45 @@
+package transfer
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// statusRequest is sent in place of a file info header to ask for the
+// server's status instead of starting a transfer.
+const statusRequest = "STATUS"
+
+// serverStatus is the reply to statusRequest. FreeBytes is -1 when the free
+// space of the storage backend is unknown, and the total of all shards when
+// -dir lists several directories.
+type serverStatus struct {
+	FreeBytes         int64    `json:"free_bytes"`
+	ActiveConnections int64    `json:"active_connections"`
+	Rankings          rankings `json:"rankings"`
+}
+
+func currentStatus() serverStatus {
+	status := serverStatus{FreeBytes: -1}
+	for _, root := range localRoots() {
+		if free, ok := freeSpace(root); ok {
+			if status.FreeBytes < 0 {
+				status.FreeBytes = 0
+			}
+			status.FreeBytes += free
+		}
+	}
+	clientsMu.Lock()
+	status.ActiveConnections = activeConnections
+	clientsMu.Unlock()
+	status.Rankings = computeRankings()
+	return status
+}
+
+// sendStatus answers a statusRequest with the status as framed JSON.
+func sendStatus(w io.Writer) error {
+	payload, err := json.Marshal(currentStatus())
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, payload)
+}
@@ -0,0 +1,225 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Storage is where received files end up. Names are the sanitized file names
+// used throughout handleConnection; backends map them to their own layout.
+type Storage interface {
+	// Create opens name for writing. Existing content is kept, so a resumed
+	// upload can keep writing at its offset, unless fresh is set. size is
+	// the expected final size, which backends may use to decide when a file
+	// is complete.
+	Create(name string, size int64, fresh bool) (StorageFile, error)
+	Rename(oldName, newName string) error
+	Stat(name string) (fs.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+}
+
+// StorageFile is an open, writable file in a Storage.
+type StorageFile interface {
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) error
+	// Sync commits what was written so far to stable storage.
+	Sync() error
+}
+
+// storageFailed starts the rejection sent when an upload's part file cannot
+// be created or opened, see storageFailure.
+const storageFailed = "cannot store file"
+
+// storageFailure is the rejection for err from Create. It names the cause
+// without passing on paths or other details of the server's disk.
+func storageFailure(err error) string {
+	reason := "I/O error"
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		reason = "permission denied"
+	case errors.Is(err, syscall.ENOSPC):
+		reason = "no space left on device"
+	case errors.Is(err, syscall.EROFS):
+		reason = "read-only file system"
+	}
+	return storageFailed + ": " + reason
+}
+
+// writeAtFull writes all of p at off. Like io.Writer, io.WriterAt must
+// report short writes as errors, but a backend that forgets would leave a
+// hole in the file, so a short count is finished or turned into an error.
+func writeAtFull(w io.WriterAt, p []byte, off int64) error {
+	for len(p) > 0 {
+		n, err := w.WriteAt(p, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		p, off = p[n:], off+int64(n)
+	}
+	return nil
+}
+
+// partSuffix marks a file that is still being received. It is renamed to
+// its final name only once the transfer completed and the hash verified, so
+// the final name never holds incomplete data.
+const partSuffix = ".part"
+
+func partName(name string) string {
+	return name + partSuffix
+}
+
+var (
+	// storage is the active backend, selected with -backend.
+	storage Storage = localStorage{root: storageDir}
+	// preallocateFiles reserves disk space for the whole file up front.
+	preallocateFiles bool
+)
+
+// prepareStorageDir creates dir if needed and makes sure files can be
+// written to it, so a bad -dir fails at startup rather than on the first
+// upload.
+func prepareStorageDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".write-test-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// setModTime sets the modification time of a stored file, as sent by a
+// client using -preserve-times. Only local storage keeps file times.
+func setModTime(name string, t time.Time) error {
+	path, ok := localPath(name)
+	if !ok {
+		return errors.New("storage backend does not keep modification times")
+	}
+	return os.Chtimes(path, t, t)
+}
+
+// syncStoredDir flushes the directory holding a stored file, so that its
+// rename from the part name survives a crash along with its data. Only local
+// storage needs this; Windows cannot sync directories and does not need to.
+func syncStoredDir(name string) error {
+	path, ok := localPath(name)
+	if !ok || runtime.GOOS == "windows" {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// localRoots are the directories files are stored in when they are kept on
+// local disk, one per shard, and nil for remote backends.
+func localRoots() []string {
+	switch s := storage.(type) {
+	case localStorage:
+		return []string{s.root}
+	case *shardedStorage:
+		roots := make([]string, len(s.shards))
+		for i, shard := range s.shards {
+			roots[i] = shard.root
+		}
+		return roots
+	}
+	return nil
+}
+
+// localPath is where the stored file name is on local disk. ok is false for
+// remote backends and for a sharded file that is not in any shard.
+func localPath(name string) (string, bool) {
+	switch s := storage.(type) {
+	case localStorage:
+		return s.path(name), true
+	case *shardedStorage:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if i := s.locate(name); i >= 0 {
+			return s.shards[i].path(name), true
+		}
+	}
+	return "", false
+}
+
+// openStorage parses a -backend value. An empty value selects the local
+// storage directory, or shards files over them when -dir lists several.
+func openStorage(backend string) (Storage, error) {
+	switch {
+	case backend == "" && len(storageDirs) > 1:
+		return newShardedStorage(storageDirs), nil
+	case backend == "":
+		return localStorage{root: storageDir}, nil
+	case strings.HasPrefix(backend, "s3://"):
+		return newS3Storage(strings.TrimPrefix(backend, "s3://"))
+	default:
+		return nil, fmt.Errorf("unsupported storage backend %q", backend)
+	}
+}
+
+// localStorage keeps files in a directory on local disk.
+type localStorage struct {
+	root string
+}
+
+func (l localStorage) path(name string) string {
+	return filepath.Join(l.root, name)
+}
+
+func (l localStorage) Create(name string, size int64, fresh bool) (StorageFile, error) {
+	// name may sit in a -dest subdirectory.
+	if err := os.MkdirAll(filepath.Dir(l.path(name)), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return openForWrite(l.path(name), size, fresh)
+}
+
+// openForWrite opens path for writing, emptying it first if fresh is set
+// and reserving size bytes when -preallocate is set.
+func openForWrite(path string, size int64, fresh bool) (*os.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY
+	if fresh {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if preallocateFiles && size > 0 {
+		if err := preallocate(file, size); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to preallocate %d bytes: %w", size, err)
+		}
+	}
+	return file, nil
+}
+
+func (l localStorage) Rename(oldName, newName string) error {
+	return os.Rename(l.path(oldName), l.path(newName))
+}
+
+func (l localStorage) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(l.path(name))
+}
+
+func (l localStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
@@ -0,0 +1,1010 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3PartTries  = 3
+	s3MaxCopyLen = 5 * 1024 * 1024 * 1024 // CopyObject limit for Rename
+	// s3PiecesDir holds the pieces of part files, under the -backend prefix.
+	s3PiecesDir = ".eilecores-parts"
+)
+
+var (
+	s3Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	s3Region   = os.Getenv("AWS_REGION")
+	// s3PieceSize is the most a piece holds, and so how much of a part file
+	// a connection buffers in memory, as well as the size of the parts a
+	// file is assembled from. s3MinPartSize is the least S3 accepts for
+	// every part of a multipart upload but the last.
+	s3PieceSize   int64 = 16 * 1024 * 1024
+	s3MinPartSize int64 = 5 * 1024 * 1024
+)
+
+// s3Storage stores files in an S3-compatible bucket without keeping them on
+// local disk. Objects cannot be written at an offset, and the parts of a
+// multipart upload cannot be read back before it completes, while resuming
+// needs both: a client may resume at any offset, and the server hashes the
+// bytes it already has. A part file is therefore kept as pieces, objects
+// under s3PiecesDir that each hold one run of bytes, at most s3PieceSize
+// long. Renaming the part file to its final name assembles the pieces into
+// the object with a multipart upload, copying them within the bucket where
+// they are large enough, and deletes them, so unverified data never reaches
+// a final name.
+type s3Storage struct {
+	bucket    string
+	prefix    string
+	endpoint  *url.URL
+	pathStyle bool
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+
+	mu      sync.Mutex
+	uploads map[string]*s3Upload // part files with open handles, by name
+}
+
+// newS3Storage takes "bucket/prefix". Credentials come from the usual
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables.
+func newS3Storage(location string) (*s3Storage, error) {
+	bucket, prefix, _ := strings.Cut(location, "/")
+	if bucket == "" {
+		return nil, errors.New("s3 backend needs a bucket, e.g. s3://bucket/prefix")
+	}
+
+	s := &s3Storage{
+		bucket:    bucket,
+		prefix:    strings.Trim(prefix, "/"),
+		region:    s3Region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{Timeout: 10 * time.Minute},
+		uploads:   make(map[string]*s3Upload),
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("s3 backend needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	endpoint := s3Endpoint
+	if endpoint == "" {
+		// AWS itself prefers virtual-hosted buckets.
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, s.region)
+	} else {
+		// Custom endpoints (MinIO, Ceph, ...) are addressed path-style.
+		s.pathStyle = true
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	s.endpoint = u
+	return s, nil
+}
+
+func (s *s3Storage) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+// pieceKey is the object holding piece p of part file name.
+func (s *s3Storage) pieceKey(name string, p s3Piece) string {
+	return s.key(path.Join(s3PiecesDir, name)) + "/" + p.objectName()
+}
+
+// s3Piece is bytes [start, end) of a part file. A hole reads as zeros and is
+// stored as an empty object.
+type s3Piece struct {
+	start, end int64
+	hole       bool
+	modTime    time.Time
+}
+
+func (p s3Piece) objectName() string {
+	name := fmt.Sprintf("%016x-%016x", p.start, p.end)
+	if p.hole {
+		name += ".z"
+	}
+	return name
+}
+
+// parseS3Piece is the reverse of objectName.
+func parseS3Piece(name string) (s3Piece, bool) {
+	var p s3Piece
+	if strings.HasSuffix(name, ".z") {
+		p.hole = true
+		name = strings.TrimSuffix(name, ".z")
+	}
+	startHex, endHex, ok := strings.Cut(name, "-")
+	if !ok {
+		return p, false
+	}
+	start, err1 := strconv.ParseInt(startHex, 16, 64)
+	end, err2 := strconv.ParseInt(endHex, 16, 64)
+	if err1 != nil || err2 != nil || start < 0 || end <= start {
+		return p, false
+	}
+	p.start, p.end = start, end
+	return p, true
+}
+
+// s3Upload is a part file while handles to it are open. Every handle
+// stores its pieces through it, so pieces holds the part file as stored.
+type s3Upload struct {
+	files map[*s3File]bool // guarded by s3Storage.mu
+
+	mu        sync.Mutex
+	pieces    []s3Piece // sorted by start, never overlapping
+	lastWrite time.Time
+}
+
+// s3File is a handle to a part file. Writes that follow each other are
+// gathered in buf and stored as a piece once s3PieceSize is reached, and
+// before a write elsewhere in the file, Sync, Truncate and Close.
+type s3File struct {
+	storage *s3Storage
+	name    string
+	upload  *s3Upload
+
+	mu       sync.Mutex
+	buf      []byte
+	bufStart int64
+}
+
+func (s *s3Storage) Create(name string, size int64, fresh bool) (StorageFile, error) {
+	if !strings.HasSuffix(name, partSuffix) {
+		return nil, fmt.Errorf("s3 backend only writes %s files", partSuffix)
+	}
+	s.mu.Lock()
+	u := s.uploads[name]
+	if u == nil {
+		pieces, err := s.listPieces(name)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		u = &s3Upload{files: make(map[*s3File]bool), pieces: pieces}
+		s.uploads[name] = u
+	}
+	f := &s3File{storage: s, name: name, upload: u}
+	u.files[f] = true
+	s.mu.Unlock()
+
+	if fresh {
+		if err := s.truncatePieces(u, name, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *s3File) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.buf) > 0 && (off < f.bufStart || off > f.bufStart+int64(len(f.buf))) {
+		if err := f.flush(int64(len(f.buf))); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.buf) == 0 {
+		f.bufStart = off
+	}
+	n := copy(f.buf[off-f.bufStart:], p)
+	f.buf = append(f.buf, p[n:]...)
+	for int64(len(f.buf)) >= s3PieceSize {
+		if err := f.flush(s3PieceSize); err != nil {
+			return 0, err
+		}
+	}
+	f.upload.mu.Lock()
+	f.upload.lastWrite = time.Now()
+	f.upload.mu.Unlock()
+	return len(p), nil
+}
+
+// flush stores the first n bytes of buf as a piece.
+func (f *s3File) flush(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	p := s3Piece{start: f.bufStart, end: f.bufStart + n}
+	if err := f.storage.storePiece(f.upload, f.name, p, f.buf[:n]); err != nil {
+		return err
+	}
+	f.buf = append(f.buf[:0], f.buf[n:]...)
+	f.bufStart += n
+	return nil
+}
+
+// Sync stores what is buffered. A piece is durable once stored.
+func (f *s3File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flush(int64(len(f.buf)))
+}
+
+func (f *s3File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.flush(int64(len(f.buf))); err != nil {
+		return err
+	}
+	return f.storage.truncatePieces(f.upload, f.name, size)
+}
+
+func (f *s3File) Close() error {
+	err := f.Sync()
+	s := f.storage
+	s.mu.Lock()
+	delete(f.upload.files, f)
+	if len(f.upload.files) == 0 && s.uploads[f.name] == f.upload {
+		delete(s.uploads, f.name)
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// storePiece uploads data as piece p of part file name, then drops what it
+// replaces of older pieces, storing their remainders as pieces of their
+// own.
+func (s *s3Storage) storePiece(u *s3Upload, name string, p s3Piece, data []byte) error {
+	if err := s.putObject(s.pieceKey(name, p), data); err != nil {
+		return err
+	}
+	p.modTime = time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return s.replacePieces(u, name, p.start, p.end, []s3Piece{p})
+}
+
+// truncatePieces cuts part file name to size, or extends it with a hole.
+func (s *s3Storage) truncatePieces(u *s3Upload, name string, size int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var end int64
+	for _, p := range u.pieces {
+		if p.end > end {
+			end = p.end
+		}
+	}
+	if size >= end {
+		if size == end {
+			return nil
+		}
+		hole := s3Piece{start: end, end: size, hole: true, modTime: time.Now()}
+		if err := s.putObject(s.pieceKey(name, hole), nil); err != nil {
+			return err
+		}
+		u.pieces = append(u.pieces, hole)
+		return nil
+	}
+	return s.replacePieces(u, name, size, end, nil)
+}
+
+// replacePieces drops the bytes [start, end) of u's pieces and adds added,
+// which cover them or are stored already. u.mu is held.
+func (s *s3Storage) replacePieces(u *s3Upload, name string, start, end int64, added []s3Piece) error {
+	kept := added
+	var dropped []s3Piece
+	for _, old := range u.pieces {
+		if old.end <= start || old.start >= end {
+			kept = append(kept, old)
+			continue
+		}
+		if old.start < start {
+			left, err := s.slicePiece(name, old, old.start, start)
+			if err != nil {
+				return err
+			}
+			kept = append(kept, left)
+		}
+		if old.end > end {
+			right, err := s.slicePiece(name, old, end, old.end)
+			if err != nil {
+				return err
+			}
+			kept = append(kept, right)
+		}
+		dropped = append(dropped, old)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].start < kept[j].start })
+	u.pieces = kept
+	for _, old := range dropped {
+		if err := s.deleteObject(s.pieceKey(name, old)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slicePiece stores bytes [start, end) of piece p as a piece of their own.
+func (s *s3Storage) slicePiece(name string, p s3Piece, start, end int64) (s3Piece, error) {
+	slice := s3Piece{start: start, end: end, hole: p.hole, modTime: p.modTime}
+	var data []byte
+	if !p.hole {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start-p.start, end-p.start-1)}}
+		resp, err := s.do(http.MethodGet, s.pieceKey(name, p), nil, header, nil)
+		if err != nil {
+			return slice, err
+		}
+		data, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return slice, err
+		}
+		if int64(len(data)) != end-start {
+			return slice, fmt.Errorf("piece %s of %s is shorter than its name says", p.objectName(), name)
+		}
+	}
+	return slice, s.putObject(s.pieceKey(name, slice), data)
+}
+
+// listPieces reads the pieces of part file name from the bucket. Pieces only
+// overlap when the server stopped while replacing one; which of them holds
+// the newer bytes is not known, so both are dropped and the client sends
+// that range again.
+func (s *s3Storage) listPieces(name string) ([]s3Piece, error) {
+	prefix := s.key(path.Join(s3PiecesDir, name)) + "/"
+	var pieces []s3Piece
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the pieces of %s: %w", name, err)
+		}
+		for _, c := range result.Contents {
+			if p, ok := parseS3Piece(strings.TrimPrefix(c.Key, prefix)); ok {
+				p.modTime = c.LastModified
+				pieces = append(pieces, p)
+			}
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(pieces, func(i, j int) bool { return pieces[i].start < pieces[j].start })
+
+	overlaps := make([]bool, len(pieces))
+	for i := range pieces {
+		for j := 0; j < i; j++ {
+			if pieces[j].end > pieces[i].start {
+				overlaps[i], overlaps[j] = true, true
+			}
+		}
+	}
+	var kept []s3Piece
+	for i, p := range pieces {
+		if !overlaps[i] {
+			kept = append(kept, p)
+			continue
+		}
+		logWarn("dropping overlapping piece of a part file", "file", name, "start", p.start, "end", p.end)
+		if err := s.deleteObject(s.pieceKey(name, p)); err != nil {
+			return nil, err
+		}
+	}
+	return kept, nil
+}
+
+// pieces returns the pieces of part file name and when it was last written
+// to, and whether it has open handles.
+func (s *s3Storage) pieces(name string) ([]s3Piece, time.Time, bool, error) {
+	s.mu.Lock()
+	u := s.uploads[name]
+	s.mu.Unlock()
+	if u == nil {
+		pieces, err := s.listPieces(name)
+		return pieces, time.Time{}, false, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]s3Piece(nil), u.pieces...), u.lastWrite, true, nil
+}
+
+// storedRun is how many bytes from start on the pieces of part file name
+// hold without a gap. Unlike a hole, a gap is data that never got stored,
+// such as what a connection buffered when the server stopped, so a range
+// must not resume past it. See storedOffset.
+func (s *s3Storage) storedRun(name string, start int64) (int64, error) {
+	pieces, _, _, err := s.pieces(name)
+	if err != nil {
+		return 0, err
+	}
+	pos := start
+	for _, p := range pieces {
+		if p.start <= pos && pos < p.end {
+			pos = p.end
+		}
+	}
+	return pos - start, nil
+}
+
+func (s *s3Storage) Rename(oldName, newName string) error {
+	switch {
+	case strings.HasSuffix(oldName, partSuffix) && strings.HasSuffix(newName, partSuffix):
+		return s.movePieces(oldName, newName)
+	case strings.HasSuffix(oldName, partSuffix):
+		if err := s.assemble(oldName, newName); err != nil {
+			return fmt.Errorf("failed to upload %s to s3: %w", newName, err)
+		}
+		return nil
+	}
+
+	info, err := s.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if info.Size() > s3MaxCopyLen {
+		return fmt.Errorf("cannot rename %s: objects over 5GB cannot be copied", oldName)
+	}
+	if err := s.copyObject(s.key(oldName), s.key(newName)); err != nil {
+		return err
+	}
+	return s.deleteObject(s.key(oldName))
+}
+
+// movePieces renames part file oldName to newName, piece by piece.
+func (s *s3Storage) movePieces(oldName, newName string) error {
+	pieces, _, open, err := s.pieces(oldName)
+	if err != nil {
+		return err
+	}
+	if open {
+		return fmt.Errorf("cannot rename %s while it is being written", oldName)
+	}
+	for _, p := range pieces {
+		if err := s.copyObject(s.pieceKey(oldName, p), s.pieceKey(newName, p)); err != nil {
+			return err
+		}
+		if err := s.deleteObject(s.pieceKey(oldName, p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assemble stores part file partName as object name with a multipart
+// upload, then deletes its pieces. A piece of at least s3MinPartSize is
+// copied within the bucket as one part; smaller pieces, holes and gaps are
+// gathered in memory into parts of about s3PieceSize.
+func (s *s3Storage) assemble(partName, name string) error {
+	pieces, _, _, err := s.pieces(partName)
+	if err != nil {
+		return err
+	}
+	key := s.key(name)
+	if len(pieces) == 0 {
+		// An empty file: multipart uploads need at least one part.
+		return s.putObject(key, nil)
+	}
+	size := pieces[len(pieces)-1].end
+
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	uploadID := initiated.UploadID
+
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	var parts []part
+	var buf []byte
+	send := func() error {
+		etag, err := s.uploadPart(key, uploadID, len(parts)+1, buf, "")
+		if err != nil {
+			return err
+		}
+		parts = append(parts, part{len(parts) + 1, etag})
+		buf = buf[:0]
+		return nil
+	}
+	addZeros := func(n int64) error {
+		for n > 0 {
+			take := s3PieceSize - int64(len(buf))
+			if take > n {
+				take = n
+			}
+			buf = append(buf, make([]byte, take)...)
+			n -= take
+			if int64(len(buf)) >= s3PieceSize {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	build := func() error {
+		var pos int64
+		for _, p := range pieces {
+			if err := addZeros(p.start - pos); err != nil {
+				return err
+			}
+			pos = p.end
+			if p.hole {
+				if err := addZeros(p.end - p.start); err != nil {
+					return err
+				}
+				continue
+			}
+			// Parts but the last must not be small, so a large piece is
+			// copied as it is only when nothing is gathered before it.
+			if int64(len(buf)) >= s3MinPartSize {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			if len(buf) == 0 && p.end-p.start >= s3MinPartSize {
+				etag, err := s.uploadPart(key, uploadID, len(parts)+1, nil, s.pieceKey(partName, p))
+				if err != nil {
+					return err
+				}
+				parts = append(parts, part{len(parts) + 1, etag})
+				continue
+			}
+			resp, err := s.do(http.MethodGet, s.pieceKey(partName, p), nil, nil, nil)
+			if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+			buf = append(buf, data...)
+			if int64(len(buf)) >= s3PieceSize {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+		}
+		if len(buf) > 0 || len(parts) == 0 {
+			return send()
+		}
+		return nil
+	}
+	if err := build(); err != nil {
+		s.abortUpload(key, uploadID)
+		return err
+	}
+
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err = s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		s.abortUpload(key, uploadID)
+		return err
+	}
+	// CompleteMultipartUpload can fail with a 200 status and an error body.
+	reply, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(reply, []byte("<Error>")) {
+		return fmt.Errorf("failed to complete multipart upload: %s", reply)
+	}
+	if info, err := s.Stat(name); err == nil && info.Size() != size {
+		return fmt.Errorf("assembled %s has %d bytes instead of %d", name, info.Size(), size)
+	}
+
+	for _, p := range pieces {
+		if err := s.deleteObject(s.pieceKey(partName, p)); err != nil {
+			logWarn("failed to delete a piece of a stored part file", "file", partName, "piece", p.objectName(), "err", err)
+		}
+	}
+	return nil
+}
+
+// uploadPart uploads data, or copies the object copySource, as part number
+// of a multipart upload and returns the part's ETag.
+func (s *s3Storage) uploadPart(key, uploadID string, number int, data []byte, copySource string) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	var header http.Header
+	if copySource != "" {
+		header = http.Header{"X-Amz-Copy-Source": {s.copySource(copySource)}}
+	}
+	var lastErr error
+	for attempt := 1; attempt <= s3PartTries; attempt++ {
+		resp, err := s.do(http.MethodPut, key, query, header, data)
+		if err == nil {
+			defer resp.Body.Close()
+			if copySource == "" {
+				return resp.Header.Get("ETag"), nil
+			}
+			var result struct {
+				ETag string
+			}
+			if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return "", fmt.Errorf("failed to copy part %d: %w", number, err)
+			}
+			return result.ETag, nil
+		}
+		lastErr = err
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	return "", fmt.Errorf("failed to upload part %d: %w", number, lastErr)
+}
+
+func (s *s3Storage) abortUpload(key, uploadID string) {
+	resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (s *s3Storage) copySource(key string) string {
+	return "/" + s.bucket + "/" + s3Escape(key, false)
+}
+
+func (s *s3Storage) putObject(key string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) copyObject(from, to string) error {
+	resp, err := s.do(http.MethodPut, to, nil, http.Header{"X-Amz-Copy-Source": {s.copySource(from)}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) deleteObject(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Stat(name string) (fs.FileInfo, error) {
+	if strings.HasSuffix(name, partSuffix) {
+		pieces, lastWrite, open, err := s.pieces(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(pieces) == 0 && !open {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		}
+		info := s3FileInfo{name: name, modTime: lastWrite}
+		for _, p := range pieces {
+			if p.end > info.size {
+				info.size = p.end
+			}
+			if p.modTime.After(info.modTime) {
+				info.modTime = p.modTime
+			}
+		}
+		return info, nil
+	}
+
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, nil)
+	if err != nil {
+		var respErr *s3Error
+		if errors.As(err, &respErr) && respErr.status == http.StatusNotFound {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return s3FileInfo{name: name, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (s *s3Storage) Open(name string) (io.ReadCloser, error) {
+	if strings.HasSuffix(name, partSuffix) {
+		// What open handles buffered is part of the file too.
+		s.mu.Lock()
+		var files []*s3File
+		if u := s.uploads[name]; u != nil {
+			for f := range u.files {
+				files = append(files, f)
+			}
+		}
+		s.mu.Unlock()
+		for _, f := range files {
+			if err := f.Sync(); err != nil {
+				return nil, err
+			}
+		}
+		pieces, _, open, err := s.pieces(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(pieces) == 0 && !open {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return &s3PieceReader{storage: s, name: name, pieces: pieces}, nil
+	}
+	resp, err := s.do(http.MethodGet, s.key(name), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// s3PieceReader reads a part file from its pieces, with zeros for holes and
+// gaps.
+type s3PieceReader struct {
+	storage *s3Storage
+	name    string
+	pieces  []s3Piece // the first is the one being read, or the next
+	pos     int64
+	body    io.ReadCloser // of pieces[0], from pos
+}
+
+func (r *s3PieceReader) Read(p []byte) (int, error) {
+	for len(r.pieces) > 0 && r.pieces[0].end <= r.pos {
+		r.pieces = r.pieces[1:]
+	}
+	if len(r.pieces) == 0 {
+		return 0, io.EOF
+	}
+	next := r.pieces[0]
+	if next.start > r.pos || next.hole {
+		end := next.end
+		if next.start > r.pos {
+			end = next.start
+		}
+		if int64(len(p)) > end-r.pos {
+			p = p[:end-r.pos]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		r.pos += int64(len(p))
+		return len(p), nil
+	}
+
+	if r.body == nil {
+		var header http.Header
+		if r.pos > next.start {
+			header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.pos-next.start)}}
+		}
+		resp, err := r.storage.do(http.MethodGet, r.storage.pieceKey(r.name, next), nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	if int64(len(p)) > next.end-r.pos {
+		p = p[:next.end-r.pos]
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	if r.pos == next.end || err != nil {
+		r.body.Close()
+		r.body = nil
+		if err == io.EOF && r.pos < next.end {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+func (r *s3PieceReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// s3Error is returned for non-2xx replies.
+type s3Error struct {
+	status int
+	body   string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 request failed: %d %s", e.status, e.body)
+}
+
+// do sends a SigV4-signed request for key and returns the response when the
+// status is 2xx.
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.pathStyle {
+		objectPath = "/" + s.bucket + objectPath
+	}
+	u.Path = path.Join(s.endpoint.Path, objectPath)
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, &s3Error{status: resp.StatusCode, body: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *s3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lower := strings.ToLower(k)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, keeping '/'
+// unless escapeSlash is set, as SigV4 requires.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i s3FileInfo) Name() string       { return i.name }
+func (i s3FileInfo) Size() int64        { return i.size }
+func (i s3FileInfo) Mode() fs.FileMode  { return 0644 }
+func (i s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i s3FileInfo) IsDir() bool        { return false }
+func (i s3FileInfo) Sys() interface{}   { return nil }
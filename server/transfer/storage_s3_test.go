@@ -0,0 +1,438 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an S3-compatible bucket in memory, addressed path-style as
+// /bucket/key. It knows just the requests s3Storage sends.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte // upload ID -> part number -> data
+	nextID  int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") == "" {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, query.Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, "<ListBucketResult>")
+		for _, k := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>%s</LastModified></Contents>", k, time.Now().UTC().Format(time.RFC3339))
+		}
+		fmt.Fprint(w, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var object []byte
+		for i, part := range complete.Parts {
+			data, ok := parts[part.PartNumber]
+			if !ok || part.ETag != etagOf(data) {
+				fmt.Fprintf(w, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			if i < len(complete.Parts)-1 && int64(len(data)) < s3MinPartSize {
+				fmt.Fprintf(w, "<Error><Code>EntityTooSmall</Code></Error>")
+				return
+			}
+			object = append(object, data...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data := body
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			if data, ok = f.source(source); !ok {
+				http.Error(w, "no such key", http.StatusNotFound)
+				return
+			}
+			parts[number] = data
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", etagOf(data))
+			return
+		}
+		parts[number] = data
+		w.Header().Set("ETag", etagOf(data))
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		data, ok := f.source(r.Header.Get("X-Amz-Copy-Source"))
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		f.objects[key] = data
+		fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		if spec := strings.TrimPrefix(r.Header.Get("Range"), "bytes="); spec != "" {
+			from, to, _ := strings.Cut(spec, "-")
+			start, _ := strconv.Atoi(from)
+			end := len(data) - 1
+			if to != "" {
+				end, _ = strconv.Atoi(to)
+			}
+			data = data[start : end+1]
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+// source looks up the object named by an X-Amz-Copy-Source header.
+func (f *fakeS3) source(header string) ([]byte, bool) {
+	key, err := url.PathUnescape(strings.TrimPrefix(header, "/bucket/"))
+	if err != nil {
+		return nil, false
+	}
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+// pieceCount counts the part-file pieces left in the bucket.
+func (f *fakeS3) pieceCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for k := range f.objects {
+		if strings.Contains(k, s3PiecesDir+"/") {
+			n++
+		}
+	}
+	return n
+}
+
+func etagOf(data []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", len(data)))
+}
+
+// newTestS3 returns an s3Storage on a fake bucket, with pieces of 32 bytes
+// and parts of at least 16, and makes it the active storage.
+func newTestS3(t *testing.T) (*s3Storage, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	oldEndpoint, oldPiece, oldMin, oldStorage := s3Endpoint, s3PieceSize, s3MinPartSize, storage
+	s3Endpoint, s3PieceSize, s3MinPartSize = server.URL, 32, 16
+	t.Cleanup(func() {
+		s3Endpoint, s3PieceSize, s3MinPartSize, storage = oldEndpoint, oldPiece, oldMin, oldStorage
+	})
+
+	s, err := newS3Storage("bucket/prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = s
+	return s, fake
+}
+
+// testData is n bytes that differ from their neighbours.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i%251 + 1)
+	}
+	return data
+}
+
+func writeRange(t *testing.T, s *s3Storage, name string, data []byte, start, end int64, chunk int) {
+	t.Helper()
+	file, err := s.Create(name, int64(len(data)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := start; off < end; off += int64(chunk) {
+		stop := off + int64(chunk)
+		if stop > end {
+			stop = end
+		}
+		if err := writeAtFull(file, data[off:stop], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAll(t *testing.T, s *s3Storage, name string) []byte {
+	t.Helper()
+	r, err := s.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestS3StorageAssemblesRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		chunk  int
+		ranges [][2]int64 // written in this order, each by its own handle
+	}{
+		{"sequential", 100, 10, [][2]int64{{0, 100}}},
+		{"one byte", 1, 10, [][2]int64{{0, 1}}},
+		{"large writes", 200, 70, [][2]int64{{0, 200}}},
+		{"ranges out of order", 150, 7, [][2]int64{{100, 150}, {0, 50}, {50, 100}}},
+		{"ranges off piece boundaries", 101, 9, [][2]int64{{33, 67}, {67, 101}, {0, 33}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, fake := newTestS3(t)
+			data := testData(tt.size)
+			for _, r := range tt.ranges {
+				writeRange(t, s, "dir/f.bin.part", data, r[0], r[1], tt.chunk)
+			}
+			if got := readAll(t, s, "dir/f.bin.part"); !bytes.Equal(got, data) {
+				t.Fatalf("part file reads %v, want %v", got, data)
+			}
+			if err := s.Rename("dir/f.bin.part", "dir/f.bin"); err != nil {
+				t.Fatal(err)
+			}
+			if got := fake.objects["prefix/dir/f.bin"]; !bytes.Equal(got, data) {
+				t.Fatalf("object holds %v, want %v", got, data)
+			}
+			if n := fake.pieceCount(); n != 0 {
+				t.Errorf("%d pieces left after rename", n)
+			}
+		})
+	}
+}
+
+func TestS3StorageResumesAfterRestart(t *testing.T) {
+	s, fake := newTestS3(t)
+	data := testData(120)
+	writeRange(t, s, "f.part", data, 0, 70, 10)
+
+	// A new storage has only what is in the bucket.
+	restarted, err := newS3Storage("bucket/prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = restarted
+	info, err := restarted.Stat("f.part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 70 {
+		t.Fatalf("part file has %d bytes after restart, want 70", info.Size())
+	}
+	if offset, ok := storedOffset("f", 0, 120); !ok || offset != 70 {
+		t.Fatalf("storedOffset = %d, %v, want 70, true", offset, ok)
+	}
+
+	writeRange(t, restarted, "f.part", data, 70, 120, 10)
+	if err := restarted.Rename("f.part", "f"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.objects["prefix/f"]; !bytes.Equal(got, data) {
+		t.Fatalf("object holds %v, want %v", got, data)
+	}
+}
+
+func TestS3StorageStoredRun(t *testing.T) {
+	s, _ := newTestS3(t)
+	data := testData(100)
+	writeRange(t, s, "f.part", data, 0, 40, 10)
+	writeRange(t, s, "f.part", data, 60, 100, 10)
+
+	tests := []struct {
+		start int64
+		want  int64
+	}{
+		{0, 40},
+		{20, 20},
+		{40, 0},
+		{50, 0},
+		{60, 40},
+		{100, 0},
+	}
+	for _, tt := range tests {
+		got, err := s.storedRun("f.part", tt.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("storedRun(%d) = %d, want %d", tt.start, got, tt.want)
+		}
+	}
+
+	// The gap reads as zeros, and is no longer one once written.
+	want := append(append(append([]byte(nil), data[:40]...), make([]byte, 20)...), data[60:]...)
+	if got := readAll(t, s, "f.part"); !bytes.Equal(got, want) {
+		t.Fatalf("part file reads %v, want %v", got, want)
+	}
+	writeRange(t, s, "f.part", data, 40, 60, 10)
+	if got, _ := s.storedRun("f.part", 0); got != 100 {
+		t.Fatalf("storedRun(0) = %d after filling the gap, want 100", got)
+	}
+}
+
+func TestS3StorageRewriteTruncateAndFresh(t *testing.T) {
+	s, fake := newTestS3(t)
+	data := testData(100)
+	writeRange(t, s, "f.part", data, 0, 100, 25)
+
+	// Writing over stored bytes replaces them.
+	changed := append([]byte(nil), data...)
+	for i := 10; i < 50; i++ {
+		changed[i] = 0xff
+	}
+	writeRange(t, s, "f.part", changed, 10, 50, 8)
+	if got := readAll(t, s, "f.part"); !bytes.Equal(got, changed) {
+		t.Fatalf("part file reads %v after rewrite, want %v", got, changed)
+	}
+
+	file, err := s.Create("f.part", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Truncate(60); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Truncate(90); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	want := append(append([]byte(nil), changed[:60]...), make([]byte, 30)...)
+	if got := readAll(t, s, "f.part"); !bytes.Equal(got, want) {
+		t.Fatalf("part file reads %v after truncating, want %v", got, want)
+	}
+	if run, _ := s.storedRun("f.part", 0); run != 90 {
+		t.Fatalf("storedRun(0) = %d, want 90: a hole is not a gap", run)
+	}
+
+	file, err = s.Create("f.part", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if n := fake.pieceCount(); n != 0 {
+		t.Fatalf("%d pieces left after a fresh Create", n)
+	}
+	if _, err := s.Stat("f.part"); err == nil {
+		t.Fatal("empty part file still exists after it was closed")
+	}
+}
+
+func TestS3StorageDropsOverlappingPieces(t *testing.T) {
+	s, fake := newTestS3(t)
+	data := testData(64)
+	writeRange(t, s, "f.part", data, 0, 64, 32)
+	// As if the server stopped between storing a piece and dropping the
+	// one it replaces.
+	fake.objects[s.pieceKey("f.part", s3Piece{start: 16, end: 40})] = data[16:40]
+
+	restarted, err := newS3Storage("bucket/prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run, _ := restarted.storedRun("f.part", 0); run != 0 {
+		t.Fatalf("storedRun(0) = %d, want 0 with the overlapping pieces dropped", run)
+	}
+	if run, _ := restarted.storedRun("f.part", 32); run != 0 {
+		t.Fatalf("storedRun(32) = %d, want 0 with the overlapping pieces dropped", run)
+	}
+}
+
+func TestS3StorageMovesPieces(t *testing.T) {
+	s, fake := newTestS3(t)
+	data := testData(50)
+	writeRange(t, s, "old.part", data, 0, 50, 10)
+	if err := s.Rename("old.part", "new.part"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("old.part"); err == nil {
+		t.Fatal("old part file still exists")
+	}
+	if err := s.Rename("new.part", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.objects["prefix/new"]; !bytes.Equal(got, data) {
+		t.Fatalf("object holds %v, want %v", got, data)
+	}
+}
@@ -0,0 +1,38 @@
+package transfer
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+// partialWriterAt writes at most max bytes per call, without an error,
+// into buf.
+type partialWriterAt struct {
+	buf []byte
+	max int
+}
+
+func (w *partialWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return copy(w.buf[off:], p), nil
+}
+
+func TestWriteAtFull(t *testing.T) {
+	data := []byte("received chunk written in pieces")
+
+	w := &partialWriterAt{buf: make([]byte, len(data)+4), max: 3}
+	if err := writeAtFull(w, data, 4); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(w.buf[4:]); got != string(data) {
+		t.Errorf("wrote %q at offset 4, want %q", got, data)
+	}
+
+	w = &partialWriterAt{buf: make([]byte, len(data)), max: 0}
+	if err := writeAtFull(w, data, 0); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("writeAtFull to a writer taking nothing = %v, want io.ErrShortWrite", err)
+	}
+}
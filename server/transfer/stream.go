@@ -0,0 +1,49 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// In stream mode the header's size is streamSize: the client does not know
+// the size up front, e.g. because it is still building the archive it
+// sends. The data then arrives as chunks, each prefixed with a 4-byte
+// big-endian length, and ends with an empty chunk; the hex hash of the
+// whole stream follows as the usual trailer. Streams cannot be resumed or
+// split into ranges.
+const streamSize = -1
+
+// Statuses for streams stopped because they outgrew a server limit.
+const (
+	statusTooLarge      = "文件过大"
+	statusQuotaExceeded = "超出配额"
+)
+
+// errStreamEnd is returned by readStreamChunk for the closing empty chunk.
+var errStreamEnd = errors.New("end of stream")
+
+// readStreamChunk reads one stream-mode chunk into *buf, growing it if the
+// client's chunks are larger than ours.
+func readStreamChunk(conn net.Conn, buf *[]byte) (int, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n == 0 {
+		return 0, errStreamEnd
+	}
+	if n > maxCheckedChunk {
+		return 0, fmt.Errorf("invalid chunk length %d", n)
+	}
+	if int(n) > len(*buf) {
+		*buf = make([]byte, n)
+	}
+	if _, err := io.ReadFull(conn, (*buf)[:n]); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
@@ -0,0 +1,462 @@
+// Package transfer receives files from EileCores clients and serves them
+// back. The server command is a thin wrapper around it; other programs can
+// embed the server instead of running the command:
+//
+//	srv, err := transfer.NewServer(transfer.Options{Dir: "/srv/uploads", Token: secret})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	listener, err := net.Listen("tcp", ":59999")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	srv.Serve(listener)
+//
+// Storage, quotas, resume state and statistics are kept per process, so a
+// process runs one Server at a time: another can be created once Shutdown
+// returns.
+package transfer
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the zero values of Options.
+const (
+	DefaultDir              = "./uploads"
+	DefaultChunkSize        = 4 * 1024 * 1024
+	DefaultIdleTimeout      = 5 * time.Minute
+	DefaultKeepAlive        = 15 * time.Second
+	DefaultSpeedWindow      = 5 * time.Second
+	DefaultProgressInterval = time.Second
+	DefaultHistory          = 100
+	DefaultMaxNameLength    = 255
+	DefaultTransferLogsAge  = 7 * 24 * time.Hour
+	DefaultTransferLogs     = 1000
+)
+
+// Options configure a Server. The zero value stores files in DefaultDir
+// with no limits, the same as the server command without flags.
+type Options struct {
+	// Dir is the storage directory, or a comma-separated list of them that
+	// new files are spread over by ShardPolicy. The first also keeps the
+	// server's state files. Empty means DefaultDir.
+	Dir string
+	// ShardPolicy is "least-full" (the default) or "round-robin".
+	ShardPolicy string
+	// Backend stores files elsewhere than Dir, e.g. s3://bucket/prefix.
+	// S3Endpoint and S3Region default to $AWS_ENDPOINT_URL and
+	// $AWS_REGION.
+	Backend    string
+	S3Endpoint string
+	S3Region   string
+	// Overwrite decides what happens when an upload's file already exists:
+	// "always" (the default) replaces it, "never" refuses the upload and
+	// "rename" stores it as name(1).ext.
+	Overwrite string
+	// CaseInsensitive treats names differing only by case as the same file.
+	// It is detected for local storage when not set.
+	CaseInsensitive bool
+	// Preallocate reserves disk space for the whole file before receiving it.
+	Preallocate bool
+
+	// Token is the shared secret clients authenticate every header with.
+	Token string
+	// VerifyKey checks the detached signatures of uploads. With
+	// RequireSignature set, unsigned uploads are refused.
+	VerifyKey        ed25519.PublicKey
+	RequireSignature bool
+
+	// MaxSize refuses files larger than this many bytes, Quota transfers
+	// that would grow the storage beyond it. Quota needs local storage. 0
+	// means no limit.
+	MaxSize int64
+	Quota   int64
+	// MaxNameLength refuses longer file and directory names. 0 means
+	// DefaultMaxNameLength.
+	MaxNameLength int
+	// GlobalRate is the receive bandwidth in bytes per second shared fairly
+	// by all transfers, MaxRate that of each one. 0 means unlimited.
+	GlobalRate int64
+	MaxRate    int64
+	// MaxConn bounds the connections Serve keeps open at once, and
+	// PerIPConnRate how many new ones per second it takes from one address.
+	// 0 means no limit.
+	MaxConn       int
+	PerIPConnRate float64
+	// AcceptWorkers is how many goroutines Serve accepts connections in. 0
+	// means one.
+	AcceptWorkers int
+	// ChunkSize is the receive buffer of each connection. 0 means
+	// DefaultChunkSize.
+	ChunkSize int
+	// IdleTimeout disconnects a client that sends nothing for this long, and
+	// KeepAlive is the TCP keepalive period of the connections Serve
+	// accepts. 0 means the defaults, a negative value turns them off.
+	IdleTimeout time.Duration
+	KeepAlive   time.Duration
+
+	// Manifest appends a JSON record of every finished transfer to this
+	// file, and Webhook POSTs one to this http(s) URL.
+	Manifest string
+	Webhook  string
+	// TransferLogs is a directory for a log file per transfer, kept for
+	// TransferLogsMaxAge and at most TransferLogsMaxCount of them. 0 means
+	// DefaultTransferLogsAge and DefaultTransferLogs.
+	TransferLogs         string
+	TransferLogsMaxAge   time.Duration
+	TransferLogsMaxCount int
+	// LogLevel is the lowest level written to the standard logger: debug,
+	// info (the default), warn or error.
+	LogLevel string
+
+	// History is how many finished transfers StatusLines and /stats keep. 0
+	// means DefaultHistory, a negative value keeps none.
+	History int
+	// SpeedWindow is the time speeds are averaged over, ProgressInterval the
+	// least time between two progress events of a transfer. 0 means the
+	// defaults.
+	SpeedWindow      time.Duration
+	ProgressInterval time.Duration
+	// Console, when set, receives a line whenever a client connects, a
+	// transfer starts or ends, and so on.
+	Console io.Writer
+}
+
+// Server receives files. Create it with NewServer, then hand it
+// connections with Serve or Receive.
+type Server struct {
+	opts Options
+	// stop ends the background work NewServer started.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// listenersMu guards listeners, those of ServeStats and ServeEvents,
+	// which Shutdown closes.
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+}
+
+// running is set from NewServer until Shutdown, see the package comment.
+var running atomic.Bool
+
+// NewServer checks opts, opens the storage, loads the resume state saved by
+// a previous run and starts the background work that saves it again.
+func NewServer(opts Options) (*Server, error) {
+	if !running.CompareAndSwap(false, true) {
+		return nil, errors.New("a Server is already running in this process")
+	}
+	s, err := newServer(opts)
+	if err != nil {
+		running.Store(false)
+		return nil, err
+	}
+	return s, nil
+}
+
+// newServer is NewServer once it holds running. Every setting is assigned,
+// not only those opts changes from the defaults, so nothing is left over
+// from an earlier Server or a failed call, and no goroutine starts until
+// every step that can fail has succeeded.
+func newServer(opts Options) (*Server, error) {
+	if opts.LogLevel == "" {
+		opts.LogLevel = levelInfo.String()
+	}
+	level, err := parseLogLevel(opts.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Overwrite == "" {
+		opts.Overwrite = overwriteAlways
+	}
+	if !validOverwritePolicy(opts.Overwrite) {
+		return nil, fmt.Errorf("invalid overwrite policy %q, use %s, %s or %s", opts.Overwrite, overwriteAlways, overwriteNever, overwriteRename)
+	}
+	if opts.Webhook != "" {
+		if u, err := url.Parse(opts.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid webhook %q, expected an http(s) URL", opts.Webhook)
+		}
+	}
+	if opts.MaxNameLength == 0 {
+		opts.MaxNameLength = DefaultMaxNameLength
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.SpeedWindow == 0 {
+		opts.SpeedWindow = DefaultSpeedWindow
+	}
+	if opts.ProgressInterval == 0 {
+		opts.ProgressInterval = DefaultProgressInterval
+	}
+	if opts.History == 0 {
+		opts.History = DefaultHistory
+	}
+	if opts.History < 0 {
+		opts.History = 0
+	}
+	if opts.TransferLogsMaxAge == 0 {
+		opts.TransferLogsMaxAge = DefaultTransferLogsAge
+	}
+	if opts.TransferLogsMaxCount == 0 {
+		opts.TransferLogsMaxCount = DefaultTransferLogs
+	}
+	if opts.AcceptWorkers <= 0 {
+		opts.AcceptWorkers = 1
+	}
+	switch {
+	case opts.MaxNameLength < 0:
+		return nil, fmt.Errorf("invalid name length limit %d", opts.MaxNameLength)
+	case opts.ChunkSize < 0 || opts.ChunkSize > math.MaxInt32:
+		return nil, fmt.Errorf("invalid chunk size %d", opts.ChunkSize)
+	case opts.SpeedWindow < 0:
+		return nil, fmt.Errorf("invalid speed window %s", opts.SpeedWindow)
+	case opts.MaxSize < 0 || opts.Quota < 0 || opts.GlobalRate < 0 || opts.MaxRate < 0:
+		return nil, errors.New("sizes and rates cannot be negative")
+	case opts.Quota > 0 && opts.Backend != "":
+		return nil, errors.New("a quota only applies to local storage")
+	case opts.RequireSignature && opts.VerifyKey == nil:
+		return nil, errors.New("RequireSignature needs a VerifyKey")
+	}
+	if err := configureStorage(opts); err != nil {
+		return nil, err
+	}
+
+	minLogLevel = level
+	overwritePolicy = opts.Overwrite
+	maxNameLength = opts.MaxNameLength
+	chunkSize = opts.ChunkSize
+	speedWindow = opts.SpeedWindow
+	progressEventInterval = opts.ProgressInterval
+	maxCompletedClients = opts.History
+	idleTimeout = opts.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	keepAlivePeriod = opts.KeepAlive
+	if keepAlivePeriod == 0 {
+		keepAlivePeriod = DefaultKeepAlive
+	}
+	maxFileSize, quotaBytes = opts.MaxSize, opts.Quota
+	scheduler = newFairScheduler(float64(opts.GlobalRate), float64(opts.MaxRate))
+	authToken = []byte(opts.Token)
+	verifyKey, requireSignature = opts.VerifyKey, opts.RequireSignature
+	manifestPath, webhookURL = opts.Manifest, opts.Webhook
+	preallocateFiles = opts.Preallocate
+	console = opts.Console
+	connSlots = nil
+	if opts.MaxConn > 0 {
+		connSlots = make(chan struct{}, opts.MaxConn)
+	}
+	connLimiter = newIPLimiter(opts.PerIPConnRate)
+
+	transferLogDir = opts.TransferLogs
+	transferLogMaxAge, transferLogMaxCount = opts.TransferLogsMaxAge, opts.TransferLogsMaxCount
+	if transferLogDir != "" {
+		if err := startTransferLogs(); err != nil {
+			logError("failed to create transfer log directory", "err", err)
+			return nil, fmt.Errorf("creating transfer log directory: %w", err)
+		}
+	}
+	for _, dir := range storageDirs {
+		if err := prepareStorageDir(dir); err != nil {
+			logError("failed to prepare storage directory", "dir", dir, "err", err)
+			return nil, fmt.Errorf("preparing storage directory: %w", err)
+		}
+	}
+	if storage, err = openStorage(opts.Backend); err != nil {
+		logError("failed to open storage backend", "err", err)
+		return nil, fmt.Errorf("opening storage backend: %w", err)
+	}
+
+	if err := loadResumeState(); err != nil {
+		logWarn("failed to load resume state, starting without it", "err", err)
+	}
+	if err := loadIPUsage(); err != nil {
+		logWarn("failed to load per-IP usage, starting from zero", "err", err)
+	}
+
+	caseInsensitive = opts.CaseInsensitive
+	if roots := localRoots(); len(roots) > 0 && !caseInsensitive {
+		caseInsensitive = detectCaseInsensitive(roots[0])
+	}
+	if caseInsensitive {
+		logInfo("storage is case-insensitive, file names differing only by case are treated as the same file")
+	}
+
+	s := &Server{opts: opts, stop: make(chan struct{})}
+	go persistResumeState(resumeStateInterval, s.stop)
+	go reconcileResumeStateEvery(resumeReconcileInterval, s.stop)
+	go persistIPUsage(resumeStateInterval, s.stop)
+	if opts.PerIPConnRate > 0 {
+		go connLimiter.evictIdle(time.Minute, s.stop)
+	}
+	if transferLogDir != "" {
+		go pruneTransferLogsEvery(transferLogPruneInterval, s.stop)
+	}
+	draining.Store(false)
+	serverStartTime = time.Now()
+	return s, nil
+}
+
+// configureStorage sets the storage directories and S3 settings of opts,
+// short of opening the storage.
+func configureStorage(opts Options) error {
+	if opts.Dir == "" {
+		opts.Dir = DefaultDir
+	}
+	dirs, err := parseStorageDirs(opts.Dir)
+	if err != nil {
+		return err
+	}
+	if len(dirs) > 1 && opts.Backend != "" {
+		return errors.New("several storage directories only apply to local storage")
+	}
+	if opts.ShardPolicy == "" {
+		opts.ShardPolicy = shardLeastFull
+	}
+	if opts.ShardPolicy != shardLeastFull && opts.ShardPolicy != shardRoundRobin {
+		return fmt.Errorf("invalid shard policy %q, use %s or %s", opts.ShardPolicy, shardLeastFull, shardRoundRobin)
+	}
+	storageDirs, storageDir, shardPolicy = dirs, dirs[0], opts.ShardPolicy
+	if opts.S3Endpoint != "" {
+		s3Endpoint = opts.S3Endpoint
+	}
+	if opts.S3Region != "" {
+		s3Region = opts.S3Region
+	}
+	return nil
+}
+
+// Serve accepts connections on listener and receives from each of them
+// until listener is closed, applying MaxConn and PerIPConnRate. It does not
+// wait for the connections still open; Shutdown does.
+func (s *Server) Serve(listener net.Listener) {
+	logInfo("file server is listening", "addr", listener.Addr())
+	accepting.Store(true)
+	var workers sync.WaitGroup
+	for i := 0; i < s.opts.AcceptWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			acceptLoop(listener)
+		}()
+	}
+	workers.Wait()
+	accepting.Store(false)
+}
+
+// Receive serves one connection until the client is done with it: its
+// uploads, downloads, listings and status queries. It closes conn.
+// Connections handed over this way are not counted against MaxConn.
+func (s *Server) Receive(conn net.Conn) {
+	handleConnection(conn)
+}
+
+// Cancel aborts the active transfer with the given ID, as shown by
+// StatusLines. It returns false if no such transfer is running.
+func (s *Server) Cancel(id string) bool {
+	return cancelTransfer(id)
+}
+
+// StatusLines describes the server's throughput and transfers, one line
+// per row of the server command's dashboard.
+func (s *Server) StatusLines() []string {
+	return statusLines()
+}
+
+// ServeStats serves the JSON statistics, the incomplete uploads, the
+// metrics, a health check and cancellation over HTTP on addr.
+func (s *Server) ServeStats(addr string) error {
+	listener, err := serveStats(addr)
+	if err != nil {
+		return err
+	}
+	s.addListener(listener)
+	return nil
+}
+
+// ServeEvents writes a JSON line for every transfer event to the clients
+// of the Unix socket at target, or to stdout if target is "-".
+func (s *Server) ServeEvents(target string) error {
+	listener, err := serveEvents(target)
+	if err != nil {
+		return err
+	}
+	if listener != nil {
+		s.addListener(listener)
+	}
+	return nil
+}
+
+// addListener has Shutdown close listener.
+func (s *Server) addListener(listener net.Listener) {
+	s.listenersMu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.listenersMu.Unlock()
+}
+
+// Drain marks the server as shutting down, so its health check fails and
+// load balancers stop sending it clients. Close the listener given to Serve
+// to stop taking connections, then call Shutdown.
+func (s *Server) Drain() {
+	draining.Store(true)
+	accepting.Store(false)
+}
+
+// Shutdown waits up to timeout for the transfers in progress to finish,
+// then saves the resume state so what is left can resume after a restart.
+// It stops the background work and closes the listeners of ServeStats and
+// ServeEvents. s cannot be used afterwards, but NewServer can create
+// another Server.
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.stopOnce.Do(func() {
+		drain(timeout)
+		close(s.stop)
+		s.listenersMu.Lock()
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
+		s.listeners = nil
+		s.listenersMu.Unlock()
+		running.Store(false)
+	})
+}
+
+// SaveState saves the resume state and the per-IP usage now rather than at
+// their next periodic save.
+func (s *Server) SaveState() {
+	saveState()
+}
+
+// PrintIncomplete writes the uploads that can be resumed from the state
+// saved in the storage of opts, without starting a server.
+func PrintIncomplete(w io.Writer, opts Options) error {
+	if err := configureStorage(opts); err != nil {
+		return err
+	}
+	var err error
+	if storage, err = openStorage(opts.Backend); err != nil {
+		return fmt.Errorf("opening storage backend: %w", err)
+	}
+	if err := loadResumeState(); err != nil {
+		return fmt.Errorf("loading resume state: %w", err)
+	}
+	return printIncomplete(w)
+}
+
+// ShowTransferLog writes the log of the transfer with the given ID from the
+// TransferLogs directory dir.
+func ShowTransferLog(w io.Writer, dir, id string) error {
+	transferLogDir = dir
+	return showTransferLog(w, id)
+}
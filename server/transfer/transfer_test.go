@@ -0,0 +1,50 @@
+package transfer
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// keepStorage restores the storage NewServer configures once t ends.
+func keepStorage(t *testing.T) {
+	oldStorage, oldDirs, oldDir := storage, storageDirs, storageDir
+	t.Cleanup(func() { storage, storageDirs, storageDir = oldStorage, oldDirs, oldDir })
+}
+
+func TestNewServerAfterShutdown(t *testing.T) {
+	keepStorage(t)
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(Options{Dir: notDir}); err == nil {
+		t.Fatal("NewServer accepted a storage directory that is a file")
+	}
+
+	// A failed NewServer does not block the next one.
+	srv, err := NewServer(Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewServer after a failed one: %v", err)
+	}
+	if _, err := NewServer(Options{Dir: t.TempDir()}); err == nil {
+		t.Fatal("NewServer created a second Server while the first runs")
+	}
+	if err := srv.ServeStats("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	addr := srv.listeners[0].Addr().String()
+	srv.Shutdown(0)
+	srv.Shutdown(0) // a second call does nothing
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("ServeStats still listens after Shutdown")
+	}
+
+	srv, err = NewServer(Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewServer after Shutdown: %v", err)
+	}
+	srv.Shutdown(0)
+}
@@ -0,0 +1,123 @@
+package transfer
+
+import (
+	"strings"
+	"sync"
+)
+
+// A client may name its upload with a transfer ID, a UUID it keeps for the
+// same content across runs. The ID remembers which part file holds that
+// upload's data, so a resume finds it even after the file was renamed on
+// the client's side.
+
+// resumeTarget is the part file, and the hash its resume state is keyed
+// by, that a transfer ID points at.
+type resumeTarget struct {
+	name string
+	hash string
+}
+
+var (
+	transferIDsMu sync.Mutex
+	transferIDs   = make(map[string]resumeTarget)
+)
+
+// validTransferID accepts an empty ID or a UUID in its usual 8-4-4-4-12 hex
+// form.
+func validTransferID(id string) bool {
+	if id == "" {
+		return true
+	}
+	if len(id) != 36 {
+		return false
+	}
+	for i, r := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// adoptTransfer points id at the upload of name with hash. If id pointed at
+// another file and resume is set, that file's partial data and resume
+// state are moved over to name first, so the upload resumes where the
+// earlier one stopped; the client's prefix check still catches content
+// that changed. Nothing is moved while the old file is being written or
+// when name already has partial data of its own.
+func adoptTransfer(id, name, hash string, resume bool, tlog *transferLog) {
+	hash = strings.ToLower(hash)
+	transferIDsMu.Lock()
+	defer transferIDsMu.Unlock()
+
+	old, ok := transferIDs[id]
+	transferIDs[id] = resumeTarget{name: name, hash: hash}
+	if !ok || !resume || old == transferIDs[id] {
+		return
+	}
+	if uploadActive(old.name) || storedFileExists(partName(name)) {
+		tlog.Info("not moving the partial data of the transfer ID", "transfer_id", id, "from", old.name, "to", name)
+		return
+	}
+	if err := storage.Rename(partName(old.name), partName(name)); err != nil {
+		tlog.Warn("failed to move the partial data of the transfer ID", "transfer_id", id, "from", old.name, "to", name, "err", err)
+		return
+	}
+	fileState.Range(func(key, value interface{}) bool {
+		if k := key.(resumeKey); k.name == old.name && k.hash == old.hash {
+			fileState.Store(newResumeKey(name, hash, k.start), value)
+			fileState.Delete(key)
+		}
+		return true
+	})
+	tlog.Info("resuming the transfer ID under a new name", "transfer_id", id, "from", old.name, "to", name)
+}
+
+// forgetTransferIDs drops the IDs pointing at name with hash, once there is
+// nothing left to resume.
+func forgetTransferIDs(name, hash string) {
+	hash = strings.ToLower(hash)
+	transferIDsMu.Lock()
+	defer transferIDsMu.Unlock()
+	for id, target := range transferIDs {
+		if target.name == name && target.hash == hash {
+			delete(transferIDs, id)
+		}
+	}
+}
+
+// pruneTransferIDs drops the IDs whose file has no resume state left.
+func pruneTransferIDs() {
+	live := make(map[resumeTarget]bool)
+	fileState.Range(func(key, _ interface{}) bool {
+		k := key.(resumeKey)
+		live[resumeTarget{name: k.name, hash: k.hash}] = true
+		return true
+	})
+	transferIDsMu.Lock()
+	defer transferIDsMu.Unlock()
+	for id, target := range transferIDs {
+		if !live[target] && !uploadActive(target.name) {
+			delete(transferIDs, id)
+		}
+	}
+}
+
+// transferIDsByTarget returns the IDs by the file they point at, for saving
+// them with the resume state.
+func transferIDsByTarget() map[resumeTarget]string {
+	transferIDsMu.Lock()
+	defer transferIDsMu.Unlock()
+	byTarget := make(map[resumeTarget]string, len(transferIDs))
+	for id, target := range transferIDs {
+		byTarget[target] = id
+	}
+	return byTarget
+}
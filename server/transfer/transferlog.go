@@ -0,0 +1,168 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	transferLogDir      string
+	transferLogMaxAge   = DefaultTransferLogsAge
+	transferLogMaxCount = DefaultTransferLogs
+)
+
+// transferLogPruneInterval is how often old per-transfer logs are deleted.
+const transferLogPruneInterval = 10 * time.Minute
+
+// transferLog mirrors the lifecycle events of a single transfer into
+// <transferLogDir>/<id>.log in addition to server.log. The id is the
+// client's transfer ID (see transferid.go), so every attempt of an upload,
+// and every range of a parallel one, lands in the same file. Until the
+// header names one, lines are held in memory; a request without a transfer
+// ID is logged under its connection ID when it ends. A nil *transferLog
+// only writes to server.log.
+type transferLog struct {
+	connID  string
+	file    *os.File
+	logger  *log.Logger
+	pending bytes.Buffer
+}
+
+// openTransferLog returns nil when per-transfer logs are disabled; logging
+// then goes to server.log only.
+func openTransferLog(connID string) *transferLog {
+	if transferLogDir == "" {
+		return nil
+	}
+	t := &transferLog{connID: connID}
+	t.logger = log.New(&t.pending, "", log.LstdFlags)
+	return t
+}
+
+// attach writes the lines logged so far, and all later ones, to the log
+// of transfer ID id. If that file cannot be opened they stay in server.log
+// only.
+func (t *transferLog) attach(id string) {
+	if t == nil || t.file != nil {
+		return
+	}
+	file, err := os.OpenFile(transferLogPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logError("failed to open transfer log", "transfer_id", id, "err", err)
+		t.logger.SetOutput(io.Discard)
+		t.pending.Reset()
+		return
+	}
+	file.Write(t.pending.Bytes())
+	t.pending.Reset()
+	t.file = file
+	t.logger.SetOutput(file)
+}
+
+func transferLogPath(id string) string {
+	return filepath.Join(transferLogDir, filepath.Base(id)+".log")
+}
+
+// logAt logs to server.log and, when enabled, to the transfer's own file.
+func (t *transferLog) logAt(level logLevel, msg string, kv []interface{}) {
+	line, ok := logAt(2, level, msg, kv)
+	if ok && t != nil {
+		t.logger.Print(line)
+	}
+}
+
+func (t *transferLog) Debug(msg string, kv ...interface{}) { t.logAt(levelDebug, msg, kv) }
+func (t *transferLog) Info(msg string, kv ...interface{})  { t.logAt(levelInfo, msg, kv) }
+func (t *transferLog) Warn(msg string, kv ...interface{})  { t.logAt(levelWarn, msg, kv) }
+func (t *transferLog) Error(msg string, kv ...interface{}) { t.logAt(levelError, msg, kv) }
+
+func (t *transferLog) Close() {
+	if t == nil {
+		return
+	}
+	t.attach(t.connID)
+	if t.file != nil {
+		t.file.Close()
+	}
+}
+
+// startTransferLogs creates transferLogDir and prunes it; from then on
+// pruneTransferLogsEvery does.
+func startTransferLogs() error {
+	if err := os.MkdirAll(transferLogDir, os.ModePerm); err != nil {
+		return err
+	}
+	pruneTransferLogs()
+	return nil
+}
+
+// pruneTransferLogsEvery runs pruneTransferLogs every interval until stop is
+// closed.
+func pruneTransferLogsEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			pruneTransferLogs()
+		}
+	}
+}
+
+// pruneTransferLogs drops logs older than transferLogMaxAge and then the
+// oldest ones beyond transferLogMaxCount.
+func pruneTransferLogs() {
+	entries, err := os.ReadDir(transferLogDir)
+	if err != nil {
+		return
+	}
+
+	type logFile struct {
+		path    string
+		modTime time.Time
+	}
+	var kept []logFile
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(transferLogDir, entry.Name())
+		if transferLogMaxAge > 0 && now.Sub(info.ModTime()) > transferLogMaxAge {
+			os.Remove(path)
+			continue
+		}
+		kept = append(kept, logFile{path, info.ModTime()})
+	}
+
+	if transferLogMaxCount <= 0 || len(kept) <= transferLogMaxCount {
+		return
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].modTime.Before(kept[j].modTime) })
+	for _, lf := range kept[:len(kept)-transferLogMaxCount] {
+		os.Remove(lf.path)
+	}
+}
+
+// showTransferLog copies the log of transfer id to w.
+func showTransferLog(w io.Writer, id string) error {
+	file, err := os.Open(transferLogPath(id))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
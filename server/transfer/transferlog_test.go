@@ -0,0 +1,101 @@
+package transfer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransferLogCollectsTransferEvents(t *testing.T) {
+	useTestStorage(t, "")
+	oldDir := transferLogDir
+	transferLogDir = t.TempDir()
+	t.Cleanup(func() { transferLogDir = oldDir })
+
+	const good, bad = "0f8fad5b-d9cb-469f-a165-70867728950e", "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	data := testData(5000)
+	t.Cleanup(func() { forgetResume("a.bin", sha256Hex(data)); forgetResume("b.bin", sha256Hex(data)) })
+	for _, u := range []struct {
+		id, name string
+		sent     []byte
+	}{
+		{good, "a.bin", data},
+		{bad, "b.bin", testData(5001)[1:]},
+		{good, "a.bin", data}, // a second attempt of the same transfer
+	} {
+		fields := uploadHeader(u.name, data)
+		fields[fieldTransferID] = u.id
+		upload(t, fields, u.sent)
+	}
+
+	tests := []struct {
+		id       string
+		want     []string
+		wantNot  []string
+		finished int
+	}{
+		{good, []string{`msg="file info"`, `msg="transfer started"`, `msg="file received"`, "file=a.bin"}, []string{"b.bin"}, 2},
+		{bad, []string{`msg="hash mismatch"`, "file=b.bin"}, []string{"a.bin", `msg="file received"`}, 1},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := showTransferLog(&buf, tt.id); err != nil {
+			t.Fatalf("log of %s: %v", tt.id, err)
+		}
+		got := buf.String()
+		for _, s := range tt.want {
+			if !strings.Contains(got, s) {
+				t.Errorf("log of %s lacks %s:\n%s", tt.id, s, got)
+			}
+		}
+		for _, s := range tt.wantNot {
+			if strings.Contains(got, s) {
+				t.Errorf("log of %s holds %s of another transfer:\n%s", tt.id, s, got)
+			}
+		}
+		if n := strings.Count(got, `msg="transfer finished"`); n != tt.finished {
+			t.Errorf("log of %s has %d finished attempts, want %d", tt.id, n, tt.finished)
+		}
+	}
+}
+
+func TestPruneTransferLogs(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		maxCount int
+		want     []string
+	}{
+		{"no limits", 0, 0, []string{"new", "old", "older"}},
+		{"by age", 36 * time.Hour, 0, []string{"new", "old"}},
+		{"by count", 0, 1, []string{"new"}},
+		{"by age and count", 36 * time.Hour, 2, []string{"new", "old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldDir, oldAge, oldCount := transferLogDir, transferLogMaxAge, transferLogMaxCount
+			t.Cleanup(func() { transferLogDir, transferLogMaxAge, transferLogMaxCount = oldDir, oldAge, oldCount })
+			transferLogDir, transferLogMaxAge, transferLogMaxCount = t.TempDir(), tt.maxAge, tt.maxCount
+
+			now := time.Now()
+			for id, age := range map[string]time.Duration{"new": 0, "old": 24 * time.Hour, "older": 48 * time.Hour} {
+				path := transferLogPath(id)
+				os.WriteFile(path, []byte(id), 0644)
+				os.Chtimes(path, now.Add(-age), now.Add(-age))
+			}
+			pruneTransferLogs()
+
+			entries, _ := filepath.Glob(filepath.Join(transferLogDir, "*.log"))
+			var got []string
+			for _, e := range entries {
+				got = append(got, strings.TrimSuffix(filepath.Base(e), ".log"))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
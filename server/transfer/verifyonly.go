@@ -0,0 +1,101 @@
+package transfer
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// verifyRequest starts a header asking the server to hash a stored file and
+// compare it with the client's hash, without sending any data.
+const verifyRequest = "VERIFY"
+
+// Verify header fields, in wire order.
+const (
+	vfFieldType    = iota // verifyRequest
+	vfFieldVersion        // ProtocolVersion
+	vfFieldName
+	vfFieldDest     // as fieldDest
+	vfFieldHashAlgo // as fieldHashAlgo
+	vfFieldHash     // the client's hash of its copy
+	vfFieldAuth     // HMAC of the fields before it, see -token
+	verifyFields
+)
+
+// Results of a verify request.
+const (
+	verifyMatch    = "match"
+	verifyMismatch = "mismatch"
+)
+
+// handleVerify hashes the stored file a verify request names and replies
+// "result|hash|size", or rejects the request like an upload. It reports
+// whether the connection is still in step.
+func handleVerify(conn net.Conn, clientIP string, info []string, tlog *transferLog) bool {
+	if len(info) != verifyFields {
+		tlog.Warn("malformed verify request", "client_ip", clientIP, "fields", len(info))
+		rejectConnection(conn, "malformed file info")
+		return false
+	}
+	if version, err := strconv.Atoi(info[vfFieldVersion]); err != nil || version != ProtocolVersion {
+		tlog.Warn("unsupported protocol version", "client_ip", clientIP, "version", info[vfFieldVersion])
+		rejectConnection(conn, fmt.Sprintf("%s %s, server speaks %d", protocolMismatch, info[vfFieldVersion], ProtocolVersion))
+		return false
+	}
+	if !authenticate(strings.Join(info[:vfFieldAuth], "|"), info[vfFieldAuth]) {
+		tlog.Warn("rejected verify request with invalid token HMAC", "client_ip", clientIP)
+		rejectConnection(conn, authFailed)
+		return false
+	}
+	fileName, err := sanitizeFileName(info[vfFieldName])
+	if err != nil {
+		tlog.Warn("rejected file name", "client_ip", clientIP, "err", err)
+		rejectConnection(conn, "invalid file name")
+		return false
+	}
+	dest, err := sanitizeDestDir(info[vfFieldDest])
+	if err != nil {
+		tlog.Warn("rejected destination directory", "client_ip", clientIP, "err", err)
+		rejectConnection(conn, "invalid destination")
+		return false
+	}
+	if dest != "" {
+		fileName = path.Join(dest, fileName)
+	}
+	fileName = canonicalFileName(fileName)
+	newHash, ok := hashAlgorithms[info[vfFieldHashAlgo]]
+	if !ok {
+		tlog.Warn("unsupported hash algorithm", "client_ip", clientIP, "hash_algorithm", info[vfFieldHashAlgo])
+		rejectConnection(conn, unsupportedHash)
+		return false
+	}
+
+	stat, err := storage.Stat(fileName)
+	if err != nil || stat.IsDir() {
+		tlog.Warn("rejected verify request for missing file", "client_ip", clientIP, "file", fileName, "err", err)
+		rejectConnection(conn, fileNotFound)
+		return false
+	}
+	fileHash, err := calculateFileHash(fileName, newHash)
+	if err != nil {
+		tlog.Error("error hashing file", "client_ip", clientIP, "file", fileName, "err", err)
+		rejectConnection(conn, fileNotFound)
+		return false
+	}
+
+	result := verifyMatch
+	if !strings.EqualFold(fileHash, info[vfFieldHash]) {
+		result = verifyMismatch
+		tlog.Warn("stored file does not match the client's hash", "client_ip", clientIP, "file", fileName, "expected", info[vfFieldHash], "hash", fileHash)
+	} else {
+		tlog.Info("stored file verified", "client_ip", clientIP, "file", fileName, "hash", fileHash)
+	}
+	reply := strings.Join([]string{result, fileHash, strconv.FormatInt(stat.Size(), 10)}, "|")
+	if err := writeFrame(conn, []byte(reply)); err != nil {
+		tlog.Warn("error sending verify result", "client_ip", clientIP, "err", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookURL receives a JSON POST for every finished transfer (-webhook).
+var webhookURL string
+
+const (
+	webhookTimeout  = 5 * time.Second
+	webhookAttempts = 3
+	webhookBackoff  = time.Second
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookPayload is the body posted to -webhook when a transfer completes
+// or fails.
+type webhookPayload struct {
+	TransferID    string    `json:"transfer_id"`
+	Time          time.Time `json:"time"`
+	ClientIP      string    `json:"client_ip"`
+	FileName      string    `json:"file_name"`
+	FileSize      int64     `json:"file_size"`
+	Received      int64     `json:"received"`
+	Hash          string    `json:"hash,omitempty"`
+	HashAlgorithm string    `json:"hash_algorithm,omitempty"`
+	Status        string    `json:"status"`
+	Duration      float64   `json:"duration_seconds"`
+}
+
+// notifyWebhook posts the final state of client in the background, trying
+// a few times before giving up so a slow endpoint never holds up transfers.
+func notifyWebhook(client *Client, fileSize int64) {
+	if webhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(webhookPayload{
+		TransferID:    client.ID,
+		Time:          time.Now(),
+		ClientIP:      client.IP,
+		FileName:      client.FileName,
+		FileSize:      fileSize,
+		Received:      client.Received,
+		Hash:          client.CalculatedHash,
+		HashAlgorithm: client.HashAlgorithm,
+		Status:        client.Status,
+		Duration:      time.Since(client.StartTime).Seconds(),
+	})
+	if err != nil {
+		logError("failed to encode webhook payload", "transfer", client.ID, "err", err)
+		return
+	}
+	go func() {
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			err = postWebhook(body)
+			if err == nil {
+				return
+			}
+			if attempt < webhookAttempts {
+				time.Sleep(webhookBackoff)
+			}
+		}
+		logError("webhook failed", "transfer", client.ID, "attempts", webhookAttempts, "err", err)
+	}()
+}
+
+func postWebhook(body []byte) error {
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}